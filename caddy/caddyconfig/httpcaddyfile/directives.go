@@ -62,6 +62,7 @@ var directiveOrder = []string{
 	"request_header",
 	"encode",
 	"push",
+	"cachev2",
 	"templates",
 
 	// special routing & dispatching directives
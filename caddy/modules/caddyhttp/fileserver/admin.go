@@ -0,0 +1,402 @@
+package fileserver
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(adminCacheV2{})
+}
+
+// adminCacheV2 is a module that provides the /cachev2/ endpoints
+// of the Caddy admin API, with which the token stores and the
+// memoized pages of CacheV2 handlers can be inspected, seeded
+// and purged while the server runs:
+//
+//	GET    /cachev2/stores                     lists the token stores
+//	GET    /cachev2/stores/<name>/tokens       lists the tokens of a store
+//	POST   /cachev2/stores/<name>/tokens       seeds tokens, given by URL
+//	DELETE /cachev2/stores/<name>/tokens       deletes tokens
+//	POST   /cachev2/stores/<name>/refresh      revalidates tokens
+//	GET    /cachev2/pages                      lists the memoized pages
+//	DELETE /cachev2/pages                      flushes memoized pages
+//
+// Endpoints that act on tokens or pages act on all of them, or on
+// the one whose absolute URL is given in the `url` query parameter.
+// Pages may also be selected by the `path` of their URL. A selected
+// page which is not in memory is listed with its current manifest.
+type adminCacheV2 struct{}
+
+// storeInfo describes a token store.
+type storeInfo struct {
+	Name   string `json:"name"`
+	Tokens int    `json:"tokens"`
+}
+
+// pageInfo describes a memoized page.
+type pageInfo struct {
+	URL        string          `json:"url"`
+	SourceEtag string          `json:"source_etag"`
+	Streamed   bool            `json:"streamed,omitempty"`
+	Manifest   json.RawMessage `json:"manifest,omitempty"`
+
+	// whether the page is not in memory, and its manifest
+	// was computed for the request
+	Computed bool `json:"computed,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (adminCacheV2) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.cachev2",
+		New: func() caddy.Module { return new(adminCacheV2) },
+	}
+}
+
+// Routes returns a route for the /cachev2/ endpoints.
+func (a adminCacheV2) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/cachev2/",
+			Handler: caddy.AdminHandlerFunc(a.handleAPIEndpoints),
+		},
+	}
+}
+
+// handleAPIEndpoints routes the request to the handler of its endpoint.
+func (a adminCacheV2) handleAPIEndpoints(w http.ResponseWriter, r *http.Request) error {
+	uri := strings.TrimSuffix(strings.TrimPrefix(r.URL.EscapedPath(), "/cachev2/"), "/")
+	parts := strings.Split(uri, "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "stores":
+		return a.handleStores(w, r)
+	case len(parts) == 1 && parts[0] == "pages":
+		return a.handlePages(w, r)
+	case len(parts) == 3 && parts[0] == "stores":
+		name, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid store name: %v", err),
+			}
+		}
+		store, ok := lookupEtagStore(name)
+		if !ok {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("unknown store: %s", name),
+			}
+		}
+		switch parts[2] {
+		case "tokens":
+			return a.handleTokens(w, r, store)
+		case "refresh":
+			return a.handleRefresh(w, r, store)
+		}
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+	}
+}
+
+// handleStores lists the token stores in use.
+func (adminCacheV2) handleStores(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+	stores := []storeInfo{}
+	etagStores.Range(func(key, val any) bool {
+		name, ok := key.(string)
+		s, ok2 := val.(*persistedEtagStore)
+		if ok && ok2 {
+			stores = append(stores, storeInfo{Name: name, Tokens: s.Len()})
+		}
+		return true
+	})
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+	return writeJSON(w, stores)
+}
+
+// handleTokens lists, seeds or deletes the tokens of store.
+func (adminCacheV2) handleTokens(w http.ResponseWriter, r *http.Request, store *EtagStore) error {
+	key := r.URL.Query().Get("url")
+	switch r.Method {
+	case http.MethodGet:
+		if key == "" {
+			return writeJSON(w, store.statuses())
+		}
+		status, ok := store.status(key)
+		if !ok {
+			return errUnknownToken(key)
+		}
+		return writeJSON(w, status)
+
+	case http.MethodPost:
+		var tokens map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&tokens); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding tokens: %v", err),
+			}
+		}
+		for key, etag := range tokens {
+			u, err := url.Parse(key)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        fmt.Errorf("not an absolute http(s) URL: %q", key),
+				}
+			}
+			if etag == "" {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        fmt.Errorf("empty token for %s", key),
+				}
+			}
+		}
+		for key, etag := range tokens {
+			store.Set(key, etag)
+		}
+		return nil
+
+	case http.MethodDelete:
+		if key == "" {
+			store.Clear()
+			return nil
+		}
+		if !store.Delete(key) {
+			return errUnknownToken(key)
+		}
+		return nil
+	}
+	return errMethodNotAllowed
+}
+
+// handleRefresh revalidates the tokens of store with their origins. A
+// single token is revalidated before the response, with its new status;
+// all tokens are revalidated in the background by the store's refresh
+// loop, so that concurrent requests do not start concurrent refreshes.
+func (adminCacheV2) handleRefresh(w http.ResponseWriter, r *http.Request, store *EtagStore) error {
+	if r.Method != http.MethodPost {
+		return errMethodNotAllowed
+	}
+	key := r.URL.Query().Get("url")
+	if key == "" {
+		store.refreshSoon()
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	if !store.has(key) {
+		return errUnknownToken(key)
+	}
+	store.revalidate(key)
+	status, ok := store.status(key)
+	if !ok {
+		return errUnknownToken(key)
+	}
+	return writeJSON(w, status)
+}
+
+// handlePages lists or flushes the pages which the CacheV2 handlers
+// memoized, along with the manifests last computed for them. A single
+// page which no handler memoized is computed by the handlers on demand.
+func (adminCacheV2) handlePages(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	key, path := query.Get("url"), query.Get("path")
+	selects := func(p *rewrittenPage) bool {
+		if key != "" {
+			return p.key == key
+		}
+		if path != "" {
+			u, err := url.Parse(p.key)
+			return err == nil && u.Path == path
+		}
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		pages := []pageInfo{}
+		for _, e := range cacheV2Engines.list() {
+			for _, p := range e.pages.list() {
+				if !selects(p) {
+					continue
+				}
+				info := pageInfo{URL: p.key, SourceEtag: p.sourceEtag, Streamed: p.streamed}
+				if m := p.lastManifest(); json.Valid(m) {
+					info.Manifest = m
+				}
+				pages = append(pages, info)
+			}
+		}
+		if len(pages) == 0 && (key != "" || path != "") {
+			target, err := pageURL(key, path)
+			if err != nil {
+				return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+			}
+			for _, e := range cacheV2Engines.list() {
+				if info, ok := e.computePage(target); ok {
+					pages = append(pages, info)
+				}
+			}
+			if len(pages) == 0 {
+				return caddy.APIError{
+					HTTPStatus: http.StatusNotFound,
+					Err:        fmt.Errorf("no page at %s", target),
+				}
+			}
+		}
+		sort.SliceStable(pages, func(i, j int) bool { return pages[i].URL < pages[j].URL })
+		return writeJSON(w, pages)
+
+	case http.MethodDelete:
+		for _, e := range cacheV2Engines.list() {
+			if key == "" && path == "" {
+				// the encoded variants are keyed by content, so
+				// they only go stale when all pages are flushed
+				e.pages.clear()
+				e.variants.clear()
+				continue
+			}
+			for _, p := range e.pages.list() {
+				if selects(p) {
+					e.pages.remove(p.key)
+				}
+			}
+		}
+		return nil
+	}
+	return errMethodNotAllowed
+}
+
+// pageURL returns the URL of the page selected by the absolute URL key
+// or, if it is empty, by path. Pages selected by path are computed as
+// if they were requested at localhost; the host only decides which
+// resources are cross-origin.
+func pageURL(key, path string) (*url.URL, error) {
+	if key == "" {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("not an absolute path: %q", path)
+		}
+		return &url.URL{Scheme: "http", Host: "localhost", Path: path}, nil
+	}
+	u, err := url.Parse(key)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("not an absolute http(s) URL: %q", key)
+	}
+	return normalizeURL(u), nil
+}
+
+// computePage computes the manifest of the page at target, which is not
+// memoized, from its dependencies in the manifest index if it has them
+// for the current version of the page, or else by reading the page with
+// the resolver and crawling it. It returns false if the page cannot be
+// resolved. Directories are read as their index.html file. Placeholders
+// are evaluated with the variables of the last page request, so that
+// the root of the site is the one set for it.
+func (e *cacheV2Engine) computePage(target *url.URL) (pageInfo, bool) {
+	r, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return pageInfo{}, false
+	}
+	if target.Scheme == "https" {
+		r.TLS = new(tls.ConnectionState)
+	}
+	r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), nil, nil)
+	if vars, ok := e.pageVars.Load().(map[string]any); ok {
+		for k, v := range vars {
+			caddyhttp.SetVar(r.Context(), k, v)
+		}
+	}
+
+	file := target.Path
+	if strings.HasSuffix(file, "/") {
+		file += "index.html"
+	}
+	sourceEtag, _ := e.resolver.ResolveETag(r, file)
+
+	var tokens map[string]string
+	var ok bool
+	if deps := e.index.dependencies(target, sourceEtag); deps != nil {
+		tokens, ok = e.crawler.refresh(r, deps)
+	}
+	if !ok {
+		opener, isOpener := e.resolver.(ResourceOpener)
+		if !isOpener {
+			return pageInfo{}, false
+		}
+		rc, err := opener.OpenResource(r, file)
+		if err != nil {
+			return pageInfo{}, false
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return pageInfo{}, false
+		}
+		if _, tokens, err = parsePage(r, e.crawler, content); err != nil {
+			return pageInfo{}, false
+		}
+	}
+
+	manifest, err := encodeManifest(tokens, target)
+	if err != nil {
+		return pageInfo{}, false
+	}
+	return pageInfo{URL: target.String(), SourceEtag: sourceEtag, Manifest: manifest, Computed: true}, true
+}
+
+// lookupEtagStore returns the token store with the given name, if a
+// handler uses it.
+func lookupEtagStore(name string) (*EtagStore, bool) {
+	var store *EtagStore
+	etagStores.Range(func(key, val any) bool {
+		if key == name {
+			if s, ok := val.(*persistedEtagStore); ok {
+				store = s.EtagStore
+			}
+			return false
+		}
+		return true
+	})
+	return store, store != nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("encoding response: %v", err),
+		}
+	}
+	return nil
+}
+
+func errUnknownToken(key string) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("no token for %s", key),
+	}
+}
+
+var errMethodNotAllowed = caddy.APIError{
+	HTTPStatus: http.StatusMethodNotAllowed,
+	Err:        fmt.Errorf("method not allowed"),
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminCacheV2)(nil)
+)
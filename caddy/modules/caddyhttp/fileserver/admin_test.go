@@ -0,0 +1,182 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// callAdmin sends a request to the CacheV2 admin endpoints and returns
+// the status and body of the response.
+func callAdmin(t *testing.T, method, target, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	if err := (adminCacheV2{}).handleAPIEndpoints(rr, req); err != nil {
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+		return apiErr.HTTPStatus, apiErr.Err.Error()
+	}
+	return rr.Code, rr.Body.String()
+}
+
+func TestAdminTokens(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v2"`)
+	}))
+	defer origin.Close()
+	script := origin.URL + "/a.js"
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	cfg := CacheV2Config{StoreName: "admin-test"}
+	cfg.provision()
+	store, err := loadEtagStore(storage, cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, body := callAdmin(t, http.MethodPost, "/cachev2/stores/admin-test/tokens", `{"`+script+`": "\"v1\""}`); code != http.StatusOK {
+		t.Fatalf("seeding: %d %s", code, body)
+	}
+	if code, _ := callAdmin(t, http.MethodPost, "/cachev2/stores/admin-test/tokens", `{"/a.js": "\"v1\""}`); code != http.StatusBadRequest {
+		t.Errorf("expected relative URLs to be rejected, got %d", code)
+	}
+	_, body := callAdmin(t, http.MethodGet, "/cachev2/stores", "")
+	if !strings.Contains(body, `{"name":"admin-test","tokens":1}`) {
+		t.Errorf("expected the store to be listed, got %s", body)
+	}
+
+	var status tokenStatus
+	_, body = callAdmin(t, http.MethodGet, "/cachev2/stores/admin-test/tokens?url="+url.QueryEscape(script), "")
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ETag != `"v1"` || status.Status != "unvalidated" {
+		t.Errorf("expected the seeded token, got %+v", status)
+	}
+
+	_, body = callAdmin(t, http.MethodPost, "/cachev2/stores/admin-test/refresh?url="+url.QueryEscape(script), "")
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ETag != `"v2"` || status.Status != "validated" || status.Validated == nil {
+		t.Errorf("expected the refreshed token, got %+v", status)
+	}
+
+	// refreshing all tokens is left to the store's refresh loop, and
+	// requests made before it gets to them are merged
+	store.Set(script, `"v1"`)
+	for i := 0; i < 3; i++ {
+		if code, _ := callAdmin(t, http.MethodPost, "/cachev2/stores/admin-test/refresh", ""); code != http.StatusAccepted {
+			t.Errorf("expected the refresh to be accepted, got %d", code)
+		}
+	}
+	eventually(t, "the token is refreshed", func() bool {
+		etag, _ := store.Get(script)
+		return etag == `"v2"`
+	})
+
+	// deleted tokens are not merged back from the snapshot
+	data, err := json.Marshal(map[string]storedToken{script: {ETag: `"v1"`, Expires: time.Now().Add(time.Hour)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(context.Background(), etagStoreKey(cfg.StoreName), data); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := callAdmin(t, http.MethodDelete, "/cachev2/stores/admin-test/tokens?url="+url.QueryEscape(script), ""); code != http.StatusOK {
+		t.Errorf("expected the token to be deleted, got %d", code)
+	}
+	if code, _ := callAdmin(t, http.MethodGet, "/cachev2/stores/admin-test/tokens?url="+url.QueryEscape(script), ""); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for the deleted token, got %d", code)
+	}
+	if _, err := etagStores.Delete(cfg.StoreName); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := loadEtagStore(storage, cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer etagStores.Delete(cfg.StoreName)
+	if _, ok := restarted.Get(script); ok {
+		t.Error("expected the deleted token to stay deleted")
+	}
+
+	if code, _ := callAdmin(t, http.MethodGet, "/cachev2/stores/unknown/tokens", ""); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown store, got %d", code)
+	}
+	if code, _ := callAdmin(t, http.MethodPut, "/cachev2/stores/admin-test/tokens", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", code)
+	}
+}
+
+func TestAdminPages(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "logo.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: "{http.vars.root}", fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheV2Engines.add(e)
+	defer cacheV2Engines.remove(e)
+
+	req := caddyhttp.PrepareRequest(httptest.NewRequest(http.MethodGet, "/", nil), caddy.NewReplacer(), nil, nil)
+	caddyhttp.SetVar(req.Context(), "root", root)
+	page := []byte(`<html><head></head><body><img src="/logo.png"></body></html>`)
+	if _, _, err := e.rewrite(httptest.NewRecorder(), req, `"a"`, func() ([]byte, error) { return page, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	var pages []pageInfo
+	_, body := callAdmin(t, http.MethodGet, "/cachev2/pages?path=/", "")
+	if err := json.Unmarshal([]byte(body), &pages); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || pages[0].SourceEtag != `"a"` || !strings.Contains(string(pages[0].Manifest), "logo.png") {
+		t.Fatalf("expected the page with its manifest, got %s", body)
+	}
+
+	// pages not in memory are computed on demand, in the root of the site
+	about := `<html><head><link rel="icon" href="logo.png"></head><body></body></html>`
+	if err := os.WriteFile(filepath.Join(root, "about.html"), []byte(about), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pages = nil
+	_, body = callAdmin(t, http.MethodGet, "/cachev2/pages?path=/about.html", "")
+	if err := json.Unmarshal([]byte(body), &pages); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || !pages[0].Computed || pages[0].SourceEtag == "" || !strings.Contains(string(pages[0].Manifest), "logo.png") {
+		t.Errorf("expected the manifest of the page to be computed, got %s", body)
+	}
+	if _, ok := e.pages.get("http://localhost/about.html"); ok {
+		t.Error("expected the computed page not to be memoized")
+	}
+	if code, _ := callAdmin(t, http.MethodGet, "/cachev2/pages?path=/missing.html", ""); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a page that cannot be resolved, got %d", code)
+	}
+
+	if code, _ := callAdmin(t, http.MethodDelete, "/cachev2/pages?url="+url.QueryEscape(pages[0].URL), ""); code != http.StatusOK {
+		t.Errorf("expected the page to be flushed, got %d", code)
+	}
+	if _, ok := e.pages.get(pages[0].URL); ok {
+		t.Error("expected the page to be gone")
+	}
+}
@@ -0,0 +1,1193 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+)
+
+func init() {
+	caddy.RegisterModule(CacheV2{})
+}
+
+// CacheV2 is a middleware which implements the CacheV2 validation token
+// scheme in front of any handler, for example `reverse_proxy`, `templates`
+// or `respond`; the file server has the same functionality built in.
+//
+// When a client announces support for the scheme with the
+// `X-CacheV2-Extension-Enabled: true` request header, HTML responses
+// of the next handlers are buffered, a script that registers the
+// `/sw.js` service worker is injected into them, and the validation
+// tokens of the sub-resources they reference are sent to the client
+// in the `X-Etag-Config` response header. Tokens are looked up with
+// the configured resolver.
+//
+// The handler also serves the service worker itself and the
+// `/proxy-resource` endpoint which the service worker uses to
+// fetch cross-origin resources. All of these names are configurable.
+type CacheV2 struct {
+	CacheV2Config
+
+	// The resolver used to look up the validation tokens of sub-resources.
+	// Default: `file`, which uses the files in the site root.
+	ResolverRaw json.RawMessage `json:"resolver,omitempty" caddy:"namespace=http.handlers.cachev2.resolvers inline_key=source"`
+
+	engine *cacheV2Engine
+}
+
+// CacheV2Config holds the settings of the CacheV2 validation token
+// scheme, which are shared by the file server and the cachev2 handler.
+type CacheV2Config struct {
+	// Turns CacheV2 off, so that requests pass through untouched.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// The request header with which clients enable CacheV2. Its
+	// value must be `true`. Default: `X-CacheV2-Extension-Enabled`.
+	TriggerHeader string `json:"trigger_header,omitempty"`
+
+	// The response header which carries the validation tokens of
+	// the sub-resources of a page. Default: `X-Etag-Config`.
+	ManifestHeader string `json:"manifest_header,omitempty"`
+
+	// The maximum size of the manifest header. Manifests of pages with
+	// more tokens are served by the manifest endpoint instead, and the
+	// header references them. Default: 4KiB.
+	ManifestMaxSize int64 `json:"manifest_max_size,omitempty"`
+
+	// Compresses the manifest header with gzip where that makes it shorter.
+	CompressManifest bool `json:"compress_manifest,omitempty"`
+
+	// The path prefix of the endpoint which serves manifests that are
+	// too large for the header. Default: `/cachev2-manifest`.
+	ManifestPrefix string `json:"manifest_prefix,omitempty"`
+
+	// How the manifest of a page is delivered to the service worker: any of
+	// `header` (in the manifest header), `inline` (in a JSON script at the
+	// start of the page) and `url` (by the manifest endpoint, which the
+	// header and the page reference). With `inline` and `url`, the page
+	// hands the manifest to the service worker, so that it has the tokens
+	// on the first visit, too. Default: `header`.
+	//
+	// `early_hints` does not deliver the manifest, since service workers
+	// cannot read 103 responses: it sends a 103 Early Hints response with
+	// `Link` preload hints for the resources the page had when it was last
+	// served, before the page itself is produced. It is combined with
+	// `header` if given alone.
+	ManifestDelivery []string `json:"manifest_delivery,omitempty"`
+
+	// The path prefix of the endpoint through which the service worker
+	// fetches cross-origin resources. Default: `/proxy-resource`.
+	ProxyPrefix string `json:"proxy_prefix,omitempty"`
+
+	// Disables the proxy endpoint; the service worker then fetches
+	// cross-origin resources directly from their origin.
+	DisableProxy bool `json:"disable_proxy,omitempty"`
+
+	// The path at which the service worker is served. Default: `/sw.js`.
+	ServiceWorkerPath string `json:"service_worker_path,omitempty"`
+
+	// How often the validation tokens of cross-origin resources are
+	// refreshed. Default: 10m.
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// The maximum size of the rewritten pages kept in memory, so that
+	// pages whose documents did not change are not parsed again; then
+	// only the tokens of their sub-resources are resolved. Default: 32MiB.
+	RewriteCacheSize int64 `json:"rewrite_cache_size,omitempty"`
+
+	// HTML documents at least this large, and responses of the cachev2
+	// handler of unknown length, are rewritten while they are streamed
+	// to the client, rather than read and parsed as a whole first. The
+	// manifest of a streamed page is known before its response only from
+	// an earlier response with the same document; otherwise, it is sent
+	// at the end of the page and in a trailer. Only uncompressed
+	// responses are streamed. Default: 0, which streams no pages.
+	StreamThreshold int64 `json:"stream_threshold,omitempty"`
+
+	// The file with the dependencies of the pages of the site which the
+	// `caddy cachev2 --index` command wrote, so that the manifests of
+	// streamed pages are known before they are first served, and the
+	// proxy accepts the cross-origin resources of all pages right away.
+	// Entries of pages whose HTML files changed since are ignored.
+	ManifestIndex string `json:"manifest_index,omitempty"`
+
+	// Watches the site root for changes and keeps the validation tokens
+	// of the files below it in memory, so that they are not looked up on
+	// disk for every page; rewritten pages are dropped from memory when
+	// the files they depend on change. Applies to the default `file`
+	// resolver, on the local disk file system only.
+	Watch bool `json:"watch,omitempty"`
+
+	// How many levels of references in local style sheets (`@import`,
+	// `url()`) and scripts (ES module imports) to follow, so that the
+	// resources they load get validation tokens too. Default: 0, which
+	// only covers the resources referenced by the page itself.
+	CrawlDepth int `json:"crawl_depth,omitempty"`
+
+	// The maximum number of bytes of style sheets and scripts to read
+	// when following references for a page. Default: 5MiB.
+	CrawlBudget int64 `json:"crawl_budget,omitempty"`
+
+	// The name of the store of cross-origin validation tokens. Handlers
+	// with the same store name share one store, which is kept across
+	// config reloads; its settings are those of the handler that created
+	// it. Default: `default`.
+	StoreName string `json:"store_name,omitempty"`
+
+	// The storage to which the token store is saved, so that it survives
+	// restarts and is shared by all instances which use the same storage.
+	// Default: the storage configured globally.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// How often the token store is merged with the tokens in storage,
+	// which other instances may have added, and saved. Default: 1m.
+	SnapshotInterval caddy.Duration `json:"snapshot_interval,omitempty"`
+
+	// The transport with which the proxy fetches resources and the token
+	// store refreshes them, e.g. to configure TLS, timeouts, connection
+	// pooling and HTTP versions like for `reverse_proxy`. Only the `http`
+	// transport is supported, without the `h2c` version; requests go
+	// through it like those of `reverse_proxy`, so all of its options
+	// apply, and the proxy restrictions below apply on top of it.
+	// Default: the `http` transport with its defaults.
+	TransportRaw json.RawMessage `json:"transport,omitempty" caddy:"namespace=http.reverse_proxy.transport inline_key=protocol"`
+
+	// Hosts from which the proxy may fetch resources, like `cdn.example.com`
+	// or `*.example.com` for all subdomains. Default: all hosts that are
+	// not denied.
+	ProxyAllowHosts []string `json:"proxy_allow_hosts,omitempty"`
+
+	// Hosts from which the proxy must not fetch resources, in the
+	// same form as the allowed hosts. Denying takes precedence.
+	ProxyDenyHosts []string `json:"proxy_deny_hosts,omitempty"`
+
+	// IP ranges (CIDRs or single addresses) to which the proxy may connect
+	// although they are not public, e.g. for an internal CDN. By default,
+	// the proxy never connects to loopback, private, link-local or other
+	// special-purpose addresses, which is checked when connecting, so DNS
+	// rebinding cannot get around it.
+	ProxyAllowRanges []string `json:"proxy_allow_ranges,omitempty"`
+
+	// The maximum size of a proxied response body. Default: 10MiB.
+	ProxyMaxSize int64 `json:"proxy_max_size,omitempty"`
+
+	// How long a proxied request may take, including reading
+	// the response body. Default: 30s.
+	ProxyTimeout caddy.Duration `json:"proxy_timeout,omitempty"`
+
+	// Lets the proxy fetch any URL of an allowed host. By default, it only
+	// fetches cross-origin resources which pages of the site referenced,
+	// or whose tokens are in the store.
+	ProxyAnyURL bool `json:"proxy_any_url,omitempty"`
+
+	// Turns off the cache of proxied responses, so that every request
+	// to the proxy goes to the origin.
+	DisableProxyCache bool `json:"disable_proxy_cache,omitempty"`
+
+	// The maximum size of the proxied responses the cache keeps in
+	// memory. Handlers with the same store name share the cache, whose
+	// settings are those of the handler that created it. Default: 64MiB.
+	ProxyCacheMemory int64 `json:"proxy_cache_memory,omitempty"`
+
+	// The directory in which the cache keeps the proxied responses it
+	// evicts from memory. No other cache may use it. Default: none, so
+	// responses are kept in memory only.
+	ProxyCacheDir string `json:"proxy_cache_dir,omitempty"`
+
+	// The maximum size of the proxied responses in the cache
+	// directory. Default: 1GiB.
+	ProxyCacheDiskSize int64 `json:"proxy_cache_disk_size,omitempty"`
+
+	// Keeps the token store in memory only.
+	DisablePersistence bool `json:"disable_persistence,omitempty"`
+
+	// The maximum number of tokens in the store. Beyond it, the least
+	// recently used ones are evicted. Default: 10000.
+	StoreMaxEntries int `json:"store_max_entries,omitempty"`
+
+	// How long a token is kept in the store after a client last fetched
+	// the resource through the proxy. Default: 24h.
+	StoreTTL caddy.Duration `json:"store_ttl,omitempty"`
+
+	// The maximum number of concurrent requests with which the tokens
+	// in the store are refreshed. Default: 8.
+	RefreshWorkers int `json:"refresh_workers,omitempty"`
+
+	// The maximum number of concurrent refresh requests to a
+	// single host. Default: 2.
+	RefreshPerHost int `json:"refresh_per_host,omitempty"`
+}
+
+// provision fills in the defaults of unset options.
+func (cfg *CacheV2Config) provision() {
+	if cfg.TriggerHeader == "" {
+		cfg.TriggerHeader = "X-CacheV2-Extension-Enabled"
+	}
+	if cfg.ManifestHeader == "" {
+		cfg.ManifestHeader = "X-Etag-Config"
+	}
+	if cfg.ManifestMaxSize == 0 {
+		cfg.ManifestMaxSize = 4 << 10
+	}
+	if cfg.ManifestPrefix == "" {
+		cfg.ManifestPrefix = "/cachev2-manifest"
+	}
+	if len(cfg.ManifestDelivery) == 0 {
+		cfg.ManifestDelivery = []string{deliverHeader}
+	}
+	if len(cfg.ManifestDelivery) == 1 && cfg.ManifestDelivery[0] == deliverEarlyHints {
+		cfg.ManifestDelivery = append(cfg.ManifestDelivery, deliverHeader)
+	}
+	if cfg.ProxyPrefix == "" {
+		cfg.ProxyPrefix = "/proxy-resource"
+	}
+	if cfg.ServiceWorkerPath == "" {
+		cfg.ServiceWorkerPath = "/sw.js"
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = caddy.Duration(10 * time.Minute)
+	}
+	if cfg.RewriteCacheSize == 0 {
+		cfg.RewriteCacheSize = 32 << 20
+	}
+	if cfg.CrawlBudget == 0 {
+		cfg.CrawlBudget = 5 << 20
+	}
+	if cfg.ProxyMaxSize == 0 {
+		cfg.ProxyMaxSize = 10 << 20
+	}
+	if cfg.ProxyTimeout == 0 {
+		cfg.ProxyTimeout = caddy.Duration(30 * time.Second)
+	}
+	if cfg.ProxyCacheMemory == 0 {
+		cfg.ProxyCacheMemory = 64 << 20
+	}
+	if cfg.ProxyCacheDiskSize == 0 {
+		cfg.ProxyCacheDiskSize = 1 << 30
+	}
+	if cfg.StoreName == "" {
+		cfg.StoreName = "default"
+	}
+	if cfg.SnapshotInterval == 0 {
+		cfg.SnapshotInterval = caddy.Duration(time.Minute)
+	}
+}
+
+// storeOptions returns the options of the token store of cfg.
+func (cfg CacheV2Config) storeOptions() EtagStoreOptions {
+	return EtagStoreOptions{
+		Interval:   time.Duration(cfg.RefreshInterval),
+		MaxEntries: cfg.StoreMaxEntries,
+		TTL:        time.Duration(cfg.StoreTTL),
+		Workers:    cfg.RefreshWorkers,
+		PerHost:    cfg.RefreshPerHost,
+		Name:       cfg.StoreName,
+	}
+}
+
+// validate ensures cfg is a valid configuration.
+func (cfg CacheV2Config) validate() error {
+	if cfg.ProxyPrefix != "" && !strings.HasPrefix(cfg.ProxyPrefix, "/") {
+		return fmt.Errorf("proxy prefix must start with '/': %s", cfg.ProxyPrefix)
+	}
+	if cfg.ManifestPrefix != "" && !strings.HasPrefix(cfg.ManifestPrefix, "/") {
+		return fmt.Errorf("manifest prefix must start with '/': %s", cfg.ManifestPrefix)
+	}
+	if cfg.ManifestMaxSize < 0 {
+		return fmt.Errorf("manifest max size must not be negative")
+	}
+	for _, mode := range cfg.ManifestDelivery {
+		switch mode {
+		case deliverHeader, deliverInline, deliverEarlyHints, deliverURL:
+		default:
+			return fmt.Errorf("unrecognized manifest delivery '%s'", mode)
+		}
+	}
+	if cfg.ServiceWorkerPath != "" && !strings.HasPrefix(cfg.ServiceWorkerPath, "/") {
+		return fmt.Errorf("service worker path must start with '/': %s", cfg.ServiceWorkerPath)
+	}
+	if cfg.RefreshInterval < 0 || cfg.SnapshotInterval < 0 {
+		return fmt.Errorf("refresh and snapshot intervals must not be negative")
+	}
+	if cfg.RewriteCacheSize < 0 {
+		return fmt.Errorf("rewrite cache size must not be negative")
+	}
+	if cfg.StreamThreshold < 0 {
+		return fmt.Errorf("stream threshold must not be negative")
+	}
+	if cfg.CrawlDepth < 0 || cfg.CrawlBudget < 0 {
+		return fmt.Errorf("crawl depth and budget must not be negative")
+	}
+	if cfg.ProxyMaxSize < 0 || cfg.ProxyTimeout < 0 {
+		return fmt.Errorf("proxy size and timeout must not be negative")
+	}
+	if cfg.ProxyCacheMemory < 0 || cfg.ProxyCacheDiskSize < 0 {
+		return fmt.Errorf("proxy cache sizes must not be negative")
+	}
+	for _, s := range cfg.ProxyAllowRanges {
+		if _, err := parseIPRange(s); err != nil {
+			return err
+		}
+	}
+	for _, host := range append(cfg.ProxyAllowHosts, cfg.ProxyDenyHosts...) {
+		if host == "" || strings.ContainsAny(host, "/:") {
+			return fmt.Errorf("invalid proxy host '%s'", host)
+		}
+	}
+	if cfg.StoreMaxEntries < 0 || cfg.StoreTTL < 0 || cfg.RefreshWorkers < 0 || cfg.RefreshPerHost < 0 {
+		return fmt.Errorf("store and refresh limits must not be negative")
+	}
+	return nil
+}
+
+// CaddyModule returns the Caddy module information.
+func (CacheV2) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.cachev2",
+		New: func() caddy.Module { return new(CacheV2) },
+	}
+}
+
+// Provision sets up the CacheV2 handler.
+func (c *CacheV2) Provision(ctx caddy.Context) error {
+	var resolver ETagResolver
+	if c.ResolverRaw != nil {
+		mod, err := ctx.LoadModule(c, "ResolverRaw")
+		if err != nil {
+			return fmt.Errorf("loading resolver module: %v", err)
+		}
+		resolver = mod.(ETagResolver)
+	} else {
+		fr := &FileResolver{Watch: c.Watch}
+		if err := fr.Provision(ctx); err != nil {
+			return err
+		}
+		resolver = fr
+	}
+
+	engine, err := provisionCacheV2Engine(ctx, c.CacheV2Config, resolver)
+	if err != nil {
+		return err
+	}
+	c.engine = engine
+	return nil
+}
+
+// Cleanup releases the token store of the handler.
+func (c *CacheV2) Cleanup() error {
+	if c.engine == nil {
+		return nil
+	}
+	// loaded resolver modules are cleaned up with the config
+	if fr, ok := c.engine.resolver.(*FileResolver); ok && c.ResolverRaw == nil {
+		if err := fr.Cleanup(); err != nil {
+			return err
+		}
+	}
+	return c.engine.cleanup()
+}
+
+// Validate ensures c has a valid configuration.
+func (c *CacheV2) Validate() error {
+	return c.validate()
+}
+
+func (c *CacheV2) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if handled, err := c.engine.serveOwnRoutes(w, r); handled {
+		return err
+	}
+
+	// templates of the next handlers can look up tokens themselves,
+	// and file servers leave the pages to this handler
+	tokens := &templateTokens{engine: c.engine, w: w, r: r}
+	ctx := context.WithValue(r.Context(), templates.ValidationTokensCtxKey, tokens)
+	r = r.WithContext(context.WithValue(ctx, rewriterCtxKey, c.engine))
+
+	if !c.engine.enabledFor(r) {
+		vary := func(status int, header http.Header) bool {
+			c.engine.varyHTML(header)
+			return false
+		}
+		return next.ServeHTTP(caddyhttp.NewResponseRecorder(w, nil, vary), r)
+	}
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	// only HTML pages are rewritten, and only if we can read them;
+	// large pages and those of unknown length may be streamed instead
+	streamer := &pageStreamer{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		engine:                c.engine,
+		req:                   r,
+	}
+	shouldBuf := func(status int, header http.Header) bool {
+		c.engine.varyHTML(header)
+		if tokens.registered || c.engine.rewritten(header) {
+			return false
+		}
+		if status != http.StatusOK || !strings.Contains(header.Get("Content-Type"), "text/html") {
+			return false
+		}
+		coding := header.Get("Content-Encoding")
+		if coding == "" && c.engine.streams(contentLength(header)) {
+			streamer.streaming = true
+			return false
+		}
+		_, decodable := contentCodings[coding]
+		return coding == "" || decodable
+	}
+
+	rec := caddyhttp.NewResponseRecorder(streamer, buf, shouldBuf)
+	c.engine.sendEarlyHints(w, r)
+
+	// the next handlers must send the whole original document, since
+	// validators and ranges of the request refer to the rewritten one,
+	// which are evaluated below
+	err := next.ServeHTTP(rec, withoutConditionals(r))
+	if streamer.streaming {
+		if err := streamer.finish(err); err != nil {
+			c.engine.logger.Warn("failed to stream html for cachev2", zap.Error(err))
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if !rec.Buffered() {
+		return nil
+	}
+
+	// compressed pages are decoded for rewriting, and encoded
+	// again with the same coding afterwards
+	content := buf.Bytes()
+	hdr := rec.Header()
+	coding := hdr.Get("Content-Encoding")
+	if coding != "" {
+		content, err = decodeContent(coding, content)
+		if err != nil {
+			c.engine.logger.Warn("failed to decode html for cachev2", zap.String("coding", coding), zap.Error(err))
+			return rec.WriteResponse()
+		}
+	}
+	newContent, etag, err := c.engine.rewrite(w, r, hdr.Get("Etag"), func() ([]byte, error) { return content, nil })
+	if err != nil {
+		c.engine.logger.Warn("failed to rewrite html for cachev2", zap.Error(err))
+		return rec.WriteResponse()
+	}
+	if coding != "" {
+		newContent, err = c.engine.encodeContent(contentCodings[coding], newContent)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		etag = encodedEtag(etag, coding)
+	}
+
+	// the upstream validators describe the original document, not the
+	// rewritten one, so they are replaced, and conditional and range
+	// requests are answered for the rewritten document
+	hdr.Set("Etag", etag)
+	hdr.Del("Last-Modified")
+	hdr.Del("Content-Length")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(newContent))
+	return nil
+}
+
+// contentLength returns the length of a response with the header hdr,
+// or -1 if it is unknown.
+func contentLength(hdr http.Header) int64 {
+	n, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// pageStreamer passes the response of the next handlers through, or, once
+// it is streaming, feeds the body to the streaming rewriter, which writes
+// the response in its own goroutine.
+type pageStreamer struct {
+	*caddyhttp.ResponseWriterWrapper
+	engine    *cacheV2Engine
+	req       *http.Request
+	streaming bool
+
+	// set once the header is written
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (s *pageStreamer) WriteHeader(status int) {
+	if s.streaming {
+		if s.pw == nil {
+			s.start()
+		}
+		return
+	}
+	s.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (s *pageStreamer) Write(p []byte) (int, error) {
+	if s.streaming {
+		return s.pw.Write(p)
+	}
+	return s.ResponseWriterWrapper.Write(p)
+}
+
+func (s *pageStreamer) ReadFrom(r io.Reader) (int64, error) {
+	if s.streaming {
+		return io.Copy(s.pw, r)
+	}
+	return s.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// FlushError flushes the response, unless it is streaming, when the
+// rewriter writes it.
+func (s *pageStreamer) FlushError() error {
+	if s.streaming {
+		return nil
+	}
+	return http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// start starts rewriting the page which the next handlers write.
+func (s *pageStreamer) start() {
+	pr, pw := io.Pipe()
+	s.pw = pw
+	s.done = make(chan error, 1)
+	sourceEtag := s.Header().Get("Etag")
+	go func() {
+		err := s.engine.rewriteStream(s.ResponseWriter, s.req, sourceEtag, pr)
+		// the rest of the page, if any, is not needed anymore, as for
+		// HEAD requests; if rewriting failed, the next handlers fail
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			_, _ = io.Copy(io.Discard, pr)
+		}
+		s.done <- err
+	}()
+}
+
+// finish ends the page with the error of the next handlers, if any,
+// and returns once the page is rewritten.
+func (s *pageStreamer) finish(err error) error {
+	if s.pw == nil {
+		return nil
+	}
+	_ = s.pw.CloseWithError(err)
+	return <-s.done
+}
+
+// withoutConditionals returns r without the header fields that make
+// it a conditional or range request.
+func withoutConditionals(r *http.Request) *http.Request {
+	var found bool
+	for _, field := range conditionalHeaders {
+		if _, ok := r.Header[field]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return r
+	}
+	r2 := r.WithContext(r.Context())
+	r2.Header = r.Header.Clone()
+	for _, field := range conditionalHeaders {
+		r2.Header.Del(field)
+	}
+	return r2
+}
+
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"}
+
+// cacheV2Engine holds the CacheV2 state and behavior shared by the
+// file server and the standalone cachev2 handler.
+type cacheV2Engine struct {
+	config   CacheV2Config
+	resolver ETagResolver
+	crawler  *dependencyCrawler
+	store    *EtagStore
+	proxy    *resourceProxy
+	logger   *zap.Logger
+
+	// the manifests that were too large for the header
+	manifests *manifestSet
+
+	// the encoded variants of rewritten pages
+	variants *variantSet
+
+	// the pages prepared for rewriting
+	pages *pageCache
+
+	// the version of the injected scripts
+	scriptVer string
+
+	// the name under which store is held in etagStores, if any
+	storeName string
+
+	// stops the events of store, if they are emitted
+	unsubscribe func()
+
+	// emits the changes of watched files, if events are emitted
+	events *eventEmitter
+
+	// the dependencies of pages computed ahead of time, if any
+	index *manifestIndex
+
+	// a copy of the variables of the last page request, such as the
+	// site root, so that pages can be resolved outside of requests
+	pageVars atomic.Value // map[string]any
+}
+
+// engineSet holds the engines of the provisioned handlers, so that the
+// admin API can inspect and flush their pages.
+type engineSet struct {
+	mu      sync.Mutex
+	engines map[*cacheV2Engine]struct{}
+}
+
+var cacheV2Engines = &engineSet{engines: make(map[*cacheV2Engine]struct{})}
+
+func (s *engineSet) add(e *cacheV2Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.engines[e] = struct{}{}
+}
+
+func (s *engineSet) remove(e *cacheV2Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.engines, e)
+}
+
+func (s *engineSet) list() []*cacheV2Engine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	engines := make([]*cacheV2Engine, 0, len(s.engines))
+	for e := range s.engines {
+		engines = append(engines, e)
+	}
+	return engines
+}
+
+// provisionCacheV2Engine loads the storage of config and the shared
+// token store and manifest set it names, and returns an engine which
+// uses them. They must be released with the engine's cleanup method.
+func provisionCacheV2Engine(ctx caddy.Context, config CacheV2Config, resolver ETagResolver) (*cacheV2Engine, error) {
+	config.provision()
+
+	var storage certmagic.Storage
+	if !config.DisablePersistence {
+		if config.StorageRaw != nil {
+			val, err := ctx.LoadModule(&config, "StorageRaw")
+			if err != nil {
+				return nil, fmt.Errorf("loading storage module: %v", err)
+			}
+			storage, err = val.(caddy.StorageConverter).CertMagicStorage()
+			if err != nil {
+				return nil, fmt.Errorf("creating storage configuration: %v", err)
+			}
+		} else {
+			storage = ctx.Storage()
+		}
+	}
+
+	var mod any
+	var err error
+	if config.TransportRaw != nil {
+		mod, err = ctx.LoadModule(&config, "TransportRaw")
+	} else {
+		mod, err = ctx.LoadModuleByID("http.reverse_proxy.transport.http", json.RawMessage("{}"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading transport module: %v", err)
+	}
+	ht, ok := mod.(*reverseproxy.HTTPTransport)
+	if !ok {
+		return nil, fmt.Errorf("transport module %T is not supported, only http is", mod)
+	}
+	transport, err := newProxyTransport(config, ht)
+	if err != nil {
+		return nil, err
+	}
+
+	eventsAppIface, err := ctx.App("events")
+	if err != nil {
+		return nil, fmt.Errorf("getting events app: %v", err)
+	}
+	events := &eventEmitter{ctx: ctx, events: eventsAppIface.(*caddyevents.App)}
+
+	store, err := loadEtagStore(storage, config, transport, ctx.Logger())
+	if err != nil {
+		return nil, fmt.Errorf("loading token store: %v", err)
+	}
+
+	e, err := newCacheV2Engine(config, resolver, store, transport, ctx.Logger())
+	if err != nil {
+		_, _ = etagStores.Delete(config.StoreName)
+		return nil, err
+	}
+	e.storeName = config.StoreName
+
+	e.manifests, err = loadManifestSet(storage, config.StoreName, ctx.Logger())
+	if err != nil {
+		_, _ = etagStores.Delete(config.StoreName)
+		return nil, fmt.Errorf("loading manifest set: %v", err)
+	}
+
+	if !config.DisableProxy && !config.DisableProxyCache {
+		cache, err := loadProxyCache(config, ctx.Logger())
+		if err != nil {
+			_, _ = etagStores.Delete(config.StoreName)
+			_, _ = manifestSets.Delete(config.StoreName)
+			return nil, fmt.Errorf("loading proxy cache: %v", err)
+		}
+		e.proxy.cache = cache
+	}
+	e.emitEvents(events)
+	cacheV2Engines.add(e)
+	return e, nil
+}
+
+func newCacheV2Engine(config CacheV2Config, resolver ETagResolver, store *EtagStore, transport http.RoundTripper, logger *zap.Logger) (*cacheV2Engine, error) {
+	cacheV2Metrics.init.Do(initCacheV2Metrics)
+	config.provision()
+	proxy, err := newResourceProxy(config, store, transport, logger)
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheV2Engine{
+		config:   config,
+		resolver: resolver,
+		crawler: &dependencyCrawler{
+			resolver:   resolver,
+			maxDepth:   config.CrawlDepth,
+			budget:     config.CrawlBudget,
+			store:      store,
+			referenced: proxy.referenced,
+		},
+		store:     store,
+		proxy:     proxy,
+		manifests: newManifestSet(maxStoredManifests),
+		variants:  newVariantSet(maxVariantsSize),
+		pages:     newPageCache(int(config.RewriteCacheSize)),
+		logger:    logger,
+	}
+	e.scriptVer, err = e.scriptVersion()
+	if err != nil {
+		return nil, err
+	}
+	if config.ManifestIndex != "" {
+		e.index, err = loadManifestIndex(config.ManifestIndex)
+		if err != nil {
+			return nil, err
+		}
+		if proxy.referenced != nil {
+			for _, u := range e.index.remoteURLs() {
+				proxy.referenced.add(u)
+			}
+		}
+	}
+	if n, ok := resolver.(changeNotifier); ok {
+		n.onChange(e.fileChanged)
+	}
+	return e, nil
+}
+
+// emitEvents makes e emit the changes of tokens and the failed proxy
+// requests through em.
+func (e *cacheV2Engine) emitEvents(em *eventEmitter) {
+	e.proxy.events = em
+	e.unsubscribe = e.store.subscribe(func(ev tokenEvent) {
+		em.emit(ev.name, ev.data(e.storeName))
+	})
+	e.events = em
+}
+
+// fileChanged forgets the pages which depend on the resource at target,
+// or on any resource if it is empty, and emits the changes of the tokens
+// of the URLs at which those pages referenced it. The tokens of local
+// files are not kept, so other URLs of the file, which no page seen
+// since referenced, are not known, and neither are the previous tokens.
+func (e *cacheV2Engine) fileChanged(target string, etag func(target string) string) {
+	deps := e.pages.removeDependents(target)
+	if e.events == nil {
+		return
+	}
+	for _, dep := range deps {
+		e.events.emit(eventTokenChanged, map[string]any{
+			"url":      dep.url,
+			"path":     dep.target,
+			"new_etag": etag(dep.target),
+			"source":   sourceWatch,
+		})
+	}
+}
+
+// cleanup releases the shared token store and proxy cache of e.
+func (e *cacheV2Engine) cleanup() error {
+	cacheV2Engines.remove(e)
+	if e.unsubscribe != nil {
+		e.unsubscribe()
+	}
+	if e.storeName == "" {
+		return nil
+	}
+	if e.proxy.cache != nil {
+		if _, err := proxyCaches.Delete(e.storeName); err != nil {
+			return err
+		}
+	}
+	if _, err := manifestSets.Delete(e.storeName); err != nil {
+		return err
+	}
+	_, err := etagStores.Delete(e.storeName)
+	return err
+}
+
+// serveOwnRoutes serves the requests that belong to CacheV2 itself,
+// i.e. the proxy and manifest endpoints and the service worker script.
+// It returns true if the request was handled.
+func (e *cacheV2Engine) serveOwnRoutes(w http.ResponseWriter, r *http.Request) (bool, error) {
+	if e.isProxyRequest(r) {
+		return true, e.proxy.ServeHTTP(w, r)
+	}
+	if e.isManifestRequest(r) {
+		return true, e.serveManifest(w, r)
+	}
+	if e.isServiceWorkerRequest(r) {
+		return true, serveServiceWorker(w, r)
+	}
+	return false, nil
+}
+
+// isProxyRequest returns true if r is meant for the proxy endpoint.
+func (e *cacheV2Engine) isProxyRequest(r *http.Request) bool {
+	return !e.config.Disabled && !e.config.DisableProxy &&
+		strings.HasPrefix(r.URL.Path, e.config.ProxyPrefix)
+}
+
+// isServiceWorkerRequest returns true if r asks for the service worker.
+func (e *cacheV2Engine) isServiceWorkerRequest(r *http.Request) bool {
+	return !e.config.Disabled && r.URL.Path == e.config.ServiceWorkerPath
+}
+
+// enabledFor returns true if the client asked for CacheV2 rewriting.
+func (e *cacheV2Engine) enabledFor(r *http.Request) bool {
+	return !e.config.Disabled && r.Header.Get(e.config.TriggerHeader) == "true"
+}
+
+// serviceWorkerURL returns the URL with which pages register the
+// service worker. The query string tells the worker how to reach
+// the proxy endpoint and where to find the validation tokens.
+func (e *cacheV2Engine) serviceWorkerURL() string {
+	q := make(url.Values)
+	q.Set("header", e.config.ManifestHeader)
+	if !e.config.DisableProxy {
+		q.Set("proxy", e.config.ProxyPrefix)
+	}
+	return e.config.ServiceWorkerPath + "?" + q.Encode()
+}
+
+// rewrite injects the service worker registration into an HTML document
+// and delivers the manifest of the validation tokens of its sub-resources
+// in the configured ways: headers are set on w, and Early Hints are
+// written to it. It returns the rewritten document and its etag, which
+// is derived from sourceEtag, the etag of the document.
+//
+// The document is only read with open if the page was not prepared for
+// rewriting before with the same URL and source etag; otherwise, just
+// the tokens of its dependencies are resolved again.
+func (e *cacheV2Engine) rewrite(w http.ResponseWriter, r *http.Request, sourceEtag string, open func() ([]byte, error)) (_ []byte, _ string, err error) {
+	defer func() { observeRewrite("buffered", err) }()
+	e.rememberVars(r)
+	if sourceEtag == "" {
+		content, err := open()
+		if err != nil {
+			return nil, "", err
+		}
+		sourceEtag = documentEtag("", content)
+		open = func() ([]byte, error) { return content, nil }
+	}
+
+	origin := documentURL(r)
+	var tokens map[string]string
+	page, ok := e.pages.get(origin.String())
+	if ok && page.sourceEtag == sourceEtag && !page.streamed {
+		tokens, ok = e.crawler.refresh(r, page.deps)
+	} else {
+		ok = false
+	}
+	if !ok {
+		content, err := open()
+		if err != nil {
+			return nil, "", err
+		}
+		page, tokens, err = parsePage(r, e.crawler, content)
+		if err != nil {
+			return nil, "", err
+		}
+		page.key = origin.String()
+		page.sourceEtag = sourceEtag
+		e.pages.add(page)
+	}
+
+	data, version, header, err := e.prepareManifest(tokens, origin)
+	if err != nil {
+		return nil, "", err
+	}
+	page.setManifest(data)
+	newContent, err := page.render(version, func() ([]*html.Node, error) {
+		return e.registrationNodes(data, header)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	e.deliverManifest(w, header)
+	return newContent, e.rewrittenEtag(sourceEtag, version), nil
+}
+
+// rememberVars keeps a copy of the variables of the page request r.
+func (e *cacheV2Engine) rememberVars(r *http.Request) {
+	vars, ok := r.Context().Value(caddyhttp.VarsCtxKey).(map[string]any)
+	if !ok {
+		return
+	}
+	vars2 := make(map[string]any, len(vars))
+	for k, v := range vars {
+		vars2[k] = v
+	}
+	e.pageVars.Store(vars2)
+}
+
+// prepareManifest encodes the manifest of the tokens of a page at origin
+// and returns it, its version and the value of the manifest header, if
+// the header is needed to deliver it.
+func (e *cacheV2Engine) prepareManifest(tokens map[string]string, origin *url.URL) ([]byte, string, string, error) {
+	data, err := encodeManifest(tokens, origin)
+	if err != nil {
+		return nil, "", "", err
+	}
+	var header string
+	if e.delivers(deliverHeader) || e.delivers(deliverURL) {
+		header, err = e.manifestHeader(data)
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+	observeManifest(tokens, header)
+	return data, manifestVersion(data), header, nil
+}
+
+// deliverManifest sets the manifest header value on w, as configured.
+// It must be called before the response is written.
+func (e *cacheV2Engine) deliverManifest(w http.ResponseWriter, header string) {
+	if e.delivers(deliverHeader) || e.delivers(deliverURL) {
+		w.Header().Set(e.config.ManifestHeader, header)
+	}
+}
+
+// sendEarlyHints sends a 103 Early Hints response with preload links
+// for the local resources of the page requested by r, as they were when
+// the page was last served, if early hints are configured. It must be
+// called before the page is produced, so that the client can fetch the
+// resources meanwhile; pages which were not seen yet get no hints. The
+// hints are only links: they do not carry the manifest, which service
+// workers cannot read from a 103 response.
+func (e *cacheV2Engine) sendEarlyHints(w http.ResponseWriter, r *http.Request) {
+	if !e.delivers(deliverEarlyHints) || r.Method != http.MethodGet || !r.ProtoAtLeast(1, 1) {
+		return
+	}
+	page, ok := e.pages.get(documentURL(r).String())
+	if !ok || page.deps == nil {
+		return
+	}
+	hints := make(http.Header)
+	for _, dep := range page.deps.local {
+		if len(hints["Link"]) == maxEarlyHints {
+			break
+		}
+		if link := preloadLink(dep.url); link != "" {
+			hints.Add("Link", link)
+		}
+	}
+	if len(hints) > 0 {
+		writeEarlyHints(w, hints)
+	}
+}
+
+// streams returns true if HTML documents of the given size, or of
+// unknown size if it is negative, are rewritten while they are streamed.
+func (e *cacheV2Engine) streams(size int64) bool {
+	return e.config.StreamThreshold > 0 && (size < 0 || size >= e.config.StreamThreshold)
+}
+
+// rewriteStream rewrites the HTML document read from src like rewrite, but
+// writes the response to w while it reads the document, so that large
+// documents are neither held in memory nor delayed until they are parsed.
+// The header of w must be set except for the validators, which are
+// replaced, and the status is 200.
+//
+// The manifest of the page is known in advance only if the page was
+// streamed before with the same source etag, or is in the manifest index
+// with it; then it is delivered as usual, and the response gets an etag.
+// Otherwise, it is delivered at the end of the page, in a script which
+// hands it to the service worker, and in a trailer instead of the
+// manifest header.
+func (e *cacheV2Engine) rewriteStream(w http.ResponseWriter, r *http.Request, sourceEtag string, src io.Reader) (err error) {
+	defer func() { observeRewrite("streamed", err) }()
+	e.rememberVars(r)
+	origin := documentURL(r)
+	hdr := w.Header()
+	for _, field := range []string{"Etag", "Last-Modified", "Content-Length", "Accept-Ranges"} {
+		hdr.Del(field)
+	}
+
+	page, ok := e.pages.get(origin.String())
+	if !ok || page.sourceEtag != sourceEtag || !page.streamed {
+		// pages in the manifest index are known before they are streamed
+		if deps := e.index.dependencies(origin, sourceEtag); deps != nil {
+			page, ok = &rewrittenPage{key: origin.String(), sourceEtag: sourceEtag, deps: deps, streamed: true}, true
+			e.pages.add(page)
+		}
+	}
+	if ok && sourceEtag != "" && page.sourceEtag == sourceEtag && page.streamed {
+		if tokens, ok := e.crawler.refresh(r, page.deps); ok {
+			data, version, header, err := e.prepareManifest(tokens, origin)
+			if err != nil {
+				return err
+			}
+			page.setManifest(data)
+			nodes, err := e.registrationNodes(data, header)
+			if err != nil {
+				return err
+			}
+			e.deliverManifest(w, header)
+			etag := e.rewrittenEtag(sourceEtag, version)
+			hdr.Set("Etag", etag)
+			if etagListMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+			w.WriteHeader(http.StatusOK)
+			if r.Method == http.MethodHead {
+				return nil
+			}
+			return streamDocument(w, src, nodes, nil)
+		}
+	}
+
+	if e.delivers(deliverHeader) || e.delivers(deliverURL) {
+		hdr.Add("Trailer", e.config.ManifestHeader)
+	}
+	jsCode, err := e.registrationScript("null")
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	var deps *pageDependencies
+	var manifest []byte
+	err = streamDocument(w, src, []*html.Node{scriptNode(jsCode)}, func(refs []string, baseHref string) ([]*html.Node, error) {
+		base := origin
+		if baseHref != "" {
+			if u, err := resolveURL(origin, baseHref); err == nil {
+				base = u
+			}
+		}
+		var tokens map[string]string
+		deps, tokens = e.crawler.crawl(r, base, refs)
+		data, _, header, err := e.prepareManifest(tokens, origin)
+		if err != nil {
+			return nil, err
+		}
+		manifest = data
+		if e.delivers(deliverHeader) || e.delivers(deliverURL) {
+			hdr.Set(e.config.ManifestHeader, header)
+		}
+		return e.handoverNodes(data, header)
+	})
+	if err != nil {
+		return err
+	}
+	if sourceEtag != "" {
+		e.pages.add(&rewrittenPage{key: origin.String(), sourceEtag: sourceEtag, deps: deps, streamed: true, manifest: manifest})
+	}
+	return nil
+}
+
+// etagListMatches returns true if etag is in the list of entity tags of
+// an If-None-Match header, by weak comparison.
+func etagListMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// varyHTML adds the trigger header to the Vary header of HTML responses,
+// which differ depending on it, so that shared caches do not serve the
+// rewritten page to other clients and vice versa.
+func (e *cacheV2Engine) varyHTML(hdr http.Header) {
+	if e.config.Disabled || !strings.Contains(hdr.Get("Content-Type"), "text/html") {
+		return
+	}
+	for _, field := range hdr.Values("Vary") {
+		for _, name := range strings.Split(field, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), e.config.TriggerHeader) {
+				return
+			}
+		}
+	}
+	hdr.Add("Vary", e.config.TriggerHeader)
+}
+
+// rewritten returns true if the response with the header hdr is a page
+// which was rewritten already, e.g. by another handler.
+func (e *cacheV2Engine) rewritten(hdr http.Header) bool {
+	if hdr.Get(e.config.ManifestHeader) != "" {
+		return true
+	}
+	return strings.HasPrefix(strings.TrimPrefix(hdr.Get("Etag"), "W/"), `"cv2-`)
+}
+
+// rewriterCtxKey is the key of the engine of the cachev2 handler in the
+// context of the requests whose responses it rewrites, so that the file
+// server does not rewrite them as well.
+const rewriterCtxKey caddy.CtxKey = "cachev2_rewriter"
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*CacheV2)(nil)
+	_ caddy.Validator             = (*CacheV2)(nil)
+	_ caddy.CleanerUpper          = (*CacheV2)(nil)
+	_ caddyhttp.MiddlewareHandler = (*CacheV2)(nil)
+)
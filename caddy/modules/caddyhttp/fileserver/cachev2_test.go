@@ -0,0 +1,287 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestCacheV2Handler(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "css"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "css", "site.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	page := `<html><head><link rel="stylesheet" href="/css/site.css"></head><body><p>hi</p></body></html>`
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Etag", `"upstream"`)
+		_, err := w.Write([]byte(page))
+		return err
+	})
+
+	engine, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: root, fileSystem: osFS{}}, NewEtagStore(EtagStoreOptions{}), nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &CacheV2{engine: engine}
+
+	for i, tc := range []struct {
+		enabled     bool
+		expectToken bool
+	}{
+		{enabled: false, expectToken: false},
+		{enabled: true, expectToken: true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.enabled {
+			req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+		}
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+		rr := httptest.NewRecorder()
+		if err := c.ServeHTTP(rr, req, next); err != nil {
+			t.Fatalf("Test %d: unexpected error: %v", i, err)
+		}
+
+		body := rr.Body.String()
+		hasScript := strings.Contains(body, "serviceWorker.register")
+		if hasScript != tc.expectToken {
+			t.Errorf("Test %d: expected registration script=%t, got body: %s", i, tc.expectToken, body)
+		}
+
+		cfg := rr.Header().Get("X-Etag-Config")
+		if !tc.expectToken {
+			if cfg != "" {
+				t.Errorf("Test %d: expected no X-Etag-Config, got %s", i, cfg)
+			}
+			continue
+		}
+
+		var tokens map[string]map[string]string
+		if err := json.Unmarshal([]byte(cfg), &tokens); err != nil {
+			t.Fatalf("Test %d: invalid X-Etag-Config %q: %v", i, cfg, err)
+		}
+		if tokens["/css/"]["site.css"] == "" {
+			t.Errorf("Test %d: expected token for /css/site.css, got %v", i, tokens)
+		}
+		if etag := rr.Header().Get("Etag"); etag == `"upstream"` || !strings.HasPrefix(etag, `"cv2-`) {
+			t.Errorf("Test %d: expected Etag of the rewritten page, got %s", i, etag)
+		}
+	}
+}
+
+func TestCacheV2HandlerBeforeFileServer(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html": `<html><head><link rel="stylesheet" href="/site.css"></head><body><p>hi</p></body></html>`,
+		"site.css":   "body{}",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newEngine := func() *cacheV2Engine {
+		e, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	c := &CacheV2{engine: newEngine()}
+	fsrv := &FileServer{Root: root, fileSystem: osFS{}, cachev2: newEngine(), logger: zap.NewNop()}
+
+	for i, next := range []caddyhttp.Handler{
+		caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return fsrv.ServeHTTP(w, r, nil)
+		}),
+		// a page rewritten by another handler on the way
+		caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			req := r.WithContext(context.WithValue(r.Context(), rewriterCtxKey, nil))
+			rr := httptest.NewRecorder()
+			if err := fsrv.ServeHTTP(rr, req, nil); err != nil {
+				return err
+			}
+			for field, values := range rr.Header() {
+				w.Header()[field] = values
+			}
+			w.WriteHeader(rr.Code)
+			_, err := w.Write(rr.Body.Bytes())
+			return err
+		}),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+		rr := httptest.NewRecorder()
+		if err := c.ServeHTTP(rr, withTestReplacer(req), next); err != nil {
+			t.Fatal(err)
+		}
+		body := rr.Body.String()
+		if n := strings.Count(body, "serviceWorker.register"); n != 1 {
+			t.Errorf("Test %d: expected the page to be rewritten once, got %d times: %s", i, n, body)
+		}
+		if vary := rr.Header().Values("Vary"); len(vary) != 1 {
+			t.Errorf("Test %d: expected the trigger header in Vary once, got %v", i, vary)
+		}
+		if rr.Header().Get("X-Etag-Config") == "" {
+			t.Errorf("Test %d: expected a manifest header", i)
+		}
+	}
+}
+
+func TestCacheV2ServiceWorkerURL(t *testing.T) {
+	for i, tc := range []struct {
+		config CacheV2Config
+		expect string
+	}{
+		{
+			config: CacheV2Config{},
+			expect: "/sw.js?header=X-Etag-Config&proxy=%2Fproxy-resource",
+		},
+		{
+			config: CacheV2Config{ManifestHeader: "X-Tokens", ProxyPrefix: "/p", ServiceWorkerPath: "/cv/sw.js"},
+			expect: "/cv/sw.js?header=X-Tokens&proxy=%2Fp",
+		},
+		{
+			config: CacheV2Config{DisableProxy: true},
+			expect: "/sw.js?header=X-Etag-Config",
+		},
+	} {
+		e, err := newCacheV2Engine(tc.config, nil, nil, nil, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := e.serviceWorkerURL(); actual != tc.expect {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expect, actual)
+		}
+	}
+}
+
+func TestCacheV2ServeServiceWorker(t *testing.T) {
+	e, err := newCacheV2Engine(CacheV2Config{ServiceWorkerPath: "/static/sw.js"}, nil, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/static/sw.js", nil)
+	rr := httptest.NewRecorder()
+	if handled, err := e.serveOwnRoutes(rr, req); !handled || err != nil {
+		t.Fatalf("expected service worker to be served, got handled=%t err=%v", handled, err)
+	}
+	if rr.Code != http.StatusOK || rr.Body.Len() != len(serviceWorkerScript) {
+		t.Errorf("expected the embedded script, got status %d and %d bytes", rr.Code, rr.Body.Len())
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if rr.Header().Get("Service-Worker-Allowed") != "/" {
+		t.Errorf("expected Service-Worker-Allowed header")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/static/sw.js", nil)
+	req.Header.Set("If-None-Match", serviceWorkerEtag)
+	rr = httptest.NewRecorder()
+	e.serveOwnRoutes(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for matching Etag, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/sw.js", nil)
+	if handled, _ := e.serveOwnRoutes(httptest.NewRecorder(), req); handled {
+		t.Errorf("expected default path not to be served when another is configured")
+	}
+}
+
+func TestCacheV2RewrittenValidators(t *testing.T) {
+	root := t.TempDir()
+	css := filepath.Join(root, "site.css")
+	if err := os.WriteFile(css, []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var upstreamConditional bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		upstreamConditional = r.Header.Get("If-None-Match") != "" || r.Header.Get("Range") != ""
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Etag", `"upstream"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		_, err := w.Write([]byte(encodingTestPage))
+		return err
+	})
+	e, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &CacheV2{engine: e}
+
+	serve := func(enabled bool, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if enabled {
+			req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		if err := c.ServeHTTP(rr, withTestReplacer(req), next); err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	rr := serve(false)
+	if rr.Header().Get("Etag") != `"upstream"` || rr.Header().Get("Vary") != "X-CacheV2-Extension-Enabled" {
+		t.Errorf("expected the original page to vary on the trigger header, got %v", rr.Header())
+	}
+
+	rr = serve(true)
+	etag := rr.Header().Get("Etag")
+	if etag == `"upstream"` || rr.Header().Get("Vary") != "X-CacheV2-Extension-Enabled" || rr.Header().Get("Last-Modified") != "" {
+		t.Errorf("expected validators of the rewritten page, got %v", rr.Header())
+	}
+	full := rr.Body.String()
+	if rr.Header().Get("Content-Length") != strconv.Itoa(len(full)) {
+		t.Errorf("expected Content-Length %d, got %s", len(full), rr.Header().Get("Content-Length"))
+	}
+
+	rr = serve(true, "If-None-Match", etag)
+	if rr.Code != http.StatusNotModified || upstreamConditional {
+		t.Errorf("expected %d without a conditional upstream request, got %d (conditional=%t)", http.StatusNotModified, rr.Code, upstreamConditional)
+	}
+	rr = serve(true, "If-None-Match", `"upstream"`)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the etag of the original page not to match, got %d", rr.Code)
+	}
+
+	rr = serve(true, "Range", "bytes=0-9", "If-Range", etag)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != full[:10] || upstreamConditional {
+		t.Errorf("expected the range of the rewritten page, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// a new token of a sub-resource changes the manifest, and the etag
+	if err := os.WriteFile(css, []byte("body{color:red}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(css, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	rr = serve(true, "If-None-Match", etag)
+	if rr.Code != http.StatusOK || rr.Header().Get("Etag") == etag {
+		t.Errorf("expected a new etag with the new manifest, got %d %s", rr.Code, rr.Header().Get("Etag"))
+	}
+}
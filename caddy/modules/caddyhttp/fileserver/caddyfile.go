@@ -15,10 +15,14 @@
 package fileserver
 
 import (
+	"encoding/json"
 	"io/fs"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/dustin/go-humanize"
+
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -31,6 +35,7 @@ import (
 func init() {
 	httpcaddyfile.RegisterHandlerDirective("file_server", parseCaddyfile)
 	httpcaddyfile.RegisterDirective("try_files", parseTryFiles)
+	httpcaddyfile.RegisterHandlerDirective("cachev2", parseCacheV2)
 }
 
 // parseCaddyfile parses the file_server directive. It enables the static file
@@ -45,7 +50,50 @@ func init() {
 //	    precompressed <formats...>
 //	    status        <status>
 //	    disable_canonical_uris
+//	    content_etag  [sha256|xxhash] {
+//	        cache_size <n>
+//	    }
+//	    cachev2       [on|off] {
+//	        trigger_header     <name>
+//	        manifest_header    <name>
+//	        manifest_max_size  <size>
+//	        manifest_compress  on|off
+//	        manifest_prefix    <path>
+//	        manifest_delivery  <modes...>
+//	        proxy_prefix       <path>
+//	        proxy              on|off
+//	        proxy_allow_hosts  <hosts...>
+//	        proxy_deny_hosts   <hosts...>
+//	        proxy_allow_ranges <ranges...>
+//	        proxy_max_size     <size>
+//	        proxy_timeout      <duration>
+//	        proxy_any_url
+//	        proxy_cache        on|off
+//	        proxy_cache_memory <size>
+//	        proxy_cache_disk   <dir> [<size>]
+//	        service_worker     <path>
+//	        refresh_interval   <duration>
+//	        rewrite_cache      <size>
+//	        stream_threshold   <size>
+//	        manifest_index     <file>
+//	        watch              on|off
+//	        crawl_depth        <n>
+//	        crawl_budget       <size>
+//	        store              <name>
+//	        storage            <module> ...
+//	        snapshot_interval  <duration>
+//	        transport          http {
+//	            ...
+//	        }
+//	        persist            on|off
+//	        store_max_entries  <n>
+//	        store_ttl          <duration>
+//	        refresh_workers    <n>
+//	        refresh_per_host   <n>
+//	    }
 //	}
+//
+// CacheV2 is only enabled with the cachev2 subdirective.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var fsrv FileServer
 
@@ -147,6 +195,39 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				}
 				fsrv.PassThru = true
 
+			case "content_etag":
+				if fsrv.ContentEtag != nil {
+					return nil, h.Err("content etag is already configured")
+				}
+				ce, err := unmarshalContentEtag(h.Dispenser)
+				if err != nil {
+					return nil, err
+				}
+				fsrv.ContentEtag = ce
+
+			case "cachev2":
+				if fsrv.CacheV2 != nil {
+					return nil, h.Err("cachev2 is already configured")
+				}
+				fsrv.CacheV2 = new(CacheV2Config)
+				if h.NextArg() {
+					switch h.Val() {
+					case "on":
+					case "off":
+						fsrv.CacheV2.Disabled = true
+					default:
+						return nil, h.Errf("unrecognized cachev2 state '%s'", h.Val())
+					}
+				}
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					if err := unmarshalCacheV2Option(h, fsrv.CacheV2); err != nil {
+						return nil, err
+					}
+				}
+
 			default:
 				return nil, h.Errf("unknown subdirective '%s'", h.Val())
 			}
@@ -172,6 +253,423 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 	return &fsrv, nil
 }
 
+// parseCacheV2 parses the cachev2 directive. It enables CacheV2 for the
+// responses of the handlers that come after it, with this syntax:
+//
+//	cachev2 [<matcher>] {
+//	    resolver           <module> ...
+//	    trigger_header     <name>
+//	    manifest_header    <name>
+//	    manifest_max_size  <size>
+//	    manifest_compress  on|off
+//	    manifest_prefix    <path>
+//	    manifest_delivery  <modes...>
+//	    proxy_prefix       <path>
+//	    proxy              on|off
+//	    proxy_allow_hosts  <hosts...>
+//	    proxy_deny_hosts   <hosts...>
+//	    proxy_allow_ranges <ranges...>
+//	    proxy_max_size     <size>
+//	    proxy_timeout      <duration>
+//	    proxy_any_url
+//	    proxy_cache        on|off
+//	    proxy_cache_memory <size>
+//	    proxy_cache_disk   <dir> [<size>]
+//	    service_worker     <path>
+//	    refresh_interval   <duration>
+//	    rewrite_cache      <size>
+//	    stream_threshold   <size>
+//	    manifest_index     <file>
+//	    watch              on|off
+//	    crawl_depth        <n>
+//	    crawl_budget       <size>
+//	    store              <name>
+//	    storage            <module> ...
+//	    snapshot_interval  <duration>
+//	    transport          http {
+//	        ...
+//	    }
+//	    persist            on|off
+//	    store_max_entries  <n>
+//	    store_ttl          <duration>
+//	    refresh_workers    <n>
+//	    refresh_per_host   <n>
+//	}
+func parseCacheV2(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var c CacheV2
+
+	for h.Next() {
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "resolver":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				if c.ResolverRaw != nil {
+					return nil, h.Err("resolver already specified")
+				}
+				name := h.Val()
+				modID := "http.handlers.cachev2.resolvers." + name
+				unm, err := caddyfile.UnmarshalModule(h.Dispenser, modID)
+				if err != nil {
+					return nil, err
+				}
+				resolver, ok := unm.(ETagResolver)
+				if !ok {
+					return nil, h.Errf("module %s (%T) is not an ETagResolver", modID, unm)
+				}
+				c.ResolverRaw = caddyconfig.JSONModuleObject(resolver, "source", name, nil)
+
+			default:
+				if err := unmarshalCacheV2Option(h, &c.CacheV2Config); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return &c, nil
+}
+
+// unmarshalCacheV2Option parses the CacheV2 setting at the current
+// token of h into cfg.
+func unmarshalCacheV2Option(h httpcaddyfile.Helper, cfg *CacheV2Config) error {
+	switch h.Val() {
+	case "trigger_header":
+		if !h.Args(&cfg.TriggerHeader) {
+			return h.ArgErr()
+		}
+
+	case "manifest_header":
+		if !h.Args(&cfg.ManifestHeader) {
+			return h.ArgErr()
+		}
+
+	case "manifest_max_size":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		size, err := humanize.ParseBytes(h.Val())
+		if err != nil {
+			return h.Errf("parsing manifest max size: %v", err)
+		}
+		cfg.ManifestMaxSize = int64(size)
+
+	case "manifest_compress":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		switch h.Val() {
+		case "on":
+			cfg.CompressManifest = true
+		case "off":
+			cfg.CompressManifest = false
+		default:
+			return h.Errf("unrecognized manifest compression state '%s'", h.Val())
+		}
+
+	case "manifest_delivery":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		cfg.ManifestDelivery = append(cfg.ManifestDelivery, append([]string{h.Val()}, h.RemainingArgs()...)...)
+
+	case "manifest_prefix":
+		if !h.Args(&cfg.ManifestPrefix) {
+			return h.ArgErr()
+		}
+
+	case "proxy_prefix":
+		if !h.Args(&cfg.ProxyPrefix) {
+			return h.ArgErr()
+		}
+
+	case "proxy":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		switch h.Val() {
+		case "on":
+			cfg.DisableProxy = false
+		case "off":
+			cfg.DisableProxy = true
+		default:
+			return h.Errf("unrecognized proxy state '%s'", h.Val())
+		}
+
+	case "service_worker":
+		if !h.Args(&cfg.ServiceWorkerPath) {
+			return h.ArgErr()
+		}
+
+	case "refresh_interval":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(h.Val())
+		if err != nil {
+			return h.Errf("parsing refresh interval duration: %v", err)
+		}
+		cfg.RefreshInterval = caddy.Duration(dur)
+
+	case "crawl_depth":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		depth, err := strconv.Atoi(h.Val())
+		if err != nil {
+			return h.Errf("parsing crawl depth: %v", err)
+		}
+		cfg.CrawlDepth = depth
+
+	case "store_max_entries", "refresh_workers", "refresh_per_host":
+		opt := h.Val()
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		n, err := strconv.Atoi(h.Val())
+		if err != nil {
+			return h.Errf("parsing %s: %v", opt, err)
+		}
+		switch opt {
+		case "store_max_entries":
+			cfg.StoreMaxEntries = n
+		case "refresh_workers":
+			cfg.RefreshWorkers = n
+		case "refresh_per_host":
+			cfg.RefreshPerHost = n
+		}
+
+	case "store_ttl":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(h.Val())
+		if err != nil {
+			return h.Errf("parsing store ttl duration: %v", err)
+		}
+		cfg.StoreTTL = caddy.Duration(dur)
+
+	case "rewrite_cache":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		size, err := humanize.ParseBytes(h.Val())
+		if err != nil {
+			return h.Errf("parsing rewrite cache size: %v", err)
+		}
+		cfg.RewriteCacheSize = int64(size)
+
+	case "stream_threshold":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		size, err := humanize.ParseBytes(h.Val())
+		if err != nil {
+			return h.Errf("parsing stream threshold: %v", err)
+		}
+		cfg.StreamThreshold = int64(size)
+
+	case "manifest_index":
+		if !h.AllArgs(&cfg.ManifestIndex) {
+			return h.ArgErr()
+		}
+
+	case "watch":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		switch h.Val() {
+		case "on":
+			cfg.Watch = true
+		case "off":
+			cfg.Watch = false
+		default:
+			return h.Errf("unrecognized watch state '%s'", h.Val())
+		}
+
+	case "crawl_budget":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		size, err := humanize.ParseBytes(h.Val())
+		if err != nil {
+			return h.Errf("parsing crawl budget: %v", err)
+		}
+		cfg.CrawlBudget = int64(size)
+
+	case "proxy_allow_hosts":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		cfg.ProxyAllowHosts = append(cfg.ProxyAllowHosts, append([]string{h.Val()}, h.RemainingArgs()...)...)
+
+	case "proxy_deny_hosts":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		cfg.ProxyDenyHosts = append(cfg.ProxyDenyHosts, append([]string{h.Val()}, h.RemainingArgs()...)...)
+
+	case "proxy_allow_ranges":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		cfg.ProxyAllowRanges = append(cfg.ProxyAllowRanges, append([]string{h.Val()}, h.RemainingArgs()...)...)
+
+	case "proxy_max_size":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		size, err := humanize.ParseBytes(h.Val())
+		if err != nil {
+			return h.Errf("parsing proxy max size: %v", err)
+		}
+		cfg.ProxyMaxSize = int64(size)
+
+	case "proxy_cache":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		switch h.Val() {
+		case "on":
+			cfg.DisableProxyCache = false
+		case "off":
+			cfg.DisableProxyCache = true
+		default:
+			return h.Errf("unrecognized proxy cache state '%s'", h.Val())
+		}
+
+	case "proxy_cache_memory":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		size, err := humanize.ParseBytes(h.Val())
+		if err != nil {
+			return h.Errf("parsing proxy cache memory size: %v", err)
+		}
+		cfg.ProxyCacheMemory = int64(size)
+
+	case "proxy_cache_disk":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		cfg.ProxyCacheDir = h.Val()
+		if h.NextArg() {
+			size, err := humanize.ParseBytes(h.Val())
+			if err != nil {
+				return h.Errf("parsing proxy cache disk size: %v", err)
+			}
+			cfg.ProxyCacheDiskSize = int64(size)
+		}
+		if h.NextArg() {
+			return h.ArgErr()
+		}
+
+	case "proxy_timeout":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(h.Val())
+		if err != nil {
+			return h.Errf("parsing proxy timeout duration: %v", err)
+		}
+		cfg.ProxyTimeout = caddy.Duration(dur)
+
+	case "proxy_any_url":
+		if h.NextArg() {
+			return h.ArgErr()
+		}
+		cfg.ProxyAnyURL = true
+
+	case "store":
+		if !h.Args(&cfg.StoreName) {
+			return h.ArgErr()
+		}
+
+	case "storage":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		if cfg.StorageRaw != nil {
+			return h.Err("storage already specified")
+		}
+		name := h.Val()
+		modID := "caddy.storage." + name
+		unm, err := caddyfile.UnmarshalModule(h.Dispenser, modID)
+		if err != nil {
+			return err
+		}
+		storage, ok := unm.(caddy.StorageConverter)
+		if !ok {
+			return h.Errf("module %s is not a caddy.StorageConverter", modID)
+		}
+		cfg.StorageRaw = caddyconfig.JSONModuleObject(storage, "module", name, nil)
+
+	case "snapshot_interval":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(h.Val())
+		if err != nil {
+			return h.Errf("parsing snapshot interval duration: %v", err)
+		}
+		cfg.SnapshotInterval = caddy.Duration(dur)
+
+	case "transport":
+		if cfg.TransportRaw != nil {
+			return h.Err("transport already specified")
+		}
+		raw, err := unmarshalTransport(h.Dispenser)
+		if err != nil {
+			return err
+		}
+		cfg.TransportRaw = raw
+
+	case "persist":
+		if !h.NextArg() {
+			return h.ArgErr()
+		}
+		switch h.Val() {
+		case "on":
+			cfg.DisablePersistence = false
+		case "off":
+			cfg.DisablePersistence = true
+		default:
+			return h.Errf("unrecognized persist state '%s'", h.Val())
+		}
+
+	default:
+		return h.Errf("unknown subdirective '%s'", h.Val())
+	}
+	return nil
+}
+
+// unmarshalTransport parses a transport subdirective at the current
+// token of d, which configures an outgoing HTTP transport the same
+// way as in `reverse_proxy`. Syntax:
+//
+//	transport http {
+//	    ...
+//	}
+func unmarshalTransport(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	if name != "http" {
+		return nil, d.Errf("unsupported transport '%s', only http is supported", name)
+	}
+	unm, err := caddyfile.UnmarshalModule(d, "http.reverse_proxy.transport."+name)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, "protocol", name, nil), nil
+}
+
 // parseTryFiles parses the try_files directive. It combines a file matcher
 // with a rewrite directive, so this is not a standard handler directive.
 // A try_files directive has this syntax (notice no matcher tokens accepted):
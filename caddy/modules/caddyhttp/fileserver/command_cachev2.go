@@ -0,0 +1,298 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "cachev2",
+		Usage: "[--root <path>] [--origin <url>] [--content-etag <algorithm>] [--crawl-depth <n>] [--manifest-max-size <size>] [--manifest-compress] [--json] [--index <file>]",
+		Short: "Analyzes the CacheV2 manifests of a site offline",
+		Long: `
+Walks the site root, parses every HTML file like CacheV2 does when it
+rewrites pages, and prints the sub-resources of each page with their
+validation tokens, the references that are missing or cannot be parsed,
+and the size of the manifest header the page would be served with.
+
+The options must match the configuration of the site for the results to
+match: --content-etag that of file_server's content_etag, and the others
+the cachev2 options of the same names. --origin is the origin the pages
+are served at, against which absolute references are compared; the
+tokens of cross-origin resources are not known offline.
+
+With --json, the results are printed as JSON instead.
+
+With --index, the dependencies of all pages are written to a manifest
+index file, which file_server loads with the manifest_index option of
+cachev2, so that the manifests of streamed pages are known before they
+are first served. Pages whose files change afterwards are ignored, so
+the index should be built again as part of every deploy.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("root", "r", ".", "The path to the root of the site")
+			cmd.Flags().String("origin", "http://localhost", "The origin the site is served at")
+			cmd.Flags().String("content-etag", "", "The algorithm of content-based etags (sha256 or xxhash), if used")
+			cmd.Flags().Int("crawl-depth", 0, "How many levels of references in style sheets and scripts to follow")
+			cmd.Flags().String("manifest-max-size", "4KiB", "The maximum size of the manifest header")
+			cmd.Flags().Bool("manifest-compress", false, "Compress manifest headers")
+			cmd.Flags().Bool("json", false, "Print the results as JSON")
+			cmd.Flags().StringP("index", "o", "", "Write a manifest index to this file")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdCacheV2)
+		},
+	})
+}
+
+func cmdCacheV2(fl caddycmd.Flags) (int, error) {
+	origin, err := url.Parse(fl.String("origin"))
+	if err != nil || !isSpecialScheme(origin.Scheme) || origin.Host == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("origin must be an absolute http(s) URL: %s", fl.String("origin"))
+	}
+	maxSize, err := humanize.ParseBytes(fl.String("manifest-max-size"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("parsing manifest max size: %v", err)
+	}
+	root, err := filepath.Abs(fl.String("root"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	resolver := &FileResolver{Root: root, fileSystem: osFS{}}
+	if alg := fl.String("content-etag"); alg != "" {
+		resolver.ContentEtag = &ContentEtag{Algorithm: alg}
+		if err := resolver.ContentEtag.validate(); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+	resolver.digester = resolver.ContentEtag.newDigester()
+
+	config := CacheV2Config{
+		ManifestMaxSize:  int64(maxSize),
+		CompressManifest: fl.Bool("manifest-compress"),
+		CrawlDepth:       fl.Int("crawl-depth"),
+	}
+	if err := config.validate(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	e, err := newCacheV2Engine(config, resolver, nil, nil, zap.NewNop())
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	reports, index, err := analyzeSite(e, root, normalizeURL(origin))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if fl.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(reports)
+	} else {
+		err = printSiteReport(os.Stdout, reports)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if filename := fl.String("index"); filename != "" {
+		data, err := json.MarshalIndent(index, "", "\t")
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("writing manifest index: %v", err)
+		}
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// pageReport describes the manifest of a page of a site.
+type pageReport struct {
+	Path      string           `json:"path"`
+	Etag      string           `json:"etag"`
+	Resources []resourceReport `json:"resources"`
+
+	// references which are not valid URLs
+	Broken []string `json:"broken,omitempty"`
+
+	// the sizes of the manifest and of the header it is sent in,
+	// which holds a reference to the manifest if it is too large
+	ManifestBytes int  `json:"manifest_bytes"`
+	HeaderBytes   int  `json:"header_bytes"`
+	ByReference   bool `json:"by_reference,omitempty"`
+
+	// why the page could not be analyzed
+	Error string `json:"error,omitempty"`
+}
+
+// resourceReport describes a sub-resource of a page.
+type resourceReport struct {
+	URL         string `json:"url"`
+	Etag        string `json:"etag,omitempty"`
+	CrossOrigin bool   `json:"cross_origin,omitempty"`
+	Missing     bool   `json:"missing,omitempty"`
+}
+
+// analyzeSite computes the manifests of the HTML files below root with
+// e, as if they were requested at origin. It returns them by path, and
+// the manifest index of the site.
+func analyzeSite(e *cacheV2Engine, root string, origin *url.URL) ([]pageReport, *manifestIndex, error) {
+	index := &manifestIndex{Version: manifestIndexVersion, Pages: make(map[string]*indexedPage)}
+	var reports []pageReport
+	err := filepath.WalkDir(root, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(path.Ext(filename)) {
+		case ".html", ".htm":
+		default:
+			return nil
+		}
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		target := "/" + filepath.ToSlash(rel)
+		report, deps := analyzePage(e, filename, target, origin)
+		if deps != nil {
+			index.add(target, report.Etag, origin, deps)
+		}
+		reports = append(reports, report)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Path < reports[j].Path })
+	return reports, index, nil
+}
+
+// analyzePage computes the manifest of the HTML file filename, which is
+// served at target below origin, and returns it with the dependencies of
+// the page.
+func analyzePage(e *cacheV2Engine, filename, target string, origin *url.URL) (pageReport, *pageDependencies) {
+	report := pageReport{Path: target, Resources: []resourceReport{}}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+	report.Etag = fileEtag(osFS{}, filename, info, e.resolver.(*FileResolver).digester)
+
+	doc, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+
+	r, err := http.NewRequest(http.MethodGet, origin.Scheme+"://"+origin.Host+target, nil)
+	if err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+	if origin.Scheme == "https" {
+		r.TLS = new(tls.ConnectionState)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+
+	pageURL := documentURL(r)
+	base := documentBaseURL(doc, pageURL)
+	refs := extractResourceURLs(doc)
+	for _, ref := range refs {
+		if _, err := resolveURL(base, ref); err != nil {
+			report.Broken = append(report.Broken, ref)
+		}
+	}
+
+	deps, tokens := e.crawler.crawl(r, base, refs)
+	for _, dep := range deps.local {
+		report.Resources = append(report.Resources, resourceReport{URL: dep.url, Etag: dep.etag, Missing: dep.etag == ""})
+	}
+	for _, u := range deps.remote {
+		report.Resources = append(report.Resources, resourceReport{URL: u, CrossOrigin: true})
+	}
+
+	data, _, header, err := e.prepareManifest(tokens, pageURL)
+	if err != nil {
+		report.Error = err.Error()
+		return report, deps
+	}
+	report.ManifestBytes = len(data)
+	report.HeaderBytes = len(header)
+	report.ByReference = strings.HasPrefix(header, "ref:")
+	return report, deps
+}
+
+// printSiteReport prints the reports of the pages of a site for humans.
+func printSiteReport(w io.Writer, reports []pageReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	var resources, missing, broken int
+	var largest *pageReport
+	for i, report := range reports {
+		if report.Error != "" {
+			fmt.Fprintf(tw, "%s\terror: %s\n", report.Path, report.Error)
+			continue
+		}
+		header := humanize.IBytes(uint64(report.HeaderBytes))
+		if report.ByReference {
+			header += fmt.Sprintf(" (by reference; manifest: %s)", humanize.IBytes(uint64(report.ManifestBytes)))
+		}
+		fmt.Fprintf(tw, "%s\t%d resources, header %s\n", report.Path, len(report.Resources), header)
+		for _, res := range report.Resources {
+			status := res.Etag
+			switch {
+			case res.Missing:
+				status = "MISSING"
+				missing++
+			case res.CrossOrigin:
+				status = "(cross-origin)"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\n", res.URL, status)
+		}
+		for _, ref := range report.Broken {
+			fmt.Fprintf(tw, "  %q\tBROKEN\n", ref)
+		}
+		resources += len(report.Resources)
+		broken += len(report.Broken)
+		if largest == nil || report.HeaderBytes > largest.HeaderBytes {
+			largest = &reports[i]
+		}
+	}
+	fmt.Fprintf(tw, "\n%d pages, %d resources, %d missing, %d broken", len(reports), resources, missing, broken)
+	if largest != nil {
+		fmt.Fprintf(tw, "; largest header %s (%s)", humanize.IBytes(uint64(largest.HeaderBytes)), largest.Path)
+	}
+	fmt.Fprintln(tw)
+	return tw.Flush()
+}
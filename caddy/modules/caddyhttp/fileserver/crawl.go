@@ -0,0 +1,284 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ResourceOpener is implemented by ETag resolvers which can also provide
+// the contents of resources. CacheV2 uses it to follow the references in
+// style sheets and scripts, so that the fonts, images and module chunks
+// they load get validation tokens as well.
+type ResourceOpener interface {
+	OpenResource(r *http.Request, target string) (io.ReadCloser, error)
+}
+
+// dependencyCrawler resolves the validation tokens of the sub-resources
+// of a page. If enabled, it also follows the references in the local
+// style sheets and scripts of the page, up to a maximum depth and
+// within a budget of bytes read per page, so that the result is the
+// dependency closure of the page.
+type dependencyCrawler struct {
+	resolver ETagResolver
+	maxDepth int
+	budget   int64
+
+	// if set, provides the tokens of cross-origin resources
+	store *EtagStore
+
+	// if set, records the cross-origin resources which are referenced,
+	// so that the proxy knows it may fetch them
+	referenced *urlSet
+}
+
+// crawlItem is a resource whose references are still to be followed.
+type crawlItem struct {
+	url    *url.URL
+	target string
+	depth  int
+}
+
+// pageDependencies are the sub-resources of a page which the crawler
+// found, so that their tokens can be resolved again without parsing the
+// page and crawling its style sheets and scripts.
+type pageDependencies struct {
+	local  []localDependency
+	remote []string // URLs of cross-origin resources
+}
+
+// dependsOn returns true if the resource at target, or a resource below
+// it, is one of the local dependencies.
+func (deps *pageDependencies) dependsOn(target string) bool {
+	for _, dep := range deps.local {
+		if dep.dependsOn(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// localDependency is a resource of the same origin as the page.
+type localDependency struct {
+	url    string
+	target string
+
+	// crawled is set for style sheets and scripts whose references were
+	// followed, or would have been if they existed; etag is the token
+	// they had then, since the references change with it
+	crawled bool
+	etag    string
+}
+
+// dependsOn returns true if dep is the resource at target, or a resource
+// below it.
+func (dep localDependency) dependsOn(target string) bool {
+	return dep.target == target || strings.HasPrefix(dep.target, target+"/")
+}
+
+// tokens returns the validation tokens of the resources in refs, which
+// are referenced by the page requested by r and resolved against base,
+// and of their dependencies. Only resources of the same origin as the
+// page are resolved. Tokens are keyed by absolute URL, like the requests
+// the service worker sees.
+func (c *dependencyCrawler) tokens(r *http.Request, base *url.URL, refs []string) map[string]string {
+	_, m := c.crawl(r, base, refs)
+	return m
+}
+
+// crawl returns the dependencies of the page requested by r, which
+// references the resources in refs relative to base, and their tokens.
+func (c *dependencyCrawler) crawl(r *http.Request, base *url.URL, refs []string) (*pageDependencies, map[string]string) {
+	origin := documentURL(r)
+	deps := new(pageDependencies)
+	m := make(map[string]string)
+	etags := make(map[string]string)
+	seenURLs := make(map[string]bool)
+	var queue []crawlItem
+
+	opener, _ := c.resolver.(ResourceOpener)
+	crawlable := func(target string, depth int) bool {
+		return opener != nil && depth <= c.maxDepth && dependencyExtractor(target) != nil
+	}
+
+	// add records the token of the resource at u and returns whether it
+	// exists and was not seen before, so that it should be crawled
+	add := func(u *url.URL, depth int) (string, bool) {
+		key := u.String()
+		if !sameOrigin(u, origin) {
+			if !isSpecialScheme(u.Scheme) {
+				return "", false
+			}
+			if !seenURLs[key] {
+				seenURLs[key] = true
+				deps.remote = append(deps.remote, key)
+			}
+			c.addRemote(m, key)
+			return "", false
+		}
+		target := path.Clean("/" + u.Path)
+		etag, seen := etags[target]
+		if !seen {
+			etag, _ = c.resolver.ResolveETag(r, target)
+			etags[target] = etag
+		}
+		if !seenURLs[key] {
+			seenURLs[key] = true
+			deps.local = append(deps.local, localDependency{
+				url:     key,
+				target:  target,
+				crawled: !seen && crawlable(target, depth),
+				etag:    etag,
+			})
+		}
+		if etag == "" {
+			return "", false
+		}
+		m[key] = etag
+		return target, !seen
+	}
+
+	for _, ref := range refs {
+		u, err := resolveURL(base, ref)
+		if err != nil {
+			continue
+		}
+		if target, ok := add(u, 1); ok {
+			queue = append(queue, crawlItem{url: u, target: target, depth: 1})
+		}
+	}
+
+	if opener == nil || c.maxDepth <= 0 {
+		return deps, m
+	}
+
+	budget := c.budget
+	for len(queue) > 0 && budget > 0 {
+		item := queue[0]
+		queue = queue[1:]
+
+		extract := dependencyExtractor(item.target)
+		if extract == nil {
+			continue
+		}
+
+		contents, err := readResource(r, opener, item.target, budget)
+		if err != nil {
+			continue
+		}
+		budget -= int64(len(contents))
+
+		for _, ref := range extract(contents) {
+			// references in style sheets and scripts are
+			// relative to the resource, not to the page
+			u, err := resolveURL(item.url, ref)
+			if err != nil {
+				continue
+			}
+			if target, ok := add(u, item.depth+1); ok && item.depth < c.maxDepth {
+				queue = append(queue, crawlItem{url: u, target: target, depth: item.depth + 1})
+			}
+		}
+	}
+
+	return deps, m
+}
+
+// refresh resolves the current tokens of the dependencies of the page
+// requested by r. It returns false if a style sheet or script whose
+// references were followed changed, so that the page must be crawled
+// again.
+func (c *dependencyCrawler) refresh(r *http.Request, deps *pageDependencies) (map[string]string, bool) {
+	m := make(map[string]string, len(deps.local)+len(deps.remote))
+	etags := make(map[string]string)
+	for _, dep := range deps.local {
+		etag, seen := etags[dep.target]
+		if !seen {
+			etag, _ = c.resolver.ResolveETag(r, dep.target)
+			etags[dep.target] = etag
+		}
+		if dep.crawled && etag != dep.etag {
+			return nil, false
+		}
+		if etag != "" {
+			m[dep.url] = etag
+		}
+	}
+	for _, key := range deps.remote {
+		c.addRemote(m, key)
+	}
+	return m, true
+}
+
+// addRemote records that the cross-origin resource at key is referenced
+// and adds its token to m, if it is known.
+func (c *dependencyCrawler) addRemote(m map[string]string, key string) {
+	if c.referenced != nil {
+		c.referenced.add(key)
+	}
+	if c.store != nil {
+		if etag, _, ok := c.store.validation(key); ok {
+			m[key] = etag
+		}
+	}
+}
+
+// readResource reads the contents of target with opener. It fails if
+// the resource is larger than budget, since its references could not
+// all be followed anyway.
+func readResource(r *http.Request, opener ResourceOpener, target string, budget int64) (string, error) {
+	rc, err := opener.OpenResource(r, target)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	contents, err := io.ReadAll(io.LimitReader(rc, budget+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(contents)) > budget {
+		return "", errCrawlBudgetExceeded
+	}
+	return string(contents), nil
+}
+
+// dependencyExtractor returns the function that finds the references
+// in the resource at target, or nil if it is not a style sheet or script.
+func dependencyExtractor(target string) func(string) []string {
+	switch strings.ToLower(path.Ext(target)) {
+	case ".css":
+		return extractCSSURLs
+	case ".js", ".mjs":
+		return extractJSImports
+	}
+	return nil
+}
+
+var (
+	jsStaticImportRegexp  = regexp.MustCompile(`\b(?:import|export)\s*(?:[\w$*{}\s,]*?\bfrom\s*)?["']([^"'\n]+)["']`)
+	jsDynamicImportRegexp = regexp.MustCompile(`\bimport\s*\(\s*["']([^"'\n]+)["']\s*\)`)
+)
+
+// extractJSImports returns the module specifiers of the static and
+// dynamic imports (and re-exports) in the JavaScript source js. Bare
+// specifiers, which need an import map to resolve, are left out.
+func extractJSImports(js string) []string {
+	var specifiers []string
+	for _, re := range []*regexp.Regexp{jsStaticImportRegexp, jsDynamicImportRegexp} {
+		for _, m := range re.FindAllStringSubmatch(js, -1) {
+			s := m[1]
+			if strings.HasPrefix(s, "/") || strings.HasPrefix(s, "./") ||
+				strings.HasPrefix(s, "../") || strings.Contains(s, "://") {
+				specifiers = append(specifiers, s)
+			}
+		}
+	}
+	return specifiers
+}
+
+var errCrawlBudgetExceeded = errors.New("crawl budget exceeded")
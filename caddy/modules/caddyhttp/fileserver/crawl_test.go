@@ -0,0 +1,101 @@
+package fileserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestDependencyCrawler(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"css/site.css":      `@import "theme.css"; body { background: url(../img/bg.png); }`,
+		"css/theme.css":     `@import url("/css/site.css"); @font-face { src: url('/fonts/a.woff2'); }`,
+		"fonts/a.woff2":     `font`,
+		"img/bg.png":        `png`,
+		"js/app.mjs":        `import { a } from "./lib/a.js"; import "lodash"; const m = import("./lazy.js");`,
+		"js/lib/a.js":       `export * from "../deep/b.js"; export const a = 1;`,
+		"js/deep/b.js":      `export const b = 2;`,
+		"js/lazy.js":        `export default 3;`,
+		"img/not-crawl.png": `png`,
+	}
+	for name, contents := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	repl := caddyhttp.NewTestReplacer(req)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	resolver := &FileResolver{Root: root, fileSystem: osFS{}}
+	refs := []string{"css/site.css", "/js/app.mjs", "/img/missing.png", "https://cdn.example.com/lib.js", "//example.org/a.css"}
+
+	// only the tokens of cross-origin resources the page references are included
+	store := NewEtagStore(EtagStoreOptions{})
+	defer store.Stop()
+	store.Set("https://cdn.example.com/lib.js", `"lib"`)
+	store.Set("https://cdn.example.com/unrelated.js", `"other"`)
+
+	for i, tc := range []struct {
+		depth  int
+		budget int64
+		expect []string
+	}{
+		{
+			depth:  0,
+			budget: 1 << 20,
+			expect: []string{"http://example.com/css/site.css", "http://example.com/js/app.mjs", "https://cdn.example.com/lib.js"},
+		},
+		{
+			depth:  1,
+			budget: 1 << 20,
+			expect: []string{"http://example.com/css/site.css", "http://example.com/css/theme.css", "http://example.com/img/bg.png", "http://example.com/js/app.mjs", "http://example.com/js/lazy.js", "http://example.com/js/lib/a.js", "https://cdn.example.com/lib.js"},
+		},
+		{
+			depth:  5,
+			budget: 1 << 20,
+			expect: []string{"http://example.com/css/site.css", "http://example.com/css/theme.css", "http://example.com/fonts/a.woff2", "http://example.com/img/bg.png", "http://example.com/js/app.mjs", "http://example.com/js/deep/b.js", "http://example.com/js/lazy.js", "http://example.com/js/lib/a.js", "https://cdn.example.com/lib.js"},
+		},
+		{
+			// only site.css fits into the budget
+			depth:  5,
+			budget: int64(len(files["css/site.css"])),
+			expect: []string{"http://example.com/css/site.css", "http://example.com/css/theme.css", "http://example.com/img/bg.png", "http://example.com/js/app.mjs", "https://cdn.example.com/lib.js"},
+		},
+	} {
+		c := &dependencyCrawler{resolver: resolver, maxDepth: tc.depth, budget: tc.budget, store: store, referenced: newURLSet(10)}
+		tokens := c.tokens(req, documentURL(req), refs)
+
+		// cross-origin references are remembered for the proxy
+		for _, u := range []string{"https://cdn.example.com/lib.js", "http://example.org/a.css"} {
+			if !c.referenced.has(u) {
+				t.Errorf("Test %d: expected %s to be recorded as referenced", i, u)
+			}
+		}
+
+		var actual []string
+		for key, etag := range tokens {
+			if etag == "" {
+				t.Errorf("Test %d: empty token for %s", i, key)
+			}
+			actual = append(actual, key)
+		}
+		sort.Strings(actual)
+		if !reflect.DeepEqual(actual, tc.expect) {
+			t.Errorf("Test %d: expected %v, got %v", i, tc.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package fileserver
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/cespare/xxhash/v2"
+)
+
+// ContentEtag configures Etags which are derived from the contents of
+// files instead of their modification time and size. Such Etags stay
+// the same when a deploy touches files without changing them, and they
+// change even when an edit keeps the same size within the same second.
+//
+// Hashing a file requires reading it, so digests are remembered in a
+// bounded in-memory cache keyed on the identity of the file (inode,
+// modification time and size); files are only hashed again when they
+// change.
+type ContentEtag struct {
+	// The hash algorithm; either `sha256` or `xxhash`. Default: `sha256`.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// The maximum number of digests to remember. Default: 10000.
+	CacheSize int `json:"cache_size,omitempty"`
+}
+
+// unmarshalContentEtag parses a content_etag subdirective at the current
+// token of d. Syntax:
+//
+//	content_etag [<algorithm>] {
+//	    cache_size <n>
+//	}
+func unmarshalContentEtag(d *caddyfile.Dispenser) (*ContentEtag, error) {
+	ce := new(ContentEtag)
+	if d.NextArg() {
+		ce.Algorithm = d.Val()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "cache_size":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("parsing cache size: %v", err)
+			}
+			ce.CacheSize = size
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return ce, nil
+}
+
+// validate ensures ce is a valid configuration.
+func (ce ContentEtag) validate() error {
+	switch ce.Algorithm {
+	case "", "sha256", "xxhash":
+	default:
+		return fmt.Errorf("unsupported content etag algorithm: %s", ce.Algorithm)
+	}
+	if ce.CacheSize < 0 {
+		return fmt.Errorf("content etag cache size must not be negative")
+	}
+	return nil
+}
+
+// newDigester returns a content digester for ce. It returns nil
+// if ce is nil, which means Etags are not content-based.
+func (ce *ContentEtag) newDigester() *contentDigester {
+	if ce == nil {
+		return nil
+	}
+	d := &contentDigester{
+		newHash:    sha256.New,
+		size:       sha256.Size / 2,
+		maxEntries: ce.CacheSize,
+		entries:    make(map[digestKey]*list.Element),
+		lru:        list.New(),
+	}
+	if ce.Algorithm == "xxhash" {
+		d.newHash = func() hash.Hash { return xxhash.New() }
+		d.size = 8
+	}
+	if d.maxEntries == 0 {
+		d.maxEntries = 10000
+	}
+	return d
+}
+
+// digestKey identifies a particular version of a file.
+type digestKey struct {
+	name  string
+	inode uint64
+	mtime int64
+	size  int64
+}
+
+type digestEntry struct {
+	key  digestKey
+	etag string
+}
+
+// contentDigester computes content-based Etags and remembers them
+// in an LRU cache. It is safe for concurrent use.
+type contentDigester struct {
+	newHash    func() hash.Hash
+	size       int // number of digest bytes used in the Etag
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[digestKey]*list.Element
+	lru     *list.List
+}
+
+// etag returns the content-based Etag of the file name in fsys, which
+// info describes. The file is only read if its digest is not cached.
+func (d *contentDigester) etag(fsys fs.FS, name string, info fs.FileInfo) (string, error) {
+	key := digestKey{
+		name:  name,
+		inode: fileInode(info),
+		mtime: info.ModTime().UnixNano(),
+		size:  info.Size(),
+	}
+
+	d.mu.Lock()
+	if elem, ok := d.entries[key]; ok {
+		d.lru.MoveToFront(elem)
+		d.mu.Unlock()
+		return elem.Value.(*digestEntry).etag, nil
+	}
+	d.mu.Unlock()
+
+	// hash without holding the lock; two concurrent requests for
+	// the same new file may both hash it, which is harmless
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := d.newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:d.size]) + `"`
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.entries[key]; !ok {
+		d.entries[key] = d.lru.PushFront(&digestEntry{key: key, etag: etag})
+		for d.lru.Len() > d.maxEntries {
+			oldest := d.lru.Back()
+			d.lru.Remove(oldest)
+			delete(d.entries, oldest.Value.(*digestEntry).key)
+		}
+	}
+	return etag, nil
+}
+
+// fileEtag returns the Etag of the file name in fsys, which info
+// describes. With a digester, the Etag is a hash of the contents of
+// the file; otherwise (or if hashing fails) it is calculated from the
+// modification time and size of the file.
+func fileEtag(fsys fs.FS, name string, info fs.FileInfo, digester *contentDigester) string {
+	if digester != nil {
+		if etag, err := digester.etag(fsys, name, info); err == nil {
+			return etag
+		}
+	}
+	return calculateEtag(info)
+}
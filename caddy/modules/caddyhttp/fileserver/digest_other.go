@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fileserver
+
+import "io/fs"
+
+// fileInode returns 0, because inode numbers are
+// not available on this platform.
+func fileInode(fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,59 @@
+package fileserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContentDigester(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.css")
+	write := func(contents string, mtime time.Time) os.FileInfo {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	for _, algorithm := range []string{"sha256", "xxhash"} {
+		d := (&ContentEtag{Algorithm: algorithm, CacheSize: 1}).newDigester()
+		mtime := time.Unix(1700000000, 0)
+
+		first, err := d.etag(osFS{}, name, write("body{}", mtime))
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+
+		// touching the file without changing it keeps the etag
+		touched, err := d.etag(osFS{}, name, write("body{}", mtime.Add(time.Hour)))
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if touched != first {
+			t.Errorf("%s: expected same etag after touch, got %s and %s", algorithm, first, touched)
+		}
+
+		// an edit within the same second that keeps the size changes it
+		changed, err := d.etag(osFS{}, name, write("body{a", mtime.Add(time.Hour+time.Millisecond)))
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if changed == touched {
+			t.Errorf("%s: expected different etag for different contents, got %s", algorithm, changed)
+		}
+
+		if d.lru.Len() != 1 || len(d.entries) != 1 {
+			t.Errorf("%s: expected cache bounded to 1 entry, got %d", algorithm, d.lru.Len())
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package fileserver
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileInode returns the inode number of the file info describes,
+// or 0 if it is not known.
+func fileInode(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino) //nolint:unconvert // Ino is not uint64 on all platforms
+	}
+	return 0
+}
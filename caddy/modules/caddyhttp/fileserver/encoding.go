@@ -0,0 +1,160 @@
+package fileserver
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+	caddygzip "github.com/caddyserver/caddy/v2/modules/caddyhttp/encode/gzip"
+	caddyzstd "github.com/caddyserver/caddy/v2/modules/caddyhttp/encode/zstd"
+)
+
+// contentCodings are the content codings of HTML responses which CacheV2
+// decodes to rewrite them, and with which it encodes them again.
+var contentCodings = map[string]encode.Encoding{
+	"gzip": caddygzip.Gzip{Level: 5},
+	"zstd": caddyzstd.Zstd{},
+}
+
+// maxDecodedSize is the maximum size of an HTML document that CacheV2
+// decodes to rewrite it.
+const maxDecodedSize = 32 << 20
+
+// decodeContent returns data, which is encoded with the content coding,
+// decoded.
+func decodeContent(coding string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch coding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unsupported content coding '%s'", coding)
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxDecodedSize {
+		return nil, fmt.Errorf("decoded content exceeds %d bytes", maxDecodedSize)
+	}
+	return decoded, nil
+}
+
+// encodeContent returns content encoded with enc. The results are kept
+// in the engine's set of encoded variants, so that a rewritten page
+// which did not change is not compressed again.
+func (e *cacheV2Engine) encodeContent(enc encode.Encoding, content []byte) ([]byte, error) {
+	sum := sha256.Sum256(content)
+	key := enc.AcceptEncoding() + ":" + hex.EncodeToString(sum[:16])
+	if encoded, ok := e.variants.get(key); ok {
+		return encoded, nil
+	}
+
+	buf := new(bytes.Buffer)
+	w := enc.NewEncoder()
+	w.Reset(buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	encoded := buf.Bytes()
+	e.variants.add(key, encoded)
+	return encoded, nil
+}
+
+// encodedEtag returns the etag of the variant of a resource with the etag
+// which is encoded with the content coding, so that it differs from the
+// etags of the other variants.
+func encodedEtag(etag, coding string) string {
+	if len(etag) < 2 || etag[len(etag)-1] != '"' {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// variantSet holds encoded variants of rewritten pages by key. It is
+// bounded in size and forgets the least recently used variants.
+type variantSet struct {
+	mu    sync.Mutex
+	max   int
+	size  int
+	items map[string]*list.Element
+	lru   *list.List // of *encodedVariant, most recently used first
+}
+
+type encodedVariant struct {
+	key  string
+	data []byte
+}
+
+func newVariantSet(max int) *variantSet {
+	return &variantSet{
+		max:   max,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+func (s *variantSet) add(key string, data []byte) {
+	if len(data) > s.max {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.items[key] = s.lru.PushFront(&encodedVariant{key: key, data: data})
+	s.size += len(data)
+	for s.size > s.max {
+		oldest := s.lru.Remove(s.lru.Back()).(*encodedVariant)
+		delete(s.items, oldest.key)
+		s.size -= len(oldest.data)
+	}
+}
+
+func (s *variantSet) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*encodedVariant).data, true
+}
+
+func (s *variantSet) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = make(map[string]*list.Element)
+	s.lru.Init()
+	s.size = 0
+}
+
+// maxVariantsSize is the size of the encoded variants a variantSet holds.
+const maxVariantsSize = 16 << 20
@@ -0,0 +1,207 @@
+package fileserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+	caddybrotli "github.com/caddyserver/caddy/v2/modules/caddyhttp/encode/brotli"
+	caddygzip "github.com/caddyserver/caddy/v2/modules/caddyhttp/encode/gzip"
+)
+
+const encodingTestPage = `<html><head><link rel="stylesheet" href="/site.css"></head><body><p>hi</p></body></html>`
+
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid gzip data: %v", err)
+	}
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func withTestReplacer(r *http.Request) *http.Request {
+	repl := caddyhttp.NewTestReplacer(r)
+	ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.OriginalRequestCtxKey, *r)
+	return r.WithContext(ctx)
+}
+
+func TestContentCodings(t *testing.T) {
+	e, err := newCacheV2Engine(CacheV2Config{}, nil, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for coding, enc := range contentCodings {
+		encoded, err := e.encodeContent(enc, []byte(encodingTestPage))
+		if err != nil {
+			t.Fatalf("%s: %v", coding, err)
+		}
+		again, err := e.encodeContent(enc, []byte(encodingTestPage))
+		if err != nil || &again[0] != &encoded[0] {
+			t.Errorf("%s: expected encoded variant to be reused", coding)
+		}
+		decoded, err := decodeContent(coding, encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", coding, err)
+		}
+		if string(decoded) != encodingTestPage {
+			t.Errorf("%s: expected %s, got %s", coding, encodingTestPage, decoded)
+		}
+	}
+	if _, err := decodeContent("br", nil); err == nil {
+		t.Error("expected error for unsupported coding")
+	}
+
+	for _, tc := range []struct{ etag, expect string }{
+		{etag: `"abc"`, expect: `"abc-gzip"`},
+		{etag: `W/"abc"`, expect: `W/"abc-gzip"`},
+		{etag: `abc`, expect: `abc`},
+	} {
+		if actual := encodedEtag(tc.etag, "gzip"); actual != tc.expect {
+			t.Errorf("expected %s for %s, got %s", tc.expect, tc.etag, actual)
+		}
+	}
+}
+
+func TestFileServerRewritesPrecompressed(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":    encodingTestPage,
+		"index.html.gz": "not the page",
+		"index.html.br": "not the page either",
+		"site.css":      "body{}",
+		"site.css.gz":   "compressed",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := &caddygzip.GzipPrecompressed{Gzip: caddygzip.Gzip{Level: 5}}
+	fsrv := &FileServer{
+		Root:       root,
+		fileSystem: osFS{},
+		precompressors: map[string]encode.Precompressed{
+			"gzip": gz,
+			"br":   caddybrotli.BrotliPrecompressed{},
+		},
+		cachev2: engine,
+		logger:  zap.NewNop(),
+	}
+
+	for i, tc := range []struct {
+		acceptEncoding string
+		enabled        bool
+		expectCoding   string
+	}{
+		{acceptEncoding: "gzip", enabled: true, expectCoding: "gzip"},
+		{acceptEncoding: "br", enabled: true, expectCoding: ""},
+		{acceptEncoding: "br;q=1, gzip;q=0.5", enabled: true, expectCoding: "gzip"},
+		{acceptEncoding: "gzip", enabled: false, expectCoding: "gzip"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		if tc.enabled {
+			req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+		}
+		rr := httptest.NewRecorder()
+		if err := fsrv.ServeHTTP(rr, withTestReplacer(req), nil); err != nil {
+			t.Fatalf("Test %d: unexpected error: %v", i, err)
+		}
+
+		if coding := rr.Header().Get("Content-Encoding"); coding != tc.expectCoding {
+			t.Errorf("Test %d: expected Content-Encoding %q, got %q", i, tc.expectCoding, coding)
+		}
+		body := rr.Body.String()
+		if !tc.enabled {
+			if body != "not the page" {
+				t.Errorf("Test %d: expected the sidecar, got %q", i, body)
+			}
+			continue
+		}
+		if tc.expectCoding == "gzip" {
+			body = gunzip(t, rr.Body.Bytes())
+		}
+		if !strings.Contains(body, "serviceWorker.register") || !strings.Contains(body, "<p>hi</p>") {
+			t.Errorf("Test %d: expected rewritten page, got %q", i, body)
+		}
+		if vary := strings.Join(rr.Header().Values("Vary"), ", "); !strings.Contains(vary, "Accept-Encoding") || !strings.Contains(vary, "X-CacheV2-Extension-Enabled") {
+			t.Errorf("Test %d: expected Vary: Accept-Encoding, X-CacheV2-Extension-Enabled, got %v", i, rr.Header())
+		}
+		if !strings.HasPrefix(rr.Header().Get("Etag"), `"cv2-`) || rr.Header().Get("Last-Modified") != "" {
+			t.Errorf("Test %d: expected validators of the rewritten page, got %v", i, rr.Header())
+		}
+	}
+
+	// sidecars of other files have the etag of the file in the
+	// manifest, with their coding
+	token, err := engine.resolver.ResolveETag(withTestReplacer(httptest.NewRequest(http.MethodGet, "/", nil)), "/site.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/site.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	if err := fsrv.ServeHTTP(rr, withTestReplacer(req), nil); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Body.String() != "compressed" || rr.Header().Get("Etag") != encodedEtag(token, "gzip") {
+		t.Errorf("expected the sidecar with the etag %s of the file, got %v", encodedEtag(token, "gzip"), rr.Header())
+	}
+}
+
+func TestCacheV2HandlerDecodes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "site.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := e.encodeContent(contentCodings["gzip"], []byte(encodingTestPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, err := w.Write(compressed)
+		return err
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+	rr := httptest.NewRecorder()
+	if err := (&CacheV2{engine: e}).ServeHTTP(rr, withTestReplacer(req), next); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected the page to stay compressed, got %v", rr.Header())
+	}
+	body := gunzip(t, rr.Body.Bytes())
+	if !strings.Contains(body, "serviceWorker.register") || rr.Header().Get("X-Etag-Config") == "" {
+		t.Errorf("expected rewritten page with manifest, got %q and %v", body, rr.Header())
+	}
+}
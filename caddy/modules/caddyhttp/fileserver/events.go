@@ -0,0 +1,117 @@
+package fileserver
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// The names of the events which CacheV2 emits through the events app.
+const (
+	eventTokenAdded   = "cachev2.token_added"
+	eventTokenChanged = "cachev2.token_changed"
+	eventTokenRemoved = "cachev2.token_removed"
+	eventProxyFailed  = "cachev2.proxy_failed"
+)
+
+// The sources from which tokens are learned.
+const (
+	sourceOrigin  = "origin"  // a response of the origin, e.g. through the proxy
+	sourceRefresh = "refresh" // a refresh of the token store
+	sourceAPI     = "api"     // EtagStore.Set, e.g. through the admin API
+	sourceWatch   = "watch"   // a change of a watched file
+)
+
+// tokenEvent describes the change of a validation token.
+type tokenEvent struct {
+	name    string
+	url     string
+	etag    string // the new token, or the removed one
+	oldEtag string // of changed tokens
+	source  string // of added and changed tokens
+	reason  string // of removed tokens: expired, evicted, failed or deleted
+}
+
+// data returns the data of the event for the events app.
+func (ev tokenEvent) data(store string) map[string]any {
+	data := map[string]any{"url": ev.url}
+	if store != "" {
+		data["store"] = store
+	}
+	switch ev.name {
+	case eventTokenChanged:
+		data["old_etag"] = ev.oldEtag
+		data["new_etag"] = ev.etag
+	default:
+		data["etag"] = ev.etag
+	}
+	if ev.source != "" {
+		data["source"] = ev.source
+	}
+	if ev.reason != "" {
+		data["reason"] = ev.reason
+	}
+	return data
+}
+
+// subscribe registers fn to be called with the changes of the tokens in
+// the store, until the returned function is called. Only the listener
+// subscribed last is called, so that handlers which share the store do
+// not report the same change more than once.
+func (s *EtagStore) subscribe(fn func(tokenEvent)) (unsubscribe func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	listener := &fn
+	s.listeners = append(s.listeners, listener)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, l := range s.listeners {
+			if l == listener {
+				s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// record queues ev for the listeners, if there are any. The caller must
+// hold the lock, and call notify once it released it.
+func (s *EtagStore) record(ev tokenEvent) {
+	if len(s.listeners) > 0 {
+		s.pending = append(s.pending, ev)
+	}
+}
+
+// notify reports the queued changes to the listener. It must be called
+// without holding the lock.
+func (s *EtagStore) notify() {
+	s.mu.Lock()
+	events := s.pending
+	s.pending = nil
+	var listener func(tokenEvent)
+	if n := len(s.listeners); n > 0 {
+		listener = *s.listeners[n-1]
+	}
+	s.mu.Unlock()
+	if listener == nil {
+		return
+	}
+	for _, ev := range events {
+		listener(ev)
+	}
+}
+
+// eventEmitter emits events through the events app on behalf of the
+// module of its context.
+type eventEmitter struct {
+	ctx    caddy.Context
+	events *caddyevents.App
+}
+
+// emit emits the named event with data. It does nothing if em is nil.
+func (em *eventEmitter) emit(name string, data map[string]any) {
+	if em == nil {
+		return
+	}
+	em.events.Emit(em.ctx, name, data)
+}
@@ -3,13 +3,15 @@ package fileserver
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
-	"io"
-	"io/fs"
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
 	"slices"
-	"strings"
+	"sort"
+	"sync"
 
-	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
@@ -28,91 +30,247 @@ func findTags(root *html.Node, tags []atom.Atom) []*html.Node {
 	return foundTags
 }
 
-func isLocalfile(uri string) bool {
-	s := strings.ToLower(uri)
-	return strings.Contains(s, "localhost") || !strings.Contains(s, "http")
+// rewrittenPage is an HTML page prepared for rewriting: the rendered
+// document split where the CacheV2 nodes are inserted, at the start of
+// its body, and the dependencies whose tokens go into its manifest. The
+// page is rendered again only when its manifest changes. Of pages which
+// are streamed, only the dependencies are known.
+type rewrittenPage struct {
+	key        string // the page URL
+	sourceEtag string // of the original document
+	head, tail []byte
+	deps       *pageDependencies
+	streamed   bool
+
+	mu       sync.Mutex
+	version  string // of the manifest in content
+	content  []byte
+	manifest []byte // the last one computed
 }
 
-func normalizeFilename(s string) string {
-	idx := strings.Index(s, "?")
-	if idx == -1 {
-		return s
+// parsePage parses the HTML document h, finds the dependencies of its
+// sub-resources with crawler, and returns the page prepared for
+// rewriting and the current tokens of its dependencies.
+func parsePage(r *http.Request, crawler *dependencyCrawler, h []byte) (*rewrittenPage, map[string]string, error) {
+	root, err := html.Parse(bytes.NewReader(h))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base := documentBaseURL(root, documentURL(r))
+	deps, m := crawler.crawl(r, base, extractResourceURLs(root))
+
+	// render the document with a marker where the nodes go; frameset
+	// documents have no body, so they get the nodes at the end of the
+	// head, which the parser always adds
+	marker := &html.Node{Type: html.CommentNode, Data: injectionMarker}
+	if bodies := findTags(root, []atom.Atom{atom.Body}); len(bodies) > 0 {
+		body := bodies[0]
+		if body.FirstChild != nil {
+			body.InsertBefore(marker, body.FirstChild)
+		} else {
+			body.AppendChild(marker)
+		}
+	} else if heads := findTags(root, []atom.Atom{atom.Head}); len(heads) > 0 {
+		heads[0].AppendChild(marker)
+	} else {
+		return nil, nil, errors.New("no body or head in parsed document")
+	}
+
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	_ = html.Render(w, root)
+	err = w.Flush()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return s[:idx]
+	rendered := buf.Bytes()
+	markerTag := []byte("<!--" + injectionMarker + "-->")
+	i := bytes.Index(rendered, markerTag)
+	if i < 0 {
+		return nil, nil, errors.New("injection point not found in rendered document")
+	}
+	return &rewrittenPage{
+		head: rendered[:i],
+		tail: rendered[i+len(markerTag):],
+		deps: deps,
+	}, m, nil
 }
 
-func getEtagJsonAndRegisterServiceWorker(fsys fs.FS, rootDir string, h io.Reader) (string, string, error) {
-	m := make(map[string]string)
-	root, err := html.Parse(h)
+// injectionMarker marks the injection point in rendered documents. It is
+// random, so that documents cannot contain it.
+var injectionMarker = func() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "cachev2-" + hex.EncodeToString(b)
+}()
+
+// render returns the document of p with the nodes inserted, which nodes
+// returns for the manifest of the given version. The result is kept
+// until the manifest changes.
+func (p *rewrittenPage) render(version string, nodes func() ([]*html.Node, error)) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.content != nil && p.version == version {
+		return p.content, nil
+	}
+
+	injected, err := nodes()
 	if err != nil {
-		return "", "", err
-	}
-
-	tags := findTags(root, []atom.Atom{atom.Img, atom.Link, atom.Script})
-	for _, node := range tags {
-		var src *html.Attribute
-		for _, attr := range node.Attr {
-			a := attr
-			if attr.Key == "src" {
-				src = &a
-				break
-			} else if attr.Key == "href" {
-				src = &a
-				break
-			}
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(p.head)+len(p.tail)+1024))
+	buf.Write(p.head)
+	for _, node := range injected {
+		if err := html.Render(buf, node); err != nil {
+			return nil, err
 		}
+	}
+	buf.Write(p.tail)
 
-		if src == nil || !isLocalfile(src.Val) {
-			continue
-		}
+	p.version = version
+	p.content = buf.Bytes()
+	return p.content, nil
+}
 
-		fileName := strings.TrimSuffix(caddyhttp.SanitizedPathJoin(rootDir, normalizeFilename(src.Val)), "/")
-		stat, err := fs.Stat(fsys, fileName)
-		if err != nil {
-			continue
+// setManifest remembers the encoded manifest data last computed for p.
+func (p *rewrittenPage) setManifest(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.manifest = data
+}
+
+// lastManifest returns the encoded manifest data last computed for p.
+func (p *rewrittenPage) lastManifest() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.manifest
+}
+
+// size returns the approximate memory size of p.
+func (p *rewrittenPage) size() int {
+	size := 2 * (len(p.head) + len(p.tail))
+	if p.deps != nil {
+		for _, dep := range p.deps.local {
+			size += len(dep.url) + len(dep.target) + len(dep.etag)
+		}
+		for _, u := range p.deps.remote {
+			size += len(u)
 		}
+	}
+	return size
+}
 
-		m[src.Val] = calculateEtag(stat)
+// pageCache holds the pages prepared for rewriting by URL, one version
+// of each. It is bounded in size and forgets the least recently used
+// pages.
+type pageCache struct {
+	mu    sync.Mutex
+	max   int
+	size  int
+	items map[string]*list.Element
+	lru   *list.List // of *rewrittenPage, most recently used first
+}
+
+func newPageCache(max int) *pageCache {
+	return &pageCache{
+		max:   max,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
 	}
+}
 
-	jsCode := `
-if ('serviceWorker' in navigator) {
-    navigator.serviceWorker.register('/sw.js').then(function() {
-        return navigator.serviceWorker.ready;
-    }).catch(function(error) {
-        console.log('Error : ', error);
-    });
+func (c *pageCache) add(p *rewrittenPage) {
+	if c.max <= 0 || p.size() > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[p.key]; ok {
+		c.size -= elem.Value.(*rewrittenPage).size()
+		c.lru.Remove(elem)
+	}
+	c.items[p.key] = c.lru.PushFront(p)
+	c.size += p.size()
+	for c.size > c.max {
+		oldest := c.lru.Remove(c.lru.Back()).(*rewrittenPage)
+		delete(c.items, oldest.key)
+		c.size -= oldest.size()
+	}
 }
-`
-	body := findTags(root, []atom.Atom{atom.Body})[0]
-	script := &html.Node{
-		Type:     html.ElementNode,
-		Data:     "script",
-		DataAtom: atom.Script,
-	}
-	script.AppendChild(&html.Node{
-		Type: html.TextNode,
-		Data: jsCode,
-	})
-	if body.FirstChild != nil {
-		body.InsertBefore(script, body.FirstChild)
-	} else {
-		body.AppendChild(script)
+
+func (c *pageCache) get(key string) (*rewrittenPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
 	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*rewrittenPage), true
+}
 
-	buf := new(bytes.Buffer)
-	w := bufio.NewWriter(buf)
-	_ = html.Render(w, root)
-	err = w.Flush()
-	if err != nil {
-		return "", "", err
+func (c *pageCache) remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if ok {
+		c.lru.Remove(elem)
+		delete(c.items, key)
+		c.size -= elem.Value.(*rewrittenPage).size()
 	}
+	return ok
+}
 
-	etagJson, err := json.Marshal(m)
-	if err != nil {
-		return "", "", err
+func (c *pageCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+// list returns the pages, most recently used first.
+func (c *pageCache) list() []*rewrittenPage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pages := make([]*rewrittenPage, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		pages = append(pages, elem.Value.(*rewrittenPage))
 	}
+	return pages
+}
 
-	return buf.String(), string(etagJson), nil
+// removeDependents removes the pages which depend on the resource at
+// target, or on a resource below it if it is a directory. An empty
+// target removes all pages. It returns the dependencies on the resource
+// of the removed pages, one per URL.
+func (c *pageCache) removeDependents(target string) []localDependency {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var deps []localDependency
+	seen := make(map[string]bool)
+	for key, elem := range c.items {
+		p := elem.Value.(*rewrittenPage)
+		if target != "" && (p.deps == nil || !p.deps.dependsOn(target)) {
+			continue
+		}
+		c.lru.Remove(elem)
+		delete(c.items, key)
+		c.size -= p.size()
+		if p.deps == nil {
+			continue
+		}
+		for _, dep := range p.deps.local {
+			if !seen[dep.url] && (target == "" || dep.dependsOn(target)) {
+				seen[dep.url] = true
+				deps = append(deps, dep)
+			}
+		}
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].url < deps[j].url })
+	return deps
 }
@@ -0,0 +1,129 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRewriteMemoized(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string, mtime time.Time) {
+		filename := filepath.Join(root, name)
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("site.css", `@import "theme.css";`, now)
+	write("theme.css", "body{}", now)
+	write("logo.png", "png", now)
+
+	e, err := newCacheV2Engine(CacheV2Config{CrawlDepth: 1, ManifestDelivery: []string{deliverInline}}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := `<html><head><link rel="stylesheet" href="/site.css"></head><body><img src="/logo.png"><p>hi</p></body></html>`
+	var opened int
+	rewrite := func(sourceEtag string) (string, string) {
+		req := withTestReplacer(httptest.NewRequest(http.MethodGet, "/", nil))
+		content, etag, err := e.rewrite(httptest.NewRecorder(), req, sourceEtag, func() ([]byte, error) {
+			opened++
+			return []byte(page), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content), etag
+	}
+
+	first, firstEtag := rewrite(`"a"`)
+	if opened != 1 || !strings.Contains(first, "theme.css") || !strings.Contains(first, "<p>hi</p>") {
+		t.Fatalf("expected the page to be parsed and crawled, got %d reads and %s", opened, first)
+	}
+	second, secondEtag := rewrite(`"a"`)
+	if opened != 1 || second != first || secondEtag != firstEtag {
+		t.Errorf("expected the memoized page, got %d reads", opened)
+	}
+
+	// a changed token of a resource is picked up without parsing the page
+	write("logo.png", "png!", now.Add(time.Hour))
+	third, thirdEtag := rewrite(`"a"`)
+	if opened != 1 || third == first || thirdEtag == firstEtag {
+		t.Errorf("expected the memoized page with a new manifest, got %d reads", opened)
+	}
+
+	// a changed style sheet may reference other resources now
+	write("site.css", `@import "other.css";`, now.Add(time.Hour))
+	rewrite(`"a"`)
+	if opened != 2 {
+		t.Errorf("expected the page to be crawled again, got %d reads", opened)
+	}
+
+	// and a new document is parsed again
+	rewrite(`"b"`)
+	if opened != 3 {
+		t.Errorf("expected the new document to be parsed, got %d reads", opened)
+	}
+
+	// frameset documents have no body, so the nodes go into the head
+	page = `<html><head><title>f</title></head><frameset cols="50%,50%"><frame src="/a.html"><frame src="/b.html"></frameset></html>`
+	framed, _ := rewrite(`"c"`)
+	if !strings.Contains(framed, "serviceWorker.register") || !strings.Contains(framed, "</script></head><frameset") {
+		t.Errorf("expected the nodes at the end of the head, got %s", framed)
+	}
+}
+
+func TestPageCache(t *testing.T) {
+	c := newPageCache(150)
+	for _, key := range []string{"a", "b", "c"} {
+		c.add(&rewrittenPage{key: key, head: make([]byte, 10), tail: make([]byte, 10)})
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected page a to be cached")
+	}
+	c.add(&rewrittenPage{key: "d", head: make([]byte, 10), tail: make([]byte, 10)})
+	if _, ok := c.get("b"); ok {
+		t.Error("expected least recently used page b to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("expected page %s to be cached", key)
+		}
+	}
+	c.add(&rewrittenPage{key: "huge", head: make([]byte, 100)})
+	if _, ok := c.get("huge"); ok {
+		t.Error("expected page larger than the cache not to be cached")
+	}
+
+	// pages which depend on a changed resource are removed, and the URLs
+	// at which they reference it are returned once
+	logo := localDependency{url: "http://example.com/img/logo.png", target: "/img/logo.png"}
+	css := localDependency{url: "http://example.com/site.css", target: "/site.css"}
+	c = newPageCache(1 << 10)
+	c.add(&rewrittenPage{key: "d", deps: &pageDependencies{local: []localDependency{css}}})
+	c.add(&rewrittenPage{key: "a", deps: &pageDependencies{local: []localDependency{logo, css}}})
+	c.add(&rewrittenPage{key: "c", deps: &pageDependencies{local: []localDependency{logo}}})
+	deps := c.removeDependents("/img")
+	if len(deps) != 1 || deps[0] != logo {
+		t.Errorf("expected the dependency on the logo, got %+v", deps)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); ok {
+			t.Errorf("expected dependent page %s to be removed", key)
+		}
+	}
+	if _, ok := c.get("d"); !ok {
+		t.Error("expected independent page d to be kept")
+	}
+}
@@ -0,0 +1,182 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// headElements are the elements which may precede the body of a
+// document; any other element starts it, even without a <body> tag.
+var headElements = map[atom.Atom]bool{
+	atom.Html:     true,
+	atom.Head:     true,
+	atom.Title:    true,
+	atom.Base:     true,
+	atom.Meta:     true,
+	atom.Link:     true,
+	atom.Style:    true,
+	atom.Script:   true,
+	atom.Noscript: true,
+	atom.Template: true,
+}
+
+// streamDocument copies the HTML document from src to w token by token,
+// so that it is never held in memory as a whole and the start of the
+// document is sent before its end is read. Tokens are copied as they
+// were written. The nodes early are inserted at the start of the body,
+// and the nodes which late returns at its end, or both before the
+// frameset of documents without a body; late is given the URLs of
+// the sub-resources which the document references, like those that
+// extractResourceURLs returns, and the href of its first <base> element.
+func streamDocument(w io.Writer, src io.Reader, early []*html.Node, late func(refs []string, base string) ([]*html.Node, error)) error {
+	bw := bufio.NewWriterSize(w, 16<<10)
+	writeNodes := func(nodes []*html.Node) error {
+		for _, node := range nodes {
+			if err := html.Render(bw, node); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		resources          resourceCollector
+		base               string
+		baseSeen           bool
+		textElement        atom.Atom // the open element whose text is raw
+		templates          int       // the depth of open templates
+		injected, finished bool
+		raw                []byte
+	)
+	inject := func() error {
+		injected = true
+		return writeNodes(early)
+	}
+	finish := func() error {
+		finished = true
+		if late == nil {
+			return nil
+		}
+		nodes, err := late(resources.urls, base)
+		if err != nil {
+			return err
+		}
+		return writeNodes(nodes)
+	}
+
+	z := html.NewTokenizer(src)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return err
+			}
+			break
+		}
+		// the tokenizer lowercases tag names in place, but the
+		// token is copied as written
+		raw = append(raw[:0], z.Raw()...)
+
+		var before, after func() error
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if templates == 0 {
+				resources.addElement(tok.DataAtom, tok.Attr)
+				if tok.DataAtom == atom.Base && !baseSeen {
+					for _, attr := range tok.Attr {
+						if attr.Key == "href" {
+							base, baseSeen = attr.Val, true
+						}
+					}
+				}
+				if !injected {
+					if tok.DataAtom == atom.Body {
+						after = inject
+					} else if !headElements[tok.DataAtom] {
+						before = inject
+					}
+				}
+				// frameset documents have no body, and nothing but
+				// frames is parsed after the frameset, so all nodes
+				// go before it, where they end up in the head
+				if tok.DataAtom == atom.Frameset && !finished {
+					before = func() error {
+						if !injected {
+							if err := inject(); err != nil {
+								return err
+							}
+						}
+						return finish()
+					}
+				}
+			}
+			if tt == html.StartTagToken {
+				switch tok.DataAtom {
+				case atom.Template:
+					templates++
+				case atom.Title, atom.Style, atom.Script, atom.Noscript, atom.Textarea:
+					textElement = tok.DataAtom
+				}
+			}
+
+		case html.EndTagToken:
+			tok := z.Token()
+			if tok.DataAtom == atom.Template && templates > 0 {
+				templates--
+			}
+			if tok.DataAtom == textElement {
+				textElement = 0
+			}
+			if templates == 0 && !finished && (tok.DataAtom == atom.Body || tok.DataAtom == atom.Html) {
+				if !injected {
+					if err := inject(); err != nil {
+						return err
+					}
+				}
+				before = finish
+			}
+
+		case html.TextToken:
+			if templates > 0 {
+				break
+			}
+			if textElement == atom.Style {
+				resources.addStyleSheet(string(raw))
+			}
+			if !injected && textElement == 0 && len(bytes.TrimSpace(raw)) > 0 {
+				before = inject
+			}
+		}
+
+		if before != nil {
+			if err := before(); err != nil {
+				return err
+			}
+		}
+		if _, err := bw.Write(raw); err != nil {
+			return err
+		}
+		if after != nil {
+			if err := after(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !injected {
+		if err := inject(); err != nil {
+			return err
+		}
+	}
+	if !finished {
+		if err := finish(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
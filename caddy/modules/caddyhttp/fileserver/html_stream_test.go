@@ -0,0 +1,177 @@
+package fileserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestStreamDocument(t *testing.T) {
+	early := []*html.Node{{Type: html.CommentNode, Data: "early"}}
+	for i, tc := range []struct {
+		input, expect string
+	}{
+		{
+			input:  `<!DOCTYPE html><HTML><Head><title>a <b></title></head><BODY class="x"><p>hi</p></BODY></HTML>`,
+			expect: `<!DOCTYPE html><HTML><Head><title>a <b></title></head><BODY class="x"><!--early--><p>hi</p><!--late--></BODY></HTML>`,
+		},
+		{
+			input:  "<title>t</title>\n<script>var a = '<p>';</script>\n<p>no body tag",
+			expect: "<title>t</title>\n<script>var a = '<p>';</script>\n<!--early--><p>no body tag<!--late-->",
+		},
+		{
+			input:  `<head><template><div></div></template></head>text`,
+			expect: `<head><template><div></div></template></head><!--early-->text<!--late-->`,
+		},
+		{
+			input:  `<html><head></head><frameset><frame src="a.html"></frameset></html>`,
+			expect: `<html><head></head><!--early--><!--late--><frameset><frame src="a.html"></frameset></html>`,
+		},
+		{
+			input:  ``,
+			expect: `<!--early--><!--late-->`,
+		},
+	} {
+		buf := new(bytes.Buffer)
+		err := streamDocument(buf, strings.NewReader(tc.input), early, func(refs []string, base string) ([]*html.Node, error) {
+			return []*html.Node{{Type: html.CommentNode, Data: "late"}}, nil
+		})
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if buf.String() != tc.expect {
+			t.Errorf("Test %d: expected\n%s\ngot\n%s", i, tc.expect, buf.String())
+		}
+	}
+
+	// references are collected like from a parsed document
+	var refs []string
+	var base string
+	doc := strings.Replace(resourcesTestDocument, "<head>", `<head><base href="/static/"><base href="/other/">`, 1)
+	err := streamDocument(new(bytes.Buffer), strings.NewReader(doc), nil, func(r []string, b string) ([]*html.Node, error) {
+		refs, base = r, b
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refs, resourcesTestURLs) {
+		t.Errorf("expected:\n%q\ngot:\n%q", resourcesTestURLs, refs)
+	}
+	if base != "/static/" {
+		t.Errorf("expected base /static/, got %q", base)
+	}
+}
+
+func TestFileServerStreams(t *testing.T) {
+	root := t.TempDir()
+	page := `<html><head><link rel="stylesheet" href="/site.css"></head><body><p>hi</p>` + strings.Repeat("<p>more</p>", 100) + `</body></html>`
+	for name, content := range map[string]string{
+		"index.html": page,
+		"site.css":   "body{}",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine, err := newCacheV2Engine(CacheV2Config{StreamThreshold: 1024}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsrv := &FileServer{Root: root, fileSystem: osFS{}, cachev2: engine, logger: zap.NewNop()}
+	serve := func(ifNoneMatch string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		if err := fsrv.ServeHTTP(rr, withTestReplacer(req), nil); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Result()
+	}
+
+	// without a known manifest, it follows the page
+	resp := serve("")
+	body := readBody(t, resp)
+	if resp.Header.Get("Etag") != "" || resp.Header.Get("Content-Length") != "" || resp.Header.Get("X-Etag-Config") != "" {
+		t.Errorf("expected no validators, length or manifest header, got %v", resp.Header)
+	}
+	if !strings.Contains(resp.Trailer.Get("X-Etag-Config"), "site.css") {
+		t.Errorf("expected the manifest in a trailer, got %v", resp.Trailer)
+	}
+	register := strings.Index(body, "serviceWorker.register")
+	handover := strings.Index(body, `id="cachev2-manifest"`)
+	if register < 0 || register > strings.Index(body, "<p>hi</p>") || handover < strings.LastIndex(body, "<p>more</p>") {
+		t.Errorf("expected registration at the start and manifest at the end, got %s", body)
+	}
+
+	// afterwards, it is known in advance
+	resp = serve("")
+	body = readBody(t, resp)
+	etag := resp.Header.Get("Etag")
+	if !strings.HasPrefix(etag, `"cv2-`) || !strings.Contains(resp.Header.Get("X-Etag-Config"), "site.css") {
+		t.Errorf("expected etag and manifest header, got %v", resp.Header)
+	}
+	if strings.Contains(body, `id="cachev2-manifest"`) || !strings.HasSuffix(body, "<p>more</p></body></html>") {
+		t.Errorf("expected page without handover, got %s", body)
+	}
+	if resp = serve(etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected status 304 for matching etag, got %d", resp.StatusCode)
+	}
+}
+
+func TestCacheV2HandlerStreams(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "logo.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newCacheV2Engine(CacheV2Config{StreamThreshold: 1 << 20}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		for _, part := range []string{"<html><body><p>", "hi</p><img src=", "/logo.png></body></html>"} {
+			if _, err := w.Write([]byte(part)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+	rr := httptest.NewRecorder()
+	if err := (&CacheV2{engine: e}).ServeHTTP(rr, withTestReplacer(req), next); err != nil {
+		t.Fatal(err)
+	}
+	resp := rr.Result()
+	body := readBody(t, resp)
+	if !strings.HasPrefix(body, "<html><body><script>") || !strings.Contains(body, "<p>hi</p><img src=/logo.png>") {
+		t.Errorf("expected streamed page, got %s", body)
+	}
+	if !strings.Contains(resp.Trailer.Get("X-Etag-Config"), "logo.png") {
+		t.Errorf("expected the manifest in a trailer, got %v", resp.Trailer)
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
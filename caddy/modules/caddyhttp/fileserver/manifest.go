@@ -0,0 +1,625 @@
+package fileserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// The manifest of a page maps the absolute URLs of its sub-resources to
+// their validation tokens. It is encoded compactly as a JSON object of
+// URL prefixes, each holding the tokens of the URLs with that prefix by
+// the rest of the URL:
+//
+//	{"/css/": {"site.css": "\"abc\""}, "https://cdn.example.com/lib/": {"a.js": "\"def\""}}
+//
+// Prefixes of the same origin as the page are paths. The header value
+// is this JSON, or `gz:` followed by its gzipped base64 encoding, or,
+// for manifests too large for a header, `ref:` followed by the URL of
+// the manifest endpoint which serves the JSON.
+
+// encodeManifest returns the compact JSON encoding of the tokens in m,
+// whose keys are absolute URLs, for a page of the origin.
+func encodeManifest(m map[string]string, origin *url.URL) ([]byte, error) {
+	originPrefix := origin.Scheme + "://" + origin.Host
+	grouped := make(map[string]map[string]string)
+	for key, token := range m {
+		prefix, name := splitManifestKey(key, originPrefix)
+		group, ok := grouped[prefix]
+		if !ok {
+			group = make(map[string]string)
+			grouped[prefix] = group
+		}
+		group[name] = token
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(grouped); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// splitManifestKey splits the URL key into the prefix under which it
+// is grouped, i.e. up to the last slash of its path, and the rest. Keys
+// of originPrefix are shortened to their path.
+func splitManifestKey(key, originPrefix string) (string, string) {
+	if rest, ok := strings.CutPrefix(key, originPrefix); ok && strings.HasPrefix(rest, "/") {
+		key = rest
+	}
+	pathEnd := strings.IndexByte(key, '?')
+	if pathEnd < 0 {
+		pathEnd = len(key)
+	}
+	slash := strings.LastIndexByte(key[:pathEnd], '/')
+	return key[:slash+1], key[slash+1:]
+}
+
+// Ways in which the manifest of a page is delivered to the service worker.
+const (
+	// in the manifest header of the page's response
+	deliverHeader = "header"
+	// in a JSON script element at the start of the page's body
+	deliverInline = "inline"
+	// not a delivery: preload links in a 103 Early Hints response
+	// before the page's response, which service workers cannot read
+	deliverEarlyHints = "early_hints"
+	// by the manifest endpoint, which the header and the page reference
+	deliverURL = "url"
+)
+
+// delivers returns true if manifests are delivered in the given way.
+func (e *cacheV2Engine) delivers(mode string) bool {
+	return slices.Contains(e.config.ManifestDelivery, mode)
+}
+
+// manifestHeader returns the value of the manifest header for the
+// encoded manifest data. Manifests larger than the maximum header size,
+// and all of them if they are delivered by URL, are kept in the engine's
+// manifest set and referenced by URL.
+func (e *cacheV2Engine) manifestHeader(data []byte) (string, error) {
+	if e.delivers(deliverURL) {
+		return e.manifestRef(data), nil
+	}
+
+	value := string(data)
+	if e.config.CompressManifest {
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(data); err != nil {
+			return "", err
+		}
+		if err := zw.Close(); err != nil {
+			return "", err
+		}
+		if compressed := "gz:" + base64.StdEncoding.EncodeToString(buf.Bytes()); len(compressed) < len(value) {
+			value = compressed
+		}
+	}
+	if int64(len(value)) <= e.config.ManifestMaxSize {
+		return value, nil
+	}
+	return e.manifestRef(data), nil
+}
+
+// manifestRef adds the encoded manifest data to the engine's manifest
+// set and returns the reference to its URL.
+func (e *cacheV2Engine) manifestRef(data []byte) string {
+	hash := manifestHash(data)
+	e.manifests.add(hash, data)
+	return "ref:" + e.config.ManifestPrefix + "/" + hash
+}
+
+// manifestURL returns the URL in the manifest header value, if it
+// references the manifest endpoint.
+func manifestURL(header string) (string, bool) {
+	return strings.CutPrefix(header, "ref:")
+}
+
+// registrationNodes returns the nodes to insert at the start of a page's
+// body: the manifest data if it is delivered inline, and the script which
+// registers the service worker and hands it the inline or referenced
+// manifest, so that the worker gets the tokens even if it did not see
+// the page's response, as on the first visit.
+func (e *cacheV2Engine) registrationNodes(data []byte, header string) ([]*html.Node, error) {
+	nodes, manifest, err := e.manifestNodes(data, header, e.delivers(deliverInline))
+	if err != nil {
+		return nil, err
+	}
+	jsCode, err := e.registrationScript(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return append(nodes, scriptNode(jsCode)), nil
+}
+
+// handoverNodes returns the nodes to insert at the end of a page which
+// was streamed before its manifest was known: the manifest data unless
+// it is delivered by URL, and the script which hands it to the service
+// worker, since the worker cannot read it from a trailer.
+func (e *cacheV2Engine) handoverNodes(data []byte, header string) ([]*html.Node, error) {
+	nodes, manifest, err := e.manifestNodes(data, header, !e.delivers(deliverURL))
+	if err != nil {
+		return nil, err
+	}
+	return append(nodes, scriptNode(handoverScript(manifest))), nil
+}
+
+// manifestNodes returns the nodes which hold the manifest data, if it
+// is inline, and the JavaScript expression which evaluates to the
+// manifest in the page: the inline data, the reference in the manifest
+// header value if the manifest is delivered by URL, or null.
+func (e *cacheV2Engine) manifestNodes(data []byte, header string, inline bool) ([]*html.Node, string, error) {
+	switch {
+	case inline:
+		buf := new(bytes.Buffer)
+		json.HTMLEscape(buf, data)
+		node := scriptNode(buf.String(),
+			html.Attribute{Key: "type", Val: "application/json"},
+			html.Attribute{Key: "id", Val: inlineManifestID})
+		return []*html.Node{node}, `document.getElementById("` + inlineManifestID + `").textContent`, nil
+	case e.delivers(deliverURL):
+		literal, err := json.Marshal(header)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, string(literal), nil
+	}
+	return nil, "null", nil
+}
+
+// registrationScript returns the script which registers the service
+// worker and hands it the manifest that the JavaScript expression
+// manifest evaluates to.
+func (e *cacheV2Engine) registrationScript(manifest string) (string, error) {
+	swURLLiteral, err := json.Marshal(e.serviceWorkerURL())
+	if err != nil {
+		return "", err
+	}
+	return `
+if ('serviceWorker' in navigator) {
+    navigator.serviceWorker.register(` + string(swURLLiteral) + `).then(function() {
+        return navigator.serviceWorker.ready;
+    }).then(function(registration) {
+        var manifest = ` + manifest + `;
+        if (manifest != null && registration.active) {
+            registration.active.postMessage({cachev2Manifest: manifest});
+        }
+    }).catch(function(error) {
+        console.log('Error : ', error);
+    });
+}
+`, nil
+}
+
+// handoverScript returns the script which hands the manifest that the
+// JavaScript expression manifest evaluates to to the service worker,
+// once the worker is active.
+func handoverScript(manifest string) string {
+	return `
+if ('serviceWorker' in navigator) {
+    navigator.serviceWorker.ready.then(function(registration) {
+        var manifest = ` + manifest + `;
+        if (manifest != null && registration.active) {
+            registration.active.postMessage({cachev2Manifest: manifest});
+        }
+    });
+}
+`
+}
+
+// scriptVersion returns the version of the scripts which are injected
+// into pages and registered by them. It changes with the service worker
+// and the way the manifest is delivered.
+func (e *cacheV2Engine) scriptVersion() (string, error) {
+	jsCode, err := e.registrationScript("null")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, part := range append([]string{serviceWorkerEtag, jsCode}, e.config.ManifestDelivery...) {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
+
+// manifestVersion returns the version of the encoded manifest data.
+func manifestVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// rewrittenEtag returns the etag of a page which was rewritten from a
+// document with the etag source and has a manifest of the given version.
+// It differs from the document's etag, and changes with it as well as
+// with the injected scripts and the manifest. It is weak if the
+// document's etag is.
+func (e *cacheV2Engine) rewrittenEtag(source, manifestVersion string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + e.scriptVer + "\x00" + manifestVersion))
+	etag := `"cv2-` + hex.EncodeToString(sum[:12]) + `"`
+	if strings.HasPrefix(source, "W/") {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// documentEtag returns etag, or one derived from content if the
+// document has none.
+func documentEtag(etag string, content []byte) string {
+	if etag != "" {
+		return etag
+	}
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// inlineManifestID is the id of the script element which holds
+// the manifest of a page if it is delivered inline.
+const inlineManifestID = "cachev2-manifest"
+
+func scriptNode(text string, attrs ...html.Attribute) *html.Node {
+	script := &html.Node{
+		Type:     html.ElementNode,
+		Data:     "script",
+		DataAtom: atom.Script,
+		Attr:     attrs,
+	}
+	script.AppendChild(&html.Node{
+		Type: html.TextNode,
+		Data: text,
+	})
+	return script
+}
+
+// maxEarlyHints is the most preload links sent in Early Hints.
+const maxEarlyHints = 32
+
+// preloadLink returns the value of a Link header field which preloads
+// the resource at u, or "" if its destination is not known by the
+// extension of its path.
+func preloadLink(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	var as string
+	switch strings.ToLower(path.Ext(parsed.Path)) {
+	case ".css":
+		as = "style"
+	case ".js", ".mjs":
+		as = "script"
+	case ".woff", ".woff2", ".ttf", ".otf":
+		// fonts are always fetched in CORS mode
+		as = "font; crossorigin"
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico":
+		as = "image"
+	default:
+		return ""
+	}
+	return "<" + parsed.RequestURI() + ">; rel=preload; as=" + as
+}
+
+// writeEarlyHints sends a 103 Early Hints response with the header fields
+// hints. The header of w is set aside meanwhile, so that the fields of the
+// final response are not sent early.
+func writeEarlyHints(w http.ResponseWriter, hints http.Header) {
+	hdr := w.Header()
+	final := hdr.Clone()
+	for field := range hdr {
+		delete(hdr, field)
+	}
+	for field, values := range hints {
+		hdr[field] = values
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+	for field := range hdr {
+		delete(hdr, field)
+	}
+	for field, values := range final {
+		hdr[field] = values
+	}
+}
+
+// isManifestRequest returns true if r is meant for the manifest endpoint.
+func (e *cacheV2Engine) isManifestRequest(r *http.Request) bool {
+	return !e.config.Disabled && strings.HasPrefix(r.URL.Path, e.config.ManifestPrefix+"/")
+}
+
+// serveManifest writes the manifest that r asks for. Manifests are
+// addressed by the hash of their contents, so they never change and
+// may be cached for good; unknown ones may become known later, when
+// another instance stores them.
+func (e *cacheV2Engine) serveManifest(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+	hash := strings.TrimPrefix(r.URL.Path, e.config.ManifestPrefix+"/")
+	data, ok := e.manifests.get(r.Context(), hash)
+	if !ok {
+		w.Header().Set("Cache-Control", "no-store")
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "application/json")
+	hdr.Set("Cache-Control", "public, max-age=31536000, immutable")
+	hdr.Set("Etag", `"`+hash+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	return nil
+}
+
+// manifestSets holds the manifest sets of the named stores, so that
+// the manifests which pages reference survive config reloads.
+var manifestSets = caddy.NewUsagePool()
+
+// manifestSet holds the manifests which were too large for the header
+// by hash. It is bounded in size and forgets the least recently used
+// manifests. If it has a storage, the manifests are stored there as
+// well, so that they are found again after they were forgotten, and by
+// the other instances of a cluster that use the same storage. They are
+// written in the background, so that slow storage does not delay pages,
+// and stored manifests which no instance used for manifestTTL are
+// deleted.
+type manifestSet struct {
+	mu    sync.Mutex
+	max   int
+	items map[string]*list.Element
+	lru   *list.List // of *storedManifest, most recently used first
+
+	storage certmagic.Storage
+	prefix  string
+	logger  *zap.Logger
+
+	writes chan *storedManifest // to be written to storage
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type storedManifest struct {
+	hash string
+	data []byte
+
+	// when the manifest was last written to storage, and whether it is
+	// queued to be written again
+	stored time.Time
+	queued bool
+}
+
+func newManifestSet(max int) *manifestSet {
+	return &manifestSet{
+		max:   max,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// loadManifestSet returns the manifest set of the named store, creating
+// it if no handler uses it yet. It must be released with
+// manifestSets.Delete(name) when it is no longer needed.
+func loadManifestSet(storage certmagic.Storage, name string, logger *zap.Logger) (*manifestSet, error) {
+	val, _, err := manifestSets.LoadOrNew(name, func() (caddy.Destructor, error) {
+		s := newManifestSet(maxStoredManifests)
+		s.storage = storage
+		s.prefix = path.Join("cachev2", certmagic.StorageKeys.Safe(name), "manifests")
+		s.logger = logger
+		if storage != nil {
+			var ctx context.Context
+			ctx, s.cancel = context.WithCancel(context.Background())
+			s.writes = make(chan *storedManifest, maxQueuedManifests)
+			s.done = make(chan struct{})
+			go s.sync(ctx)
+		}
+		return s, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*manifestSet), nil
+}
+
+// Destruct implements caddy.Destructor. It stops writing manifests to
+// storage once the queued ones are written.
+func (s *manifestSet) Destruct() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	return nil
+}
+
+// add adds the manifest data with the hash, and queues it to be stored
+// if it is new, or if it was stored long enough ago that it could be
+// pruned soon although it is still in use.
+func (s *manifestSet) add(hash string, data []byte) {
+	m, store := s.remember(hash, data, false)
+	if !store || s.writes == nil {
+		return
+	}
+	select {
+	case s.writes <- m:
+	default:
+		s.mu.Lock()
+		m.queued = false
+		s.mu.Unlock()
+		s.logger.Warn("too many cachev2 manifests to store; keeping the manifest in memory only",
+			zap.String("hash", hash))
+	}
+}
+
+// remember adds the manifest data with the hash to memory. It returns the
+// manifest, and true if it should be written to storage, in which case it
+// is marked as queued. Manifests loaded from storage are not written
+// until they are added.
+func (s *manifestSet) remember(hash string, data []byte, loaded bool) (*storedManifest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[hash]; ok {
+		s.lru.MoveToFront(elem)
+		m := elem.Value.(*storedManifest)
+		if m.queued || time.Since(m.stored) < manifestTTL/2 {
+			return m, false
+		}
+		m.queued = true
+		return m, true
+	}
+	m := &storedManifest{hash: hash, data: data, queued: !loaded}
+	s.items[hash] = s.lru.PushFront(m)
+	for s.lru.Len() > s.max {
+		oldest := s.lru.Remove(s.lru.Back()).(*storedManifest)
+		delete(s.items, oldest.hash)
+	}
+	return m, !loaded
+}
+
+// sync writes the queued manifests to storage, and prunes the stored
+// manifests every manifestPruneInterval, until ctx is canceled. The
+// manifests queued by then are still written, within snapshotTimeout.
+func (s *manifestSet) sync(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(manifestPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-s.writes:
+			s.store(ctx, m)
+		case <-ticker.C:
+			s.prune(ctx)
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+			defer cancel()
+			for {
+				select {
+				case m := <-s.writes:
+					s.store(ctx, m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// store writes the manifest m to storage.
+func (s *manifestSet) store(ctx context.Context, m *storedManifest) {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	err := s.storage.Store(ctx, s.key(m.hash), m.data)
+	s.mu.Lock()
+	m.queued = false
+	if err == nil {
+		m.stored = time.Now()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.logger.Warn("storing cachev2 manifest", zap.String("hash", m.hash), zap.Error(err))
+	}
+}
+
+// prune deletes the stored manifests which were not written for
+// manifestTTL. Manifests in use are written again before that, by
+// the instances which use them.
+func (s *manifestSet) prune(ctx context.Context) {
+	keys, err := s.storage.List(ctx, s.prefix, false)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("listing cachev2 manifests", zap.Error(err))
+		}
+		return
+	}
+	for _, key := range keys {
+		info, err := s.storage.Stat(ctx, key)
+		if err != nil || time.Since(info.Modified) < manifestTTL {
+			continue
+		}
+		if err := s.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("deleting cachev2 manifest", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// get returns the manifest with the hash, loading it from storage if
+// it is not in memory.
+func (s *manifestSet) get(ctx context.Context, hash string) ([]byte, bool) {
+	s.mu.Lock()
+	elem, ok := s.items[hash]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if ok {
+		return elem.Value.(*storedManifest).data, true
+	}
+
+	if s.storage == nil || !validManifestHash(hash) {
+		return nil, false
+	}
+	data, err := s.storage.Load(ctx, s.key(hash))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("loading cachev2 manifest", zap.String("hash", hash), zap.Error(err))
+		}
+		return nil, false
+	}
+	if manifestHash(data) != hash {
+		return nil, false
+	}
+	s.remember(hash, data, true)
+	return data, true
+}
+
+// key returns the storage key of the manifest with the hash.
+func (s *manifestSet) key(hash string) string {
+	return path.Join(s.prefix, hash+".json")
+}
+
+// manifestHash returns the hash by which the manifest data is addressed.
+func manifestHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// validManifestHash returns true if hash may be the hash of a manifest.
+func validManifestHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == 16 && hex.EncodeToString(b) == hash
+}
+
+// maxStoredManifests is the number of manifests a manifestSet holds.
+const maxStoredManifests = 1000
+
+// maxQueuedManifests is the number of manifests a manifestSet queues to
+// be written to storage.
+const maxQueuedManifests = 256
+
+// manifestTTL is how long stored manifests are kept after they were
+// last written, and manifestPruneInterval how often they are pruned.
+const (
+	manifestTTL           = 24 * time.Hour
+	manifestPruneInterval = time.Hour
+)
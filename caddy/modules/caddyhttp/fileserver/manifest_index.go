@@ -0,0 +1,128 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+)
+
+// manifestIndexVersion is the version of the format of manifest indexes.
+const manifestIndexVersion = 1
+
+// manifestIndex holds the dependencies of the pages of a site, which the
+// `caddy cachev2` command computed ahead of time. With it, the manifests
+// of streamed pages are known before the pages are first served, and the
+// proxy accepts the cross-origin resources they reference right away.
+type manifestIndex struct {
+	Version int                     `json:"version"`
+	Pages   map[string]*indexedPage `json:"pages"` // by request path
+}
+
+// indexedPage holds the dependencies of a page in a manifest index.
+type indexedPage struct {
+	// the etag of the HTML file, as the file server computes it; the
+	// entry only applies to the file as long as it is the same
+	Etag   string              `json:"etag"`
+	Local  []indexedDependency `json:"local,omitempty"`
+	Remote []string            `json:"remote,omitempty"`
+}
+
+// indexedDependency is a localDependency whose URL is relative to the
+// origin of the page, since the host the site is served at may differ.
+type indexedDependency struct {
+	URL     string `json:"url"`
+	Target  string `json:"target"`
+	Crawled bool   `json:"crawled,omitempty"`
+	Etag    string `json:"etag,omitempty"`
+}
+
+// loadManifestIndex reads the manifest index in the file filename.
+func loadManifestIndex(filename string) (*manifestIndex, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	idx := new(manifestIndex)
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("decoding manifest index %s: %v", filename, err)
+	}
+	if idx.Version != manifestIndexVersion {
+		return nil, fmt.Errorf("manifest index %s has version %d, expected %d; build it again",
+			filename, idx.Version, manifestIndexVersion)
+	}
+	return idx, nil
+}
+
+// add adds the page at the request path target, whose HTML file has the
+// etag, with the dependencies it has at origin. Index files also add the
+// path of their directory.
+func (idx *manifestIndex) add(target, etag string, origin *url.URL, deps *pageDependencies) {
+	page := &indexedPage{Etag: etag, Remote: deps.remote}
+	for _, dep := range deps.local {
+		u, err := url.Parse(dep.url)
+		if err != nil {
+			continue
+		}
+		rel := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+		page.Local = append(page.Local, indexedDependency{
+			URL:     rel.String(),
+			Target:  dep.target,
+			Crawled: dep.crawled,
+			Etag:    dep.etag,
+		})
+	}
+	if idx.Pages == nil {
+		idx.Pages = make(map[string]*indexedPage)
+	}
+	idx.Pages[target] = page
+	if name := path.Base(target); name == "index.html" || name == "index.htm" {
+		dir := path.Dir(target)
+		if dir != "/" {
+			dir += "/"
+		}
+		if _, ok := idx.Pages[dir]; !ok {
+			idx.Pages[dir] = page
+		}
+	}
+}
+
+// dependencies returns the dependencies of the page at origin, if the
+// index has them for the version of the page with the source etag.
+func (idx *manifestIndex) dependencies(origin *url.URL, sourceEtag string) *pageDependencies {
+	if idx == nil || sourceEtag == "" {
+		return nil
+	}
+	page, ok := idx.Pages[origin.Path]
+	if !ok || page.Etag != sourceEtag {
+		return nil
+	}
+	deps := &pageDependencies{remote: page.Remote}
+	for _, dep := range page.Local {
+		u, err := resolveURL(origin, dep.URL)
+		if err != nil {
+			continue
+		}
+		deps.local = append(deps.local, localDependency{
+			url:     u.String(),
+			target:  dep.Target,
+			crawled: dep.Crawled,
+			etag:    dep.Etag,
+		})
+	}
+	return deps
+}
+
+// remoteURLs returns the cross-origin resources which the pages in the
+// index reference.
+func (idx *manifestIndex) remoteURLs() []string {
+	if idx == nil {
+		return nil
+	}
+	var urls []string
+	for _, page := range idx.Pages {
+		urls = append(urls, page.Remote...)
+	}
+	return urls
+}
@@ -0,0 +1,156 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestAnalyzeSite(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":      `<html><head><link rel="stylesheet" href="style.css"><script src="https://cdn.example.com/lib.js"></script></head><body><img src="/gone.png"><a href="http://[::1">x</a><img src="http://[::1"></body></html>`,
+		"style.css":       `body { color: red }`,
+		"docs/page.htm":   `<img src="../style.css">`,
+		"docs/notes.txt":  `<img src="ignored.png">`,
+		"docs/empty.html": ``,
+	} {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolver := &FileResolver{Root: root, fileSystem: osFS{}}
+	e, err := newCacheV2Engine(CacheV2Config{}, resolver, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, _ := url.Parse("https://example.com")
+
+	reports, index, err := analyzeSite(e, root, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, report := range reports {
+		paths = append(paths, report.Path)
+	}
+	if expect := []string{"/docs/empty.html", "/docs/page.htm", "/index.html"}; !reflect.DeepEqual(paths, expect) {
+		t.Fatalf("expected pages %v, got %v", expect, paths)
+	}
+
+	report := reports[2]
+	byURL := make(map[string]resourceReport)
+	for _, res := range report.Resources {
+		byURL[res.URL] = res
+	}
+	if res := byURL["https://example.com/style.css"]; res.Etag == "" || res.Missing {
+		t.Errorf("expected the style sheet with its etag, got %+v", res)
+	}
+	if res := byURL["https://example.com/gone.png"]; !res.Missing {
+		t.Errorf("expected the image to be missing, got %+v", res)
+	}
+	if res := byURL["https://cdn.example.com/lib.js"]; !res.CrossOrigin {
+		t.Errorf("expected the script to be cross-origin, got %+v", res)
+	}
+	if !reflect.DeepEqual(report.Broken, []string{"http://[::1"}) {
+		t.Errorf("expected the broken reference, got %v", report.Broken)
+	}
+	if report.HeaderBytes == 0 || report.ManifestBytes == 0 || report.ByReference {
+		t.Errorf("expected an inline manifest header, got %+v", report)
+	}
+
+	out := new(bytes.Buffer)
+	if err := printSiteReport(out, reports); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "3 pages, 4 resources, 1 missing, 1 broken") {
+		t.Errorf("unexpected summary:\n%s", out)
+	}
+
+	// the index round-trips, and applies at any origin as long
+	// as the page does not change
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "index.json")
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadManifestIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := url.Parse("http://localhost:8080/")
+	deps := loaded.dependencies(other, report.Etag)
+	if deps == nil {
+		t.Fatal("expected the directory to have the dependencies of its index file")
+	}
+	if len(deps.local) != 2 || deps.local[0].url != "http://localhost:8080/style.css" || deps.local[0].target != "/style.css" {
+		t.Errorf("unexpected local dependencies %+v", deps.local)
+	}
+	if !reflect.DeepEqual(deps.remote, []string{"https://cdn.example.com/lib.js"}) {
+		t.Errorf("unexpected remote dependencies %v", deps.remote)
+	}
+	if loaded.dependencies(other, `"changed"`) != nil {
+		t.Error("expected no dependencies for a changed page")
+	}
+
+	if err := os.WriteFile(filename, []byte(`{"version": 0}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadManifestIndex(filename); err == nil {
+		t.Error("expected an error for an index of another version")
+	}
+}
+
+func TestCacheV2StreamsIndexedPages(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "logo.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	origin, _ := url.Parse("http://example.com")
+	index := &manifestIndex{Version: manifestIndexVersion}
+	index.add("/page.html", `"page"`, origin, &pageDependencies{
+		local: []localDependency{{url: "http://example.com/logo.png", target: "/logo.png"}},
+	})
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "index.json")
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newCacheV2Engine(CacheV2Config{ManifestIndex: filename}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the manifest of the page is sent in the headers the first time
+	req := withTestReplacer(httptest.NewRequest(http.MethodGet, "http://example.com/page.html", nil))
+	rr := httptest.NewRecorder()
+	if err := e.rewriteStream(rr, req, `"page"`, strings.NewReader(`<html><body><img src="/logo.png"></body></html>`)); err != nil {
+		t.Fatal(err)
+	}
+	resp := rr.Result()
+	if !strings.Contains(resp.Header.Get("X-Etag-Config"), "logo.png") {
+		t.Errorf("expected the manifest in the headers, got %v", resp.Header)
+	}
+	if resp.Header.Get("Etag") == "" {
+		t.Error("expected the page to have an etag")
+	}
+}
@@ -0,0 +1,384 @@
+package fileserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestEncodeManifest(t *testing.T) {
+	origin, err := url.Parse("http://example.com/blog/post.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := encodeManifest(map[string]string{
+		"http://example.com/css/site.css":      `"a"`,
+		"http://example.com/css/theme.css":     `"b"`,
+		"http://example.com/app.js?v=1/2":      `"c"`,
+		"https://cdn.example.com/lib/x.js":     `"d"`,
+		"http://example.com.evil/css/site.css": `"e"`,
+	}, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual map[string]map[string]string
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("invalid manifest %s: %v", data, err)
+	}
+	expect := map[string]map[string]string{
+		"/css/":                        {"site.css": `"a"`, "theme.css": `"b"`},
+		"/":                            {"app.js?v=1/2": `"c"`},
+		"https://cdn.example.com/lib/": {"x.js": `"d"`},
+		"http://example.com.evil/css/": {"site.css": `"e"`},
+	}
+	if len(actual) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, actual)
+	}
+	for prefix, group := range expect {
+		for name, token := range group {
+			if actual[prefix][name] != token {
+				t.Errorf("expected %s%s to be %s, got %v", prefix, name, token, actual)
+			}
+		}
+	}
+}
+
+func TestManifestHeader(t *testing.T) {
+	origin, err := url.Parse("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		m["http://example.com/js/"+name+".js"] = `"0123456789"`
+	}
+	data, err := encodeManifest(m, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compressed when that is shorter
+	e, err := newCacheV2Engine(CacheV2Config{CompressManifest: true}, nil, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := e.manifestHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, ok := strings.CutPrefix(value, "gz:")
+	if !ok {
+		t.Fatalf("expected compressed manifest, got %q", value)
+	}
+	raw, err := base64.StdEncoding.DecodeString(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Errorf("expected %s, got %s", data, decompressed)
+	}
+
+	// too large for the header
+	e, err = newCacheV2Engine(CacheV2Config{ManifestMaxSize: 64}, nil, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = e.manifestHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, ok := strings.CutPrefix(value, "ref:")
+	if !ok || !strings.HasPrefix(ref, "/cachev2-manifest/") {
+		t.Fatalf("expected manifest reference, got %q", value)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, ref, nil)
+	if !e.isManifestRequest(req) {
+		t.Fatalf("expected %s to be a manifest request", ref)
+	}
+	rr := httptest.NewRecorder()
+	if err := e.serveManifest(rr, req); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("expected manifest %s, got %d %s", data, rr.Code, rr.Body.String())
+	}
+	if cc := rr.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("expected immutable manifest, got Cache-Control %q", cc)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, ref, nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("Etag"))
+	rr = httptest.NewRecorder()
+	if err := e.serveManifest(rr, req); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected %d for conditional request, got %d", http.StatusNotModified, rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/cachev2-manifest/unknown", nil)
+	rr = httptest.NewRecorder()
+	err = e.serveManifest(rr, req)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d for unknown manifest, got %v", http.StatusNotFound, err)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("expected unknown manifest not to be cached, got Cache-Control %q", cc)
+	}
+}
+
+func TestManifestSetShared(t *testing.T) {
+	data := []byte(`{"/":{"a.css":"\"a\""}}`)
+	hash := manifestHash(data)
+
+	// a reload provisions the new handlers before the old ones are
+	// cleaned up, so they share the set
+	old, err := loadManifestSet(nil, "reload", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.add(hash, data)
+	reloaded, err := loadManifestSet(nil, "reload", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = manifestSets.Delete("reload")
+	if _, ok := reloaded.get(context.Background(), hash); !ok {
+		t.Error("expected the manifest to survive the reload")
+	}
+	_, _ = manifestSets.Delete("reload")
+
+	// another instance with the same storage finds the manifest there
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	first, err := loadManifestSet(storage, "cluster", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.add(hash, data)
+	_, _ = manifestSets.Delete("cluster")
+	second, err := loadManifestSet(storage, "cluster", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestSets.Delete("cluster")
+	if second == first {
+		t.Fatal("expected a new manifest set")
+	}
+	e, err := newCacheV2Engine(CacheV2Config{}, nil, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.manifests = second
+	rr := httptest.NewRecorder()
+	if err := e.serveManifest(rr, httptest.NewRequest(http.MethodGet, "/cachev2-manifest/"+hash, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("expected the manifest from storage, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// only keys of valid hashes are loaded
+	if _, ok := second.get(context.Background(), "../../etags"); ok {
+		t.Error("expected an invalid hash to be rejected")
+	}
+}
+
+// blockingStorage blocks storing until it is released.
+type blockingStorage struct {
+	certmagic.Storage
+	release chan struct{}
+}
+
+func (s *blockingStorage) Store(ctx context.Context, key string, value []byte) error {
+	<-s.release
+	return s.Storage.Store(ctx, key, value)
+}
+
+func TestManifestSetStoresInBackground(t *testing.T) {
+	files := &certmagic.FileStorage{Path: t.TempDir()}
+	storage := &blockingStorage{Storage: files, release: make(chan struct{})}
+	set, err := loadManifestSet(storage, "background", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestSets.Delete("background")
+
+	// slow storage does not hold up the pages
+	data := []byte(`{"/":{"a.css":"\"a\""}}`)
+	hash := manifestHash(data)
+	added := make(chan struct{})
+	go func() {
+		set.add(hash, data)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("expected the manifest to be added without waiting for the storage")
+	}
+	close(storage.release)
+	eventually(t, "the manifest is stored", func() bool {
+		return files.Exists(context.Background(), set.key(hash))
+	})
+
+	// manifests which were not written for their TTL are pruned
+	old := []byte(`{"/":{"b.css":"\"b\""}}`)
+	oldHash := manifestHash(old)
+	if err := files.Store(context.Background(), set.key(oldHash), old); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-manifestTTL - time.Minute)
+	if err := os.Chtimes(files.Filename(set.key(oldHash)), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	set.prune(context.Background())
+	if files.Exists(context.Background(), set.key(oldHash)) {
+		t.Error("expected the expired manifest to be pruned")
+	}
+	if !files.Exists(context.Background(), set.key(hash)) {
+		t.Error("expected the recent manifest to be kept")
+	}
+}
+
+func TestManifestDelivery(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "site.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	page := `<html><head><link rel="stylesheet" href="/site.css"></head><body><p>hi</p></body></html>`
+	// the page is produced only after the client got the hints, if any
+	hinted := make(chan struct{}, 1)
+	var hintedFirst bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		select {
+		case <-hinted:
+			hintedFirst = true
+		case <-time.After(100 * time.Millisecond):
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, err := w.Write([]byte(page))
+		return err
+	})
+
+	serve := func(requests int, delivery ...string) (*http.Response, string, http.Header) {
+		engine, err := newCacheV2Engine(CacheV2Config{ManifestDelivery: delivery}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &CacheV2{engine: engine}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repl := caddyhttp.NewTestReplacer(r)
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			if err := c.ServeHTTP(w, r, next); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}))
+		defer srv.Close()
+
+		// the page is known to the engine after the first request
+		var resp *http.Response
+		var body []byte
+		var hints http.Header
+		for i := 0; i < requests; i++ {
+			hints = nil
+			hintedFirst = false
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					if code == http.StatusEarlyHints {
+						hints = http.Header(header)
+						select {
+						case hinted <- struct{}{}:
+						default:
+						}
+					}
+					return nil
+				},
+			}
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, string(body), hints
+	}
+
+	resp, body, hints := serve(2)
+	if resp.Header.Get("X-Etag-Config") == "" || hints != nil || strings.Contains(body, inlineManifestID) {
+		t.Errorf("expected the manifest in the header only, got header %q, hints %v and body %s", resp.Header.Get("X-Etag-Config"), hints, body)
+	}
+
+	resp, body, _ = serve(1, deliverInline)
+	if resp.Header.Get("X-Etag-Config") != "" {
+		t.Errorf("expected no manifest header, got %q", resp.Header.Get("X-Etag-Config"))
+	}
+	if !strings.Contains(body, `<script type="application/json" id="cachev2-manifest">{"/":{"site.css":`) ||
+		!strings.Contains(body, "postMessage") {
+		t.Errorf("expected inline manifest handed to the service worker, got body %s", body)
+	}
+
+	resp, body, hints = serve(1, deliverEarlyHints, deliverURL)
+	ref, ok := manifestURL(resp.Header.Get("X-Etag-Config"))
+	if !ok {
+		t.Fatalf("expected manifest reference, got %q", resp.Header.Get("X-Etag-Config"))
+	}
+	if !strings.Contains(body, `"ref:`+ref+`"`) {
+		t.Errorf("expected page to reference the manifest %s, got body %s", ref, body)
+	}
+	if hints != nil {
+		t.Errorf("expected no Early Hints for a page which was not seen yet, got %v", hints)
+	}
+
+	// early hints preload the known resources of the page before it is
+	// produced, and do not carry the manifest
+	resp, _, hints = serve(2, deliverEarlyHints)
+	if resp.Header.Get("X-Etag-Config") == "" {
+		t.Error("expected early hints alone to deliver the manifest in the header")
+	}
+	if !hintedFirst || hints.Get("Link") != "</site.css>; rel=preload; as=style" {
+		t.Errorf("expected Early Hints preloading the style sheet before the page, got %v", hints)
+	}
+	if hints.Get("X-Etag-Config") != "" || hints.Get("Content-Type") != "" {
+		t.Errorf("expected no other header fields to be sent early, got %v", hints)
+	}
+}
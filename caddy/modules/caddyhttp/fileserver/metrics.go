@@ -0,0 +1,136 @@
+package fileserver
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+var cacheV2Metrics = struct {
+	init                 sync.Once
+	rewrites             *prometheus.CounterVec
+	manifestEntries      prometheus.Histogram
+	manifestHeaderSize   prometheus.Histogram
+	refreshes            *prometheus.CounterVec
+	tokenChanges         *prometheus.CounterVec
+	proxyRequests        *prometheus.CounterVec
+	proxyRequestDuration *prometheus.HistogramVec
+}{}
+
+func initCacheV2Metrics() {
+	const ns, sub = "caddy", "cachev2"
+
+	cacheV2Metrics.rewrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "rewrites_total",
+		Help:      "Number of HTML pages rewritten, by mode (buffered or streamed) and result (ok or failed).",
+	}, []string{"mode", "result"})
+	cacheV2Metrics.manifestEntries = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "manifest_entries",
+		Help:      "Histogram of the number of resources in the manifests sent with pages.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	cacheV2Metrics.manifestHeaderSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "manifest_header_bytes",
+		Help:      "Histogram of the size of the manifest headers sent with pages.",
+		Buckets:   prometheus.ExponentialBuckets(256, 2, 8),
+	})
+	cacheV2Metrics.refreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "token_refreshes_total",
+		Help:      "Number of cross-origin token refreshes, by the status code of the origin or \"error\".",
+	}, []string{"store", "code"})
+	cacheV2Metrics.tokenChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "token_changes_total",
+		Help:      "Number of changed cross-origin tokens, by where the new token came from (origin, refresh or api).",
+	}, []string{"store", "source"})
+
+	proxyLabels := []string{"host", "code"}
+	cacheV2Metrics.proxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "proxy_requests_total",
+		Help:      "Number of requests to the resource proxy, by the allowed host pattern of the upstream (or \"other\") and status code.",
+	}, proxyLabels)
+	cacheV2Metrics.proxyRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "proxy_request_duration_seconds",
+		Help:      "Histogram of the durations of requests to the resource proxy, including cache hits.",
+		Buckets:   prometheus.DefBuckets,
+	}, proxyLabels)
+
+	prometheus.MustRegister(storeCollector{
+		tokens: prometheus.NewDesc(prometheus.BuildFQName(ns, sub, "store_tokens"),
+			"Number of cross-origin tokens in the store.", []string{"store"}, nil),
+	})
+}
+
+// storeCollector reports the sizes of the token stores in use when
+// metrics are gathered, since stores come and go with configs.
+type storeCollector struct {
+	tokens *prometheus.Desc
+}
+
+func (c storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.tokens
+}
+
+func (c storeCollector) Collect(ch chan<- prometheus.Metric) {
+	etagStores.Range(func(key, val any) bool {
+		name, ok := key.(string)
+		s, ok2 := val.(*persistedEtagStore)
+		if ok && ok2 {
+			ch <- prometheus.MustNewConstMetric(c.tokens, prometheus.GaugeValue, float64(s.Len()), name)
+		}
+		return true
+	})
+}
+
+// observeRewrite counts a page rewritten in the given mode.
+func observeRewrite(mode string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	cacheV2Metrics.rewrites.WithLabelValues(mode, result).Inc()
+}
+
+// observeManifest records the size of a manifest sent with a page.
+func observeManifest(tokens map[string]string, header string) {
+	cacheV2Metrics.manifestEntries.Observe(float64(len(tokens)))
+	if header != "" {
+		cacheV2Metrics.manifestHeaderSize.Observe(float64(len(header)))
+	}
+}
+
+// observeProxyRequest records a request to the resource proxy for a
+// resource on a host with the given label, which was answered with the response status, or
+// failed with err.
+func observeProxyRequest(host string, status int, err error, start time.Time) {
+	if err != nil {
+		status = http.StatusInternalServerError
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+			status = handlerErr.StatusCode
+		}
+	}
+	code := strconv.Itoa(status)
+	cacheV2Metrics.proxyRequests.WithLabelValues(host, code).Inc()
+	cacheV2Metrics.proxyRequestDuration.WithLabelValues(host, code).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,94 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// gatheredValue returns the value of the gauge or the sample count of
+// the histogram name with the given store label, if it was gathered.
+func gatheredValue(t *testing.T, name, store string) (float64, bool) {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			matches := store == ""
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "store" && label.GetValue() == store {
+					matches = true
+				}
+			}
+			if !matches {
+				continue
+			}
+			if h := m.GetHistogram(); h != nil {
+				return float64(h.GetSampleCount()), true
+			}
+			return m.GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestCacheV2Metrics(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "logo.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrites := cacheV2Metrics.rewrites.WithLabelValues("buffered", "ok")
+	before := testutil.ToFloat64(rewrites)
+	manifests, _ := gatheredValue(t, "caddy_cachev2_manifest_entries", "")
+	req := withTestReplacer(httptest.NewRequest(http.MethodGet, "/", nil))
+	page := []byte(`<html><head></head><body><img src="/logo.png"></body></html>`)
+	if _, _, err := e.rewrite(httptest.NewRecorder(), req, `"a"`, func() ([]byte, error) { return page, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if after := testutil.ToFloat64(rewrites); after != before+1 {
+		t.Errorf("expected the rewrite to be counted, got %v after %v", after, before)
+	}
+	if after, _ := gatheredValue(t, "caddy_cachev2_manifest_entries", ""); after != manifests+1 {
+		t.Errorf("expected the manifest to be observed, got %v after %v", after, manifests)
+	}
+
+	// refreshes that find a new token count as changes
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v2"`)
+	}))
+	defer origin.Close()
+	cfg := CacheV2Config{StoreName: "metrics-test", DisablePersistence: true}
+	cfg.provision()
+	store, err := loadEtagStore(nil, cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer etagStores.Delete(cfg.StoreName)
+	store.Set(origin.URL+"/a.js", `"v1"`)
+	store.revalidate(origin.URL + "/a.js")
+	if n := testutil.ToFloat64(cacheV2Metrics.refreshes.WithLabelValues("metrics-test", "200")); n != 1 {
+		t.Errorf("expected one successful refresh, got %v", n)
+	}
+	if n := testutil.ToFloat64(cacheV2Metrics.tokenChanges.WithLabelValues("metrics-test", "refresh")); n != 1 {
+		t.Errorf("expected one changed token, got %v", n)
+	}
+	if n, ok := gatheredValue(t, "caddy_cachev2_store_tokens", "metrics-test"); !ok || n != 1 {
+		t.Errorf("expected the size of the store, got %v", n)
+	}
+}
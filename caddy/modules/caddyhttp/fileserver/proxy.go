@@ -0,0 +1,556 @@
+package fileserver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// resourceProxy fetches cross-origin sub-resources on behalf of the
+// CacheV2 service worker and records their validation tokens in the
+// ETag store, so that later pages can announce them to clients.
+//
+// Since the URLs come from clients, the proxy only fetches resources
+// that pages of the site referenced (unless referenced is nil), from
+// hosts the guard allows, and never connects to private addresses.
+type resourceProxy struct {
+	store      *EtagStore
+	guard      *proxyGuard
+	referenced *urlSet
+	client     *http.Client
+	cache      *proxyCache // nil if responses are not cached
+	maxSize    int64
+	timeout    time.Duration
+	events     *eventEmitter // nil if no events are emitted
+	logger     *zap.Logger
+}
+
+// newResourceProxy returns a proxy which records tokens in store and
+// fetches resources with transport according to the proxy settings in
+// config. The transport must have been guarded with newProxyTransport;
+// if it is nil, a guarded default transport is used.
+func newResourceProxy(config CacheV2Config, store *EtagStore, transport http.RoundTripper, logger *zap.Logger) (*resourceProxy, error) {
+	cacheV2Metrics.init.Do(initCacheV2Metrics)
+	guard, err := newProxyGuard(config)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = guard.transport(http.DefaultTransport.(*http.Transport))
+	}
+
+	p := &resourceProxy{
+		store:   store,
+		guard:   guard,
+		maxSize: config.ProxyMaxSize,
+		timeout: time.Duration(config.ProxyTimeout),
+		logger:  logger,
+	}
+	p.client = &http.Client{
+		Transport:     transport,
+		CheckRedirect: p.checkRedirect,
+	}
+	if !config.ProxyAnyURL {
+		p.referenced = newURLSet(maxReferencedURLs)
+	}
+	return p, nil
+}
+
+// newProxyTransport makes ht only connect to the addresses that the
+// proxy settings in config allow, and returns a round tripper which
+// sends requests through it, so that all of its options apply. The h2c
+// version is not supported, since its connections cannot be guarded.
+func newProxyTransport(config CacheV2Config, ht *reverseproxy.HTTPTransport) (http.RoundTripper, error) {
+	guard, err := newProxyGuard(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range ht.Versions {
+		if v == "h2c" {
+			return nil, fmt.Errorf("the h2c version of the transport is not supported by the proxy")
+		}
+	}
+	ht.Transport = guard.transport(ht.Transport)
+	return caddyTransport{ht}, nil
+}
+
+// caddyTransport sends requests through the RoundTrip method of an HTTP
+// transport of reverse_proxy, which needs a replacer in the context of
+// every request, even if it is made outside of an HTTP handler.
+type caddyTransport struct {
+	ht *reverseproxy.HTTPTransport
+}
+
+func (t caddyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); !ok {
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	}
+	return t.ht.RoundTrip(req)
+}
+
+// checkRedirect applies the host rules to every redirect the proxy follows.
+func (p *resourceProxy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 5 {
+		return errors.New("stopped after 5 redirects")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported scheme: %s", req.URL.Scheme)
+	}
+	if !p.guard.allowedHost(req.URL.Hostname()) {
+		return fmt.Errorf("redirect to forbidden host: %s", req.URL.Hostname())
+	}
+	return nil
+}
+
+func (p *resourceProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (err error) {
+	targetURLStr := r.URL.Query().Get("url")
+	if targetURLStr == "" {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing 'url' query parameter"))
+	}
+
+	// Basic URL validation
+	targetURL, err := url.Parse(targetURLStr)
+	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+		p.logger.Warn("Invalid proxy target URL", zap.String("url", targetURLStr), zap.Error(err))
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid 'url' query parameter: %s", targetURLStr))
+	}
+	targetURL.Fragment = ""
+	targetURL.RawFragment = ""
+	targetURLStr = normalizeURL(targetURL).String()
+
+	if p.referenced != nil && !p.referenced.has(targetURLStr) && !p.store.has(targetURLStr) {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("proxy target was not referenced by any page: %s", targetURLStr))
+	}
+	if !p.guard.allowedHost(targetURL.Hostname()) {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("proxy target host is not allowed: %s", targetURL.Hostname()))
+	}
+
+	p.logger.Debug("Proxying request for service worker", zap.String("target_url", targetURLStr))
+	start := time.Now()
+	var status int
+	defer func() { observeProxyRequest(p.guard.hostLabel(targetURL.Hostname()), status, err, start) }()
+
+	// Copy essential headers (consider adding more if needed, like Accept-Language)
+	// Cookies and authorization of the original request are never sent to the third party
+	proxyHdr := make(http.Header)
+	if userAgent := r.UserAgent(); userAgent != "" {
+		proxyHdr.Set("User-Agent", userAgent)
+	}
+	if accept := r.Header.Get("Accept"); accept != "" {
+		proxyHdr.Set("Accept", accept)
+	}
+
+	var resp *cachedResponse
+	var cacheStatus string
+	if p.cache != nil {
+		resp, cacheStatus, err = p.fetchCached(r, targetURLStr, proxyHdr)
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+		defer cancel()
+		resp, err = p.fetch(ctx, targetURLStr, proxyHdr, nil)
+	}
+	if err != nil {
+		p.logger.Error("Failed to fetch resource via proxy", zap.String("target_url", targetURLStr), zap.Error(err))
+		handlerErr := fetchError(err)
+		p.events.emit(eventProxyFailed, map[string]any{
+			"url":    targetURLStr,
+			"host":   targetURL.Hostname(),
+			"status": handlerErr.StatusCode,
+			"error":  err.Error(),
+		})
+		return handlerErr
+	}
+
+	p.logger.Debug("Received response from proxy target",
+		zap.String("target_url", targetURLStr),
+		zap.Int("status_code", resp.Status),
+		zap.String("content_type", resp.Header.Get("Content-Type")),
+		zap.String("cache_status", cacheStatus))
+
+	// the header of a cached response is shared with concurrent requests,
+	// so its values are copied before anything downstream can append to them
+	hdr := w.Header()
+	for k, vv := range resp.Header {
+		hdr[k] = slices.Clone(vv)
+	}
+	hdr.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	// the response is served from the site's origin, so it must not be
+	// sniffed, nor rendered as a document if it is not a sub-resource
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	if !subresourceType(resp.Header.Get("Content-Type")) {
+		hdr.Set("Content-Security-Policy", "sandbox")
+		hdr.Set("Content-Disposition", "attachment")
+	}
+	if cacheStatus != "" {
+		hdr.Set("Age", strconv.FormatInt(int64(resp.age(time.Now())/time.Second), 10))
+		hdr.Set("Cache-Status", "cachev2; "+cacheStatus)
+	}
+	status = resp.Status
+	w.WriteHeader(resp.Status)
+	if _, err := w.Write(resp.Body); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("error writing response body: %w", err))
+	}
+
+	p.logger.Info("Successfully proxied request",
+		zap.String("target_url", targetURLStr),
+		zap.Int("status_code", resp.Status),
+		zap.Int("bytes_copied", len(resp.Body)))
+
+	return nil
+}
+
+// fetchError returns the error with which a proxy request that failed to
+// fetch its resource with err is answered.
+func fetchError(err error) caddyhttp.HandlerError {
+	var addrErr forbiddenAddrError
+	if errors.As(err, &addrErr) {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+	var sizeErr tooLargeError
+	if errors.As(err, &sizeErr) {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return caddyhttp.Error(http.StatusGatewayTimeout, fmt.Errorf("proxy request timed out: %w", err))
+	}
+	return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("proxy request failed: %w", err))
+}
+
+// subresourceType returns true if responses with the given Content-Type
+// are sub-resources which browsers do not run as documents when they are
+// navigated to: style sheets, scripts, fonts, media other than SVG
+// images, JSON and WebAssembly.
+func subresourceType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "text/css", "text/javascript", "application/javascript", "application/x-javascript",
+		"application/ecmascript", "text/ecmascript", "application/json", "application/wasm":
+		return true
+	case "image/svg+xml":
+		return false
+	}
+	kind, _, _ := strings.Cut(mediaType, "/")
+	switch kind {
+	case "image", "font", "audio", "video":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "application/font-")
+}
+
+// proxyResponseHeader returns the header fields of a proxied response
+// that are passed on to clients and cached, i.e. without hop-by-hop
+// fields, cookies and fields managed by Caddy.
+func proxyResponseHeader(header http.Header) http.Header {
+	hdr := make(http.Header, len(header))
+	for k, vv := range header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Connection", "Proxy-Authenticate", "Proxy-Authorization", "Transfer-Encoding",
+			"Keep-Alive", "Trailer", "Upgrade", "Content-Length",
+			"Set-Cookie", "Strict-Transport-Security", "Server":
+			continue
+		}
+		hdr[http.CanonicalHeaderKey(k)] = vv
+	}
+	return hdr
+}
+
+// proxyGuard decides which hosts the proxy may fetch from, and
+// which addresses it may connect to.
+type proxyGuard struct {
+	allowHosts  []string
+	denyHosts   []string
+	allowRanges []netip.Prefix
+}
+
+func newProxyGuard(config CacheV2Config) (*proxyGuard, error) {
+	g := &proxyGuard{
+		allowHosts: lowerAll(config.ProxyAllowHosts),
+		denyHosts:  lowerAll(config.ProxyDenyHosts),
+	}
+	for _, s := range config.ProxyAllowRanges {
+		prefix, err := parseIPRange(s)
+		if err != nil {
+			return nil, err
+		}
+		g.allowRanges = append(g.allowRanges, prefix)
+	}
+	return g, nil
+}
+
+// allowedHost returns true if the proxy may fetch from host,
+// i.e. it is not denied and, if there is an allowlist, allowed.
+func (g *proxyGuard) allowedHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+	for _, pattern := range g.denyHosts {
+		if matchHostPattern(pattern, host) {
+			return false
+		}
+	}
+	if len(g.allowHosts) == 0 {
+		return true
+	}
+	for _, pattern := range g.allowHosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostLabel returns the value of the host label of the proxy's metrics
+// for host: the pattern in the allowlist which host matches, or "other",
+// so that the number of label values is bounded by the configuration.
+func (g *proxyGuard) hostLabel(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range g.allowHosts {
+		if matchHostPattern(pattern, host) {
+			return pattern
+		}
+	}
+	return "other"
+}
+
+// allowedAddr returns true if the proxy may connect to ip: it must be
+// a public unicast address, or in one of the explicitly allowed ranges.
+func (g *proxyGuard) allowedAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range g.allowRanges {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicRanges {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialContext wraps dial so that it resolves the host itself and only
+// connects to allowed addresses. Dialing the checked IP instead of the
+// host name means a second DNS lookup cannot return a different address.
+func (g *proxyGuard) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			if !g.allowedAddr(ip) {
+				lastErr = forbiddenAddrError{host: host, ip: ip}
+				continue
+			}
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses for host %s", host)
+		}
+		return nil, lastErr
+	}
+}
+
+// transport returns a copy of base which only connects to allowed
+// addresses. Upstream proxies that base is configured with are still
+// used, since the operator set them up: connections to them are not
+// restricted, but the addresses of the target host are checked before
+// a request is handed to one. Note that the upstream proxy resolves
+// the host again, so it should apply the same rules.
+func (g *proxyGuard) transport(base *http.Transport) *http.Transport {
+	t := base.Clone()
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+
+	var upstreams sync.Map // of upstream proxy addresses
+	if proxy := t.Proxy; proxy != nil {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			proxyURL, err := proxy(req)
+			if proxyURL == nil || err != nil {
+				return proxyURL, err
+			}
+			if err := g.checkHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			upstreams.Store(proxyAddr(proxyURL), struct{}{})
+			return proxyURL, nil
+		}
+	}
+
+	guarded := g.dialContext(dial)
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := upstreams.Load(addr); ok {
+			return dial(ctx, network, addr)
+		}
+		return guarded(ctx, network, addr)
+	}
+	return t
+}
+
+// checkHost returns an error unless all addresses of host are allowed.
+func (g *proxyGuard) checkHost(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !g.allowedAddr(ip) {
+			return forbiddenAddrError{host: host, ip: ip}
+		}
+	}
+	return nil
+}
+
+// proxyAddr returns the address the transport dials to reach
+// the upstream proxy at u.
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// forbiddenAddrError is returned when the proxy refuses to connect
+// to the address a host resolved to.
+type forbiddenAddrError struct {
+	host string
+	ip   netip.Addr
+}
+
+func (e forbiddenAddrError) Error() string {
+	return fmt.Sprintf("host %s resolves to forbidden address %s", e.host, e.ip)
+}
+
+// nonPublicRanges are the special-purpose ranges the proxy does not
+// connect to, besides loopback, link-local, multicast and private
+// ranges, which net/netip knows.
+var nonPublicRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, may embed private IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4, may embed private IPv4 addresses
+	netip.MustParsePrefix("2001::/32"),      // Teredo
+	netip.MustParsePrefix("100::/64"),       // discard-only
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+}
+
+// matchHostPattern returns true if host matches pattern, which is either
+// a host name or a wildcard like `*.example.com` that matches subdomains.
+func matchHostPattern(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// parseIPRange parses s as a CIDR, or as a single IP address.
+func parseIPRange(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP range '%s': %v", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address '%s': %v", s, err)
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func lowerAll(ss []string) []string {
+	lowered := make([]string, len(ss))
+	for i, s := range ss {
+		lowered[i] = strings.TrimSuffix(strings.ToLower(s), ".")
+	}
+	return lowered
+}
+
+// urlSet is a set of URLs bounded in size,
+// which forgets the least recently added ones.
+type urlSet struct {
+	mu    sync.Mutex
+	max   int
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+func newURLSet(max int) *urlSet {
+	return &urlSet{max: max, items: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (s *urlSet) add(u string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[u]; ok {
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.items[u] = s.lru.PushFront(u)
+	if s.lru.Len() > s.max {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.items, oldest.Value.(string))
+	}
+}
+
+func (s *urlSet) has(u string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.items[u]
+	return ok
+}
+
+// maxReferencedURLs is the number of cross-origin URLs referenced by
+// pages which the proxy remembers as allowed targets.
+const maxReferencedURLs = 50000
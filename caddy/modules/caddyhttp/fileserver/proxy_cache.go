@@ -0,0 +1,890 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// proxyCaches holds the response caches of the proxy by store name,
+// so that handlers which share a token store share the responses too,
+// and cached responses survive config reloads.
+var proxyCaches = caddy.NewUsagePool()
+
+// loadProxyCache returns the response cache of the store named in cfg,
+// creating it if no handler uses it yet. The cache must be released
+// with proxyCaches.Delete(cfg.StoreName) when it is no longer needed.
+func loadProxyCache(cfg CacheV2Config, logger *zap.Logger) (*proxyCache, error) {
+	val, _, err := proxyCaches.LoadOrNew(cfg.StoreName, func() (caddy.Destructor, error) {
+		return newProxyCache(cfg.ProxyCacheMemory, cfg.ProxyCacheDir, cfg.ProxyCacheDiskSize, logger)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*proxyCache), nil
+}
+
+// proxyCache is a shared cache, in the sense of RFC 9111, of the
+// responses the proxy fetched. Responses are kept in memory, and
+// move to the disk tier, if there is one, when they are evicted from
+// memory. Both tiers are bounded in size and evict the least recently
+// used responses first.
+//
+// Responses are cached by URL and, if they have a Vary header, by the
+// values of the request headers it names, which is rarely more than
+// one variant since the proxy forwards only few request headers.
+type proxyCache struct {
+	mu       sync.Mutex
+	items    map[string]*cacheItem
+	urls     map[string]*cachedURL
+	memory   *list.List // of *cacheItem, most recently used first
+	disk     *list.List // of *cacheItem, most recently used first
+	memSize  int64
+	diskSize int64
+	maxMem   int64
+	maxDisk  int64
+	dir      string
+
+	// flights coalesces concurrent requests to the origin by cache key
+	flights singleflight.Group
+
+	logger *zap.Logger
+}
+
+// cachedURL tracks the variants of a URL in a proxyCache.
+type cachedURL struct {
+	vary     []string // the request headers the latest response varies on
+	variants int
+}
+
+// cacheItem is a response in a proxyCache, in memory, on disk or both.
+type cacheItem struct {
+	key  string
+	url  string
+	size int64
+
+	resp     *cachedResponse // nil if the response is only on disk
+	memElem  *list.Element
+	diskElem *list.Element
+	file     string
+}
+
+// newProxyCache returns a cache which keeps up to maxMem bytes of
+// responses in memory and, if dir is not empty, up to maxDisk bytes
+// in files in dir. Responses that are in dir already are picked up.
+func newProxyCache(maxMem int64, dir string, maxDisk int64, logger *zap.Logger) (*proxyCache, error) {
+	c := &proxyCache{
+		items:   make(map[string]*cacheItem),
+		urls:    make(map[string]*cachedURL),
+		memory:  list.New(),
+		disk:    list.New(),
+		maxMem:  maxMem,
+		maxDisk: maxDisk,
+		dir:     dir,
+		logger:  logger,
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating proxy cache directory: %v", err)
+	}
+	if err := c.scan(); err != nil {
+		return nil, fmt.Errorf("reading proxy cache directory: %v", err)
+	}
+	return c, nil
+}
+
+// Destruct implements caddy.Destructor. Responses on disk are kept.
+func (c *proxyCache) Destruct() error {
+	return nil
+}
+
+// key returns the cache key of the response to a request for url
+// with the header hdr, according to what the cached responses for
+// url vary on.
+func (c *proxyCache) key(url string, hdr http.Header) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var vary []string
+	if u, ok := c.urls[url]; ok {
+		vary = u.vary
+	}
+	return variantKey(url, vary, hdr)
+}
+
+// get returns the cached response with key, or nil if there is none.
+func (c *proxyCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	item, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	if item.resp != nil {
+		if item.memElem != nil {
+			c.memory.MoveToFront(item.memElem)
+		}
+		resp := item.resp
+		c.mu.Unlock()
+		return resp
+	}
+	file := item.file
+	c.mu.Unlock()
+
+	resp, err := readCachedResponse(filepath.Join(c.dir, file))
+	if err == nil && resp.Key != key {
+		err = fmt.Errorf("file holds response for %s", resp.Key)
+	}
+
+	c.mu.Lock()
+	if c.items[key] != item || item.file != file {
+		c.mu.Unlock()
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+	if err != nil {
+		c.logger.Warn("reading cached proxy response", zap.String("file", file), zap.Error(err))
+		c.remove(item)
+		c.mu.Unlock()
+		return nil
+	}
+	c.disk.MoveToFront(item.diskElem)
+	var pending []pendingWrite
+	if item.resp == nil && item.size <= c.maxMem {
+		item.resp = resp
+		item.memElem = c.memory.PushFront(item)
+		c.memSize += item.size
+		pending = c.evictMemory()
+	}
+	c.mu.Unlock()
+
+	c.writeToDisk(pending)
+	return resp
+}
+
+// put adds resp to the cache, replacing the response with the same key.
+func (c *proxyCache) put(resp *cachedResponse) {
+	item := &cacheItem{
+		key:  resp.Key,
+		url:  resp.URL,
+		size: resp.size(),
+		resp: resp,
+	}
+
+	c.mu.Lock()
+	if old, ok := c.items[item.key]; ok {
+		c.remove(old)
+	}
+	u, ok := c.urls[item.url]
+	if !ok {
+		u = new(cachedURL)
+		c.urls[item.url] = u
+	}
+	u.vary = varyNames(resp.Header)
+	u.variants++
+	c.items[item.key] = item
+
+	var pending []pendingWrite
+	switch {
+	case item.size <= c.maxMem:
+		item.memElem = c.memory.PushFront(item)
+		c.memSize += item.size
+		pending = c.evictMemory()
+	case c.dir != "" && item.size <= c.maxDisk:
+		pending = []pendingWrite{{item: item, resp: resp}}
+	default:
+		c.remove(item)
+	}
+	c.mu.Unlock()
+
+	c.writeToDisk(pending)
+}
+
+// delete removes the response with key from the cache.
+func (c *proxyCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if item, ok := c.items[key]; ok {
+		c.remove(item)
+	}
+}
+
+// remove removes item from both tiers. The caller must hold the lock.
+func (c *proxyCache) remove(item *cacheItem) {
+	if item.memElem != nil {
+		c.memory.Remove(item.memElem)
+		c.memSize -= item.size
+		item.memElem = nil
+	}
+	c.removeFromDisk(item)
+	item.resp = nil
+	delete(c.items, item.key)
+	if u, ok := c.urls[item.url]; ok {
+		u.variants--
+		if u.variants <= 0 {
+			delete(c.urls, item.url)
+		}
+	}
+}
+
+// removeFromDisk removes the file of item. The caller must hold the lock.
+func (c *proxyCache) removeFromDisk(item *cacheItem) {
+	if item.diskElem == nil {
+		return
+	}
+	c.disk.Remove(item.diskElem)
+	c.diskSize -= item.size
+	item.diskElem = nil
+	if err := os.Remove(filepath.Join(c.dir, item.file)); err != nil && !os.IsNotExist(err) {
+		c.logger.Warn("removing cached proxy response", zap.String("file", item.file), zap.Error(err))
+	}
+	item.file = ""
+}
+
+// pendingWrite is an item to be written to disk, with the response it
+// had when it was evicted from memory.
+type pendingWrite struct {
+	item *cacheItem
+	resp *cachedResponse
+}
+
+// evictMemory evicts the least recently used responses from memory
+// until it is within its limit. It returns the evicted items which
+// are to be written to disk. The caller must hold the lock.
+func (c *proxyCache) evictMemory() []pendingWrite {
+	var pending []pendingWrite
+	for c.memSize > c.maxMem {
+		item := c.memory.Back().Value.(*cacheItem)
+		c.memory.Remove(item.memElem)
+		c.memSize -= item.size
+		item.memElem = nil
+		switch {
+		case item.diskElem != nil:
+			item.resp = nil
+		case c.dir != "" && item.size <= c.maxDisk:
+			pending = append(pending, pendingWrite{item: item, resp: item.resp}) // keeps resp until written
+		default:
+			c.remove(item)
+		}
+	}
+	return pending
+}
+
+// evictDisk evicts the least recently used responses from disk until
+// it is within its limit. The caller must hold the lock.
+func (c *proxyCache) evictDisk() {
+	for c.diskSize > c.maxDisk {
+		item := c.disk.Back().Value.(*cacheItem)
+		c.removeFromDisk(item)
+		if item.memElem == nil {
+			c.remove(item)
+		}
+	}
+}
+
+// writeToDisk writes the responses of items, which were evicted from
+// memory, to disk. Items that changed in the meantime are skipped.
+func (c *proxyCache) writeToDisk(pending []pendingWrite) {
+	for _, p := range pending {
+		item, resp := p.item, p.resp
+		if resp == nil {
+			continue
+		}
+		file, err := writeCachedResponse(c.dir, resp)
+		if err != nil {
+			c.logger.Warn("writing cached proxy response", zap.String("url", item.url), zap.Error(err))
+		}
+
+		c.mu.Lock()
+		switch {
+		case c.items[item.key] != item || item.resp != resp || item.diskElem != nil:
+			if err == nil {
+				os.Remove(filepath.Join(c.dir, file))
+			}
+		case err != nil:
+			if item.memElem == nil {
+				c.remove(item)
+			}
+		default:
+			item.file = file
+			item.diskElem = c.disk.PushFront(item)
+			c.diskSize += item.size
+			if item.memElem == nil {
+				item.resp = nil
+			}
+			c.evictDisk()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// scan adds the responses in the cache directory to the disk tier,
+// the most recently written first, and removes broken files.
+func (c *proxyCache) scan() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type found struct {
+		file    string
+		resp    *cachedResponse
+		modTime time.Time
+	}
+	var files []found
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(c.dir, name)
+		switch filepath.Ext(name) {
+		case ".tmp":
+			// left over from an interrupted write
+			os.Remove(path)
+			continue
+		case ".resp":
+		default:
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		resp, err := readCachedResponseMeta(path)
+		if err != nil || info.Size() < resp.BodySize {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, found{file: name, resp: resp, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		if _, ok := c.items[f.resp.Key]; ok {
+			// an older copy of a response that was replaced
+			os.Remove(filepath.Join(c.dir, f.file))
+			continue
+		}
+		item := &cacheItem{
+			key:  f.resp.Key,
+			url:  f.resp.URL,
+			size: f.resp.size(),
+			file: f.file,
+		}
+		item.diskElem = c.disk.PushBack(item)
+		c.diskSize += item.size
+		c.items[item.key] = item
+		u, ok := c.urls[item.url]
+		if !ok {
+			u = &cachedURL{vary: varyNames(f.resp.Header)}
+			c.urls[item.url] = u
+		}
+		u.variants++
+	}
+	c.evictDisk()
+	return nil
+}
+
+// cachedResponse is a response of an origin as it is kept in
+// a proxyCache. On disk, its JSON encoding is followed by a newline
+// and the body.
+type cachedResponse struct {
+	Key          string      `json:"key"`
+	URL          string      `json:"url"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	BodySize     int64       `json:"body_size"`
+	Body         []byte      `json:"-"`
+}
+
+// size returns the approximate memory footprint of r.
+func (r *cachedResponse) size() int64 {
+	n := int64(len(r.Key)+len(r.URL)+256) + r.BodySize
+	for k, vv := range r.Header {
+		n += int64(len(k))
+		for _, v := range vv {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// date returns the Date of r, or the time it was received.
+func (r *cachedResponse) date() time.Time {
+	if date, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+		return date
+	}
+	return r.ResponseTime
+}
+
+// freshnessLifetime returns how long r is fresh after it was
+// generated, according to RFC 9111, section 4.2.1, for shared caches.
+func (r *cachedResponse) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(r.Header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+	if expires := r.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(r.date())
+	}
+
+	// without explicit expiration, a fraction of the time since the
+	// resource was last modified, see section 4.2.2
+	if !heuristicallyCacheable[r.Status] && !cc.has("public") {
+		return 0
+	}
+	lastModified, err := http.ParseTime(r.Header.Get("Last-Modified"))
+	if err != nil || !lastModified.Before(r.date()) {
+		return 0
+	}
+	lifetime := r.date().Sub(lastModified) / 10
+	if lifetime > maxHeuristicLifetime {
+		lifetime = maxHeuristicLifetime
+	}
+	return lifetime
+}
+
+// age returns the age of r at now, according to RFC 9111, section 4.2.3.
+func (r *cachedResponse) age(now time.Time) time.Duration {
+	apparentAge := r.ResponseTime.Sub(r.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	var ageValue time.Duration
+	if secs, err := strconv.ParseInt(r.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		ageValue = time.Duration(secs) * time.Second
+	}
+	correctedAge := ageValue + r.ResponseTime.Sub(r.RequestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(r.ResponseTime)
+}
+
+// fresh returns true if r may be served at now without revalidation,
+// to a request with the cache directives reqCC.
+func (r *cachedResponse) fresh(now time.Time, reqCC cacheControl) bool {
+	if reqCC.has("no-cache") {
+		return false
+	}
+	age := r.age(now)
+	if maxAge, ok := reqCC.duration("max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < r.freshnessLifetime()
+}
+
+// freshened returns a copy of r as if the origin had sent it again at
+// validated, which is when the token store last confirmed its token.
+func (r *cachedResponse) freshened(validated time.Time) *cachedResponse {
+	fr := *r
+	fr.Header = r.Header.Clone()
+	fr.Header.Set("Date", validated.UTC().Format(http.TimeFormat))
+	fr.Header.Del("Age")
+	fr.RequestTime = validated
+	fr.ResponseTime = validated
+	return &fr
+}
+
+// updated returns a copy of r with the header fields of a 304 response
+// to a conditional request for it, see RFC 9111, section 4.3.4.
+func (r *cachedResponse) updated(notModified *cachedResponse) *cachedResponse {
+	ur := *r
+	ur.Header = r.Header.Clone()
+	for k, vv := range notModified.Header {
+		if k == "Content-Length" {
+			continue
+		}
+		ur.Header[k] = vv
+	}
+	ur.RequestTime = notModified.RequestTime
+	ur.ResponseTime = notModified.ResponseTime
+	return &ur
+}
+
+// storable returns true if a shared cache may store a response
+// with status and hdr, according to RFC 9111, section 3.
+func storable(status int, hdr http.Header) bool {
+	cc := parseCacheControl(hdr)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	for _, name := range varyNames(hdr) {
+		if name == "*" {
+			return false
+		}
+	}
+	if heuristicallyCacheable[status] {
+		return true
+	}
+	return cc.has("public") || cc.has("max-age") || cc.has("s-maxage") || hdr.Get("Expires") != ""
+}
+
+// heuristicallyCacheable are the status codes whose responses may be
+// cached without explicit freshness, see RFC 9110, section 15.1. 206
+// is missing, since the proxy does not make range requests.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// maxHeuristicLifetime caps the heuristic freshness lifetime.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// cacheControl holds the directives of Cache-Control header fields by
+// their lowercase names, with unquoted values.
+type cacheControl map[string]string
+
+func parseCacheControl(hdr http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, line := range hdr.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// requestCacheControl returns the cache directives of a request, in
+// which `Pragma: no-cache` stands for `no-cache` if there are none.
+func requestCacheControl(hdr http.Header) cacheControl {
+	cc := parseCacheControl(hdr)
+	if len(cc) == 0 && strings.Contains(strings.ToLower(hdr.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// duration returns the delta-seconds value of the directive name.
+// Invalid values count as zero, so that the response is stale.
+func (cc cacheControl) duration(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, true
+	}
+	if secs > maxDeltaSeconds {
+		secs = maxDeltaSeconds
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// maxDeltaSeconds is the largest delta-seconds value, see RFC 9111, section 1.2.2.
+const maxDeltaSeconds = 1 << 31
+
+// varyNames returns the sorted, canonical names of the request
+// headers the response with hdr varies on.
+func varyNames(hdr http.Header) []string {
+	var names []string
+	for _, line := range hdr.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// variantKey returns the cache key of the response for url which
+// varies on the request headers vary, for a request with hdr.
+func variantKey(url string, vary []string, hdr http.Header) string {
+	if len(vary) == 0 {
+		return url
+	}
+	var sb strings.Builder
+	sb.WriteString(url)
+	for _, name := range vary {
+		sb.WriteString("\x00")
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strings.Join(hdr.Values(name), ","))
+	}
+	return sb.String()
+}
+
+// writeCachedResponse writes resp to a new file in dir and returns its name.
+func writeCachedResponse(dir string, resp *cachedResponse) (string, error) {
+	meta, err := json.Marshal(resp)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	_, err = f.Write(append(meta, '\n'))
+	if err == nil {
+		_, err = f.Write(resp.Body)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	name := strings.TrimSuffix(tmp, ".tmp") + ".resp"
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return filepath.Base(name), nil
+}
+
+// readCachedResponse reads the response in the file at path.
+func readCachedResponse(path string) (*cachedResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("missing response metadata")
+	}
+	resp := new(cachedResponse)
+	if err := json.Unmarshal(meta, resp); err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != resp.BodySize {
+		return nil, fmt.Errorf("expected %d bytes of body, got %d", resp.BodySize, len(body))
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// readCachedResponseMeta reads the response in the file at path
+// without its body.
+func readCachedResponseMeta(path string) (*cachedResponse, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	resp := new(cachedResponse)
+	if err := json.Unmarshal(meta, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fetchCached returns the response for target, from the cache if it has
+// a fresh one, or else from the origin, with a conditional request if
+// there is a stale one. Concurrent requests for the same response are
+// coalesced into one request to the origin. It also returns how the
+// response was obtained, in the form of the Cache-Status header field
+// (RFC 9211).
+func (p *resourceProxy) fetchCached(r *http.Request, target string, hdr http.Header) (*cachedResponse, string, error) {
+	reqCC := requestCacheControl(r.Header)
+	if reqCC.has("no-store") {
+		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+		defer cancel()
+		resp, err := p.fetch(ctx, target, hdr, nil)
+		return resp, "fwd=request", err
+	}
+
+	key := p.cache.key(target, hdr)
+	cached := p.cache.get(key)
+	if cached != nil && cached.Status == http.StatusOK {
+		// the token store revalidates the tokens periodically,
+		// which also revalidates the cached response
+		if token, validated, ok := p.store.validation(target); ok {
+			if token != headerToken(cached.Header) {
+				p.cache.delete(key)
+				cached = nil
+			} else if validated.After(cached.ResponseTime) {
+				cached = cached.freshened(validated)
+			}
+		}
+	}
+	if cached != nil && cached.fresh(time.Now(), reqCC) {
+		if cached.Status == http.StatusOK {
+			// serving the resource counts as a use of its token
+			p.store.set(target, headerToken(cached.Header), cached.Header.Get("Last-Modified"), time.Time{}, sourceOrigin)
+		}
+		return cached, "hit", nil
+	}
+
+	ch := p.cache.flights.DoChan(key, func() (any, error) {
+		return p.revalidate(target, hdr, cached)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, "", res.Err
+		}
+		fetched := res.Val.(fetchedResponse)
+		if res.Shared && variantKey(target, varyNames(fetched.resp.Header), hdr) != fetched.resp.Key {
+			// the response varies on a header in which this request differs
+			ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+			defer cancel()
+			resp, err := p.fetch(ctx, target, hdr, nil)
+			return resp, "fwd=vary-miss", err
+		}
+		return fetched.resp, fetched.status, nil
+	case <-r.Context().Done():
+		return nil, "", r.Context().Err()
+	}
+}
+
+// fetchedResponse is the result of a coalesced request to the origin.
+type fetchedResponse struct {
+	resp   *cachedResponse
+	status string
+}
+
+// revalidate fetches target from the origin, conditionally if there is
+// a stale cached response, and stores the response in the cache. It is
+// not bound to the client request, since other clients may wait for it.
+func (p *resourceProxy) revalidate(target string, hdr http.Header, cached *cachedResponse) (fetchedResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	resp, err := p.fetch(ctx, target, hdr, cached)
+	if err != nil {
+		return fetchedResponse{}, err
+	}
+	status := "fwd=miss"
+	if cached != nil {
+		status = "fwd=stale"
+	}
+	if resp.Status == http.StatusNotModified && cached != nil {
+		resp = cached.updated(resp)
+		status += "; fwd-status=304"
+		if resp.Status == http.StatusOK {
+			p.store.setFromHeader(target, resp.Header)
+		}
+	} else {
+		status += "; fwd-status=" + strconv.Itoa(resp.Status)
+	}
+	if storable(resp.Status, resp.Header) {
+		p.cache.put(resp)
+		status += "; stored"
+	}
+	return fetchedResponse{resp: resp, status: status}, nil
+}
+
+// fetch requests target from the origin with the header hdr, and
+// conditionally if cached is not nil. The response body must not
+// exceed the maximum size of the proxy.
+func (p *resourceProxy) fetch(ctx context.Context, target string, hdr http.Header, cached *cachedResponse) (*cachedResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = hdr.Clone()
+	if cached != nil {
+		if etag := cached.Header.Get("Etag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > p.maxSize {
+		return nil, tooLargeError{size: resp.ContentLength}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, p.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > p.maxSize {
+		return nil, tooLargeError{size: -1}
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		p.store.setFromHeader(target, resp.Header)
+	}
+
+	header := proxyResponseHeader(resp.Header)
+	return &cachedResponse{
+		Key:          variantKey(target, varyNames(header), hdr),
+		URL:          target,
+		Status:       resp.StatusCode,
+		Header:       header,
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+		BodySize:     int64(len(body)),
+		Body:         body,
+	}, nil
+}
+
+// tooLargeError is returned when a proxied response exceeds the maximum size.
+type tooLargeError struct {
+	size int64 // -1 if unknown
+}
+
+func (e tooLargeError) Error() string {
+	if e.size < 0 {
+		return "proxy target is too large"
+	}
+	return fmt.Sprintf("proxy target is too large: %d bytes", e.size)
+}
@@ -0,0 +1,286 @@
+package fileserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCachedResponseFreshness(t *testing.T) {
+	now := time.Now()
+	date := now.Add(-10 * time.Second).UTC().Format(http.TimeFormat)
+
+	for i, tc := range []struct {
+		status   int
+		header   http.Header
+		storable bool
+		fresh    bool
+	}{
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}}, storable: true, fresh: true},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=5"}, "Date": {date}}, storable: true, fresh: false},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"100"}}, storable: true, fresh: false},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=0, s-maxage=60"}}, storable: true, fresh: true},
+		{status: 200, header: http.Header{"Cache-Control": {"no-cache"}}, storable: true, fresh: false},
+		{status: 200, header: http.Header{"Cache-Control": {"no-store"}}, storable: false},
+		{status: 200, header: http.Header{"Cache-Control": {"private, max-age=60"}}, storable: false},
+		{status: 200, header: http.Header{"Vary": {"Accept, *"}}, storable: false},
+		{status: 200, header: http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, storable: true, fresh: true},
+		{status: 200, header: http.Header{"Expires": {"0"}}, storable: true, fresh: false},
+		{status: 200, header: http.Header{"Last-Modified": {now.Add(-100 * time.Hour).UTC().Format(http.TimeFormat)}}, storable: true, fresh: true},
+		{status: 200, header: http.Header{}, storable: true, fresh: false},
+		{status: 500, header: http.Header{}, storable: false},
+		{status: 500, header: http.Header{"Cache-Control": {"max-age=60"}}, storable: true, fresh: true},
+	} {
+		resp := &cachedResponse{Status: tc.status, Header: tc.header, RequestTime: now, ResponseTime: now}
+		if actual := storable(tc.status, tc.header); actual != tc.storable {
+			t.Errorf("test %d: expected storable=%t, got %t", i, tc.storable, actual)
+		}
+		if !tc.storable {
+			continue
+		}
+		if actual := resp.fresh(now, cacheControl{}); actual != tc.fresh {
+			t.Errorf("test %d: expected fresh=%t, got %t", i, tc.fresh, actual)
+		}
+	}
+
+	resp := &cachedResponse{Status: 200, Header: http.Header{"Cache-Control": {"max-age=60"}}, RequestTime: now, ResponseTime: now}
+	later := now.Add(30 * time.Second)
+	if resp.fresh(later, requestCacheControl(http.Header{"Cache-Control": {"max-age=10"}})) {
+		t.Error("expected request max-age to be honoured")
+	}
+	if resp.fresh(later, requestCacheControl(http.Header{"Pragma": {"no-cache"}})) {
+		t.Error("expected Pragma: no-cache to require revalidation")
+	}
+}
+
+func TestProxyCache(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	conditional := make(map[string]bool)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		conditional[r.URL.Path] = r.Header.Get("If-None-Match") != ""
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/fresh.js":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Etag", `"fresh"`)
+		case "/revalidate.js":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Etag", `"r"`)
+			if r.Header.Get("If-None-Match") == `"r"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/slow.js":
+			time.Sleep(50 * time.Millisecond)
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/private.js":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewEtagStore(EtagStoreOptions{Interval: time.Hour})
+	defer store.Stop()
+	p, err := newResourceProxy(CacheV2Config{
+		ProxyMaxSize:     1024,
+		ProxyTimeout:     caddy.Duration(time.Second),
+		ProxyAllowRanges: []string{originURL.Hostname()},
+		ProxyAnyURL:      true,
+	}, store, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache, err = newProxyCache(1<<20, "", 0, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/proxy-resource?url="+url.QueryEscape(origin.URL+path), nil)
+		rr := httptest.NewRecorder()
+		if err := p.ServeHTTP(rr, req); err != nil {
+			t.Fatalf("unexpected error for %s: %v", path, err)
+		}
+		if expect := "body of " + path; rr.Body.String() != expect {
+			t.Errorf("expected body %q, got %q", expect, rr.Body.String())
+		}
+		return rr
+	}
+	count := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[path]
+	}
+
+	get("/fresh.js")
+	rr := get("/fresh.js")
+	if n := count("/fresh.js"); n != 1 {
+		t.Errorf("expected fresh response to be served from the cache, got %d origin requests", n)
+	}
+	if status := rr.Header().Get("Cache-Status"); status != "cachev2; hit" {
+		t.Errorf("expected a cache hit, got Cache-Status %q", status)
+	}
+	if rr.Header().Get("Age") == "" {
+		t.Error("expected Age header on cached response")
+	}
+	// the header of a response is its own, not that of the cached entry
+	rr.Header()["Etag"][0] = `"tampered"`
+	if etag := get("/fresh.js").Header().Get("Etag"); etag != `"fresh"` {
+		t.Errorf("expected the cached header to be left alone, got Etag %q", etag)
+	}
+
+	// a changed token in the store invalidates the cached response
+	store.Set(origin.URL+"/fresh.js", `"changed"`)
+	get("/fresh.js")
+	if n := count("/fresh.js"); n != 2 {
+		t.Errorf("expected response with outdated token to be fetched again, got %d origin requests", n)
+	}
+
+	get("/revalidate.js")
+	rr = get("/revalidate.js")
+	if n := count("/revalidate.js"); n != 2 || !conditional["/revalidate.js"] {
+		t.Errorf("expected a conditional request, got %d origin requests", n)
+	}
+	if status := rr.Header().Get("Cache-Status"); !strings.Contains(status, "fwd=stale; fwd-status=304") {
+		t.Errorf("expected revalidated response, got Cache-Status %q", status)
+	}
+
+	get("/private.js")
+	get("/private.js")
+	if n := count("/private.js"); n != 2 {
+		t.Errorf("expected private response not to be cached, got %d origin requests", n)
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/proxy-resource?url="+url.QueryEscape(origin.URL+"/slow.js"), nil)
+			if err := p.ServeHTTP(httptest.NewRecorder(), req); err != nil {
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
+		t.Error("expected coalesced requests to succeed")
+	}
+	if n := count("/slow.js"); n != 1 {
+		t.Errorf("expected concurrent requests to be coalesced, got %d origin requests", n)
+	}
+}
+
+func TestProxyCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	newResponse := func(key string) *cachedResponse {
+		body := bytes.Repeat([]byte(key[len(key)-1:]), 300)
+		return &cachedResponse{
+			Key:      key,
+			URL:      key,
+			Status:   http.StatusOK,
+			Header:   http.Header{"Cache-Control": {"max-age=60"}},
+			BodySize: int64(len(body)),
+			Body:     body,
+		}
+	}
+
+	// room for one response in memory, and all of them on disk
+	c, err := newProxyCache(700, dir, 2000, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"https://a.example/1", "https://a.example/2", "https://a.example/3"} {
+		c.put(newResponse(key))
+	}
+	for _, key := range []string{"https://a.example/1", "https://a.example/2", "https://a.example/3"} {
+		resp := c.get(key)
+		if resp == nil {
+			t.Fatalf("expected %s to be cached", key)
+		}
+		if !bytes.Equal(resp.Body, newResponse(key).Body) {
+			t.Errorf("expected body of %s to survive the disk tier", key)
+		}
+	}
+
+	// another cache picks up the responses on disk, within its limit
+	c, err = newProxyCache(700, dir, 700, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found int
+	for _, key := range []string{"https://a.example/1", "https://a.example/2", "https://a.example/3"} {
+		if resp := c.get(key); resp != nil {
+			found++
+			if !bytes.Equal(resp.Body, newResponse(key).Body) {
+				t.Errorf("expected body of %s to be read from disk", key)
+			}
+		}
+	}
+	if found != 1 {
+		t.Errorf("expected one response to be loaded from disk, got %d", found)
+	}
+}
+
+func TestProxyCacheDiskConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newProxyCache(700, dir, 2000, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"https://a.example/1", "https://a.example/2", "https://a.example/3", "https://a.example/4"}
+
+	// responses are written to disk, as they do not fit in memory or
+	// are evicted from it, while others remove them
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := keys[(i+j)%len(keys)]
+				switch j % 3 {
+				case 0, 1:
+					body := bytes.Repeat([]byte{'x'}, 300+500*(j%2))
+					c.put(&cachedResponse{Key: key, URL: key, Status: http.StatusOK, BodySize: int64(len(body)), Body: body})
+				default:
+					c.delete(key)
+				}
+				c.get(keys[j%len(keys)])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		resp, err := readCachedResponse(filepath.Join(dir, entry.Name()))
+		if err != nil || resp == nil || resp.Key == "" {
+			t.Errorf("expected a response in %s, got %v (%v)", entry.Name(), resp, err)
+		}
+	}
+}
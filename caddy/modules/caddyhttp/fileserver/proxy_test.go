@@ -0,0 +1,226 @@
+package fileserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestProxyGuard(t *testing.T) {
+	g, err := newProxyGuard(CacheV2Config{
+		ProxyAllowHosts:  []string{"cdn.example.com", "*.static.example.net"},
+		ProxyDenyHosts:   []string{"bad.static.example.net"},
+		ProxyAllowRanges: []string{"10.1.0.0/16", "192.168.1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, expect := range map[string]bool{
+		"cdn.example.com":         true,
+		"CDN.Example.com.":        true,
+		"a.cdn.example.com":       false,
+		"img.static.example.net":  true,
+		"static.example.net":      false,
+		"bad.static.example.net":  false,
+		"evil.com":                false,
+		"cdn.example.com.evil.io": false,
+		"":                        false,
+	} {
+		if actual := g.allowedHost(host); actual != expect {
+			t.Errorf("expected allowedHost(%q)=%t, got %t", host, expect, actual)
+		}
+	}
+
+	// metrics are labeled by the allowed pattern, to bound their number
+	for host, expect := range map[string]string{
+		"CDN.Example.com.":       "cdn.example.com",
+		"img.static.example.net": "*.static.example.net",
+		"evil.com":               "other",
+	} {
+		if actual := g.hostLabel(host); actual != expect {
+			t.Errorf("expected hostLabel(%q)=%q, got %q", host, expect, actual)
+		}
+	}
+
+	for ip, expect := range map[string]bool{
+		"93.184.216.34":          true,
+		"2606:2800:220:1::1":     true,
+		"::ffff:93.184.216.34":   true,
+		"127.0.0.1":              false,
+		"::1":                    false,
+		"::ffff:127.0.0.1":       false,
+		"0.0.0.0":                false,
+		"10.0.0.1":               false,
+		"172.16.0.1":             false,
+		"192.168.1.2":            false,
+		"169.254.169.254":        false,
+		"::ffff:169.254.169.254": false,
+		"100.64.0.1":             false,
+		"fd00::1":                false,
+		"fe80::1":                false,
+		"224.0.0.1":              false,
+		"64:ff9b::a9fe:a9fe":     false,
+		"2002:a9fe:a9fe::1":      false,
+		"10.1.2.3":               true,
+		"192.168.1.1":            true,
+	} {
+		if actual := g.allowedAddr(netip.MustParseAddr(ip)); actual != expect {
+			t.Errorf("expected allowedAddr(%s)=%t, got %t", ip, expect, actual)
+		}
+	}
+
+	if _, err := newProxyGuard(CacheV2Config{ProxyAllowRanges: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("expected error for invalid range")
+	}
+}
+
+func TestResourceProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "" {
+			t.Error("expected no cookies to be forwarded")
+		}
+		switch r.URL.Path {
+		case "/big.js":
+			w.Header().Set("Content-Length", "2048")
+			w.Write(make([]byte, 2048))
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<script>steal()</script>"))
+		default:
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Header().Set("Etag", `"lib"`)
+			w.Write([]byte("lib"))
+		}
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewEtagStore(EtagStoreOptions{})
+	defer store.Stop()
+
+	serve := func(p *resourceProxy, target string) (*httptest.ResponseRecorder, int) {
+		req := httptest.NewRequest(http.MethodGet, "/proxy-resource?url="+url.QueryEscape(target), nil)
+		req.Header.Set("Cookie", "session=secret")
+		rr := httptest.NewRecorder()
+		err := p.ServeHTTP(rr, req)
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return rr, handlerErr.StatusCode
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rr, rr.Code
+	}
+
+	// the test origin listens on loopback, which is forbidden by default
+	p, err := newResourceProxy(CacheV2Config{ProxyMaxSize: 1024, ProxyTimeout: caddy.Duration(time.Second)}, store, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := serve(p, origin.URL+"/lib.js"); status != http.StatusForbidden {
+		t.Errorf("expected unreferenced URL to be refused, got %d", status)
+	}
+	p.referenced.add(origin.URL + "/lib.js")
+	if _, status := serve(p, origin.URL+"/lib.js"); status != http.StatusForbidden {
+		t.Errorf("expected loopback address to be refused, got %d", status)
+	}
+	if _, status := serve(p, "file:///etc/passwd"); status != http.StatusBadRequest {
+		t.Errorf("expected non-HTTP URL to be rejected, got %d", status)
+	}
+
+	p, err = newResourceProxy(CacheV2Config{
+		ProxyMaxSize:     1024,
+		ProxyTimeout:     caddy.Duration(time.Second),
+		ProxyAllowRanges: []string{originURL.Hostname()},
+	}, store, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.referenced.add(origin.URL + "/lib.js")
+	p.referenced.add(origin.URL + "/big.js")
+
+	rr, status := serve(p, origin.URL+"/lib.js#fragment")
+	if status != http.StatusOK || rr.Body.String() != "lib" {
+		t.Errorf("expected proxied resource, got %d %q", status, rr.Body.String())
+	}
+	if etag, _ := store.Get(origin.URL + "/lib.js"); etag != `"lib"` {
+		t.Errorf("expected token to be stored, got %q", etag)
+	}
+	if rr.Header().Get("X-Content-Type-Options") != "nosniff" || rr.Header().Get("Content-Security-Policy") != "" {
+		t.Errorf("expected the script not to be sniffed nor sandboxed, got %v", rr.Header())
+	}
+	if n := testutil.ToFloat64(cacheV2Metrics.proxyRequests.WithLabelValues("other", "200")); n == 0 {
+		t.Error("expected the proxied request to be counted for other hosts")
+	}
+	if _, status := serve(p, origin.URL+"/big.js"); status != http.StatusBadGateway {
+		t.Errorf("expected response over the size limit to be refused, got %d", status)
+	}
+
+	// documents are served from the site's origin, so they are sandboxed
+	p.referenced.add(origin.URL + "/page.html")
+	rr, status = serve(p, origin.URL+"/page.html")
+	if status != http.StatusOK || rr.Header().Get("Content-Security-Policy") != "sandbox" ||
+		rr.Header().Get("Content-Disposition") != "attachment" || rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expected the document to be sandboxed, got %d %v", status, rr.Header())
+	}
+
+	p, err = newResourceProxy(CacheV2Config{
+		ProxyMaxSize:     1024,
+		ProxyTimeout:     caddy.Duration(time.Second),
+		ProxyAllowRanges: []string{originURL.Hostname()},
+		ProxyDenyHosts:   []string{strings.ToUpper(originURL.Hostname())},
+		ProxyAnyURL:      true,
+	}, store, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := serve(p, origin.URL+"/other.js"); status != http.StatusForbidden {
+		t.Errorf("expected denied host to be refused, got %d", status)
+	}
+
+	// upstream proxies of the transport are used for allowed targets only
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via " + r.URL.Host))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := CacheV2Config{ProxyMaxSize: 1024, ProxyTimeout: caddy.Duration(time.Second), ProxyAnyURL: true}
+	transport, err := newProxyTransport(cfg, &reverseproxy.HTTPTransport{Transport: &http.Transport{Proxy: http.ProxyURL(upstreamURL)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = newResourceProxy(cfg, store, transport, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr, status := serve(p, "http://93.184.216.34/lib.js"); status != http.StatusOK || rr.Body.String() != "via 93.184.216.34" {
+		t.Errorf("expected resource via upstream proxy, got %d %q", status, rr.Body.String())
+	}
+	if _, status := serve(p, "http://127.0.0.1:1/lib.js"); status != http.StatusForbidden {
+		t.Errorf("expected loopback target to be refused before the upstream proxy, got %d", status)
+	}
+
+	// h2c connections bypass the guarded transport
+	if _, err := newProxyTransport(cfg, &reverseproxy.HTTPTransport{Transport: &http.Transport{}, Versions: []string{"h2c", "2"}}); err == nil {
+		t.Error("expected the h2c version to be rejected")
+	}
+}
@@ -0,0 +1,389 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	caddy.RegisterModule(FileResolver{})
+	caddy.RegisterModule(HTTPResolver{})
+}
+
+// ETagResolver looks up the current validation token of a sub-resource
+// referenced by an HTML page. The page request is given so that resolvers
+// can evaluate placeholders; target is the request path of the resource.
+//
+// Modules in the http.handlers.cachev2.resolvers namespace implement
+// this interface.
+type ETagResolver interface {
+	ResolveETag(r *http.Request, target string) (string, error)
+}
+
+// FileResolver resolves validation tokens from files on disk (or any
+// other file system module), the same way the file server computes
+// the Etag header of the files it serves.
+type FileResolver struct {
+	// The path to the root of the site. Default is `{http.vars.root}`
+	// if set, or current working directory otherwise.
+	Root string `json:"root,omitempty"`
+
+	// The file system implementation to use. By default, the local
+	// disk file system is used.
+	FileSystemRaw json.RawMessage `json:"file_system,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+	fileSystem    fs.FS
+
+	// Use content-based validation tokens. This must match the
+	// `content_etag` setting of the file server serving the files.
+	ContentEtag *ContentEtag `json:"content_etag,omitempty"`
+	digester    *contentDigester
+
+	// Watch the root directory for changes and keep the tokens of the
+	// files below it in memory, so that resolving the token of a file
+	// which did not change costs no system calls. Only supported on
+	// the local disk file system.
+	Watch    bool `json:"watch,omitempty"`
+	watchers *fileWatchers
+}
+
+// CaddyModule returns the Caddy module information.
+func (FileResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.cachev2.resolvers.file",
+		New: func() caddy.Module { return new(FileResolver) },
+	}
+}
+
+// Provision sets up the file resolver.
+func (fr *FileResolver) Provision(ctx caddy.Context) error {
+	if len(fr.FileSystemRaw) > 0 {
+		mod, err := ctx.LoadModule(fr, "FileSystemRaw")
+		if err != nil {
+			return fmt.Errorf("loading file system module: %v", err)
+		}
+		fr.fileSystem = mod.(fs.FS)
+	}
+	if fr.fileSystem == nil {
+		fr.fileSystem = osFS{}
+	}
+	if fr.Root == "" {
+		fr.Root = "{http.vars.root}"
+	}
+	if fr.ContentEtag != nil {
+		if err := fr.ContentEtag.validate(); err != nil {
+			return err
+		}
+	}
+	fr.digester = fr.ContentEtag.newDigester()
+	if fr.Watch {
+		if _, ok := fr.fileSystem.(osFS); !ok {
+			return fmt.Errorf("watching is only supported on the local disk file system")
+		}
+		fr.watchers = newFileWatchers(ctx.Logger())
+	}
+	return nil
+}
+
+// Cleanup stops watching the root directories.
+func (fr *FileResolver) Cleanup() error {
+	if fr.watchers != nil {
+		return fr.watchers.close()
+	}
+	return nil
+}
+
+// ResolveETag returns the Etag of the file that target maps to.
+func (fr *FileResolver) ResolveETag(r *http.Request, target string) (string, error) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root := repl.ReplaceAll(fr.Root, ".")
+
+	filename := strings.TrimSuffix(caddyhttp.SanitizedPathJoin(root, target), "/")
+	if fr.watchers != nil {
+		if idx := fr.watchers.index(root); idx != nil {
+			return idx.etag(filename, func() (string, error) {
+				return fr.statETag(filename)
+			})
+		}
+	}
+	return fr.statETag(filename)
+}
+
+// statETag returns the Etag of the file filename.
+func (fr *FileResolver) statETag(filename string) (string, error) {
+	info, err := fs.Stat(fr.fileSystem, filename)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fs.ErrNotExist
+	}
+	return fileEtag(fr.fileSystem, filename, info, fr.digester), nil
+}
+
+// onChange registers fn to be called with the request paths of the files
+// which change below the watched root directories.
+func (fr *FileResolver) onChange(fn func(target string, etag func(target string) string)) {
+	if fr.watchers == nil {
+		return
+	}
+	fr.watchers.subscribe(func(root, filename string) {
+		etag := func(target string) string {
+			etag, _ := fr.statETag(strings.TrimSuffix(caddyhttp.SanitizedPathJoin(root, target), "/"))
+			return etag
+		}
+		rel, err := filepath.Rel(filepath.Clean(root), filename)
+		if filename == "" || err != nil || rel == "." {
+			fn("", etag)
+			return
+		}
+		fn("/"+filepath.ToSlash(rel), etag)
+	})
+}
+
+// OpenResource opens the file that target maps to.
+func (fr *FileResolver) OpenResource(r *http.Request, target string) (io.ReadCloser, error) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root := repl.ReplaceAll(fr.Root, ".")
+
+	filename := strings.TrimSuffix(caddyhttp.SanitizedPathJoin(root, target), "/")
+	return fr.fileSystem.Open(filename)
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens. Syntax:
+//
+//	file [<root>] {
+//	    content_etag [<algorithm>] {
+//	        cache_size <n>
+//	    }
+//	    watch
+//	}
+func (fr *FileResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume module name
+	if d.NextArg() {
+		fr.Root = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "content_etag":
+			ce, err := unmarshalContentEtag(d)
+			if err != nil {
+				return err
+			}
+			fr.ContentEtag = ce
+		case "watch":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			fr.Watch = true
+		default:
+			return d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// HTTPResolver resolves validation tokens by asking an upstream origin,
+// which is useful when the pages are produced by a proxied backend.
+// Tokens are remembered and refreshed in the background, so each
+// resource costs a HEAD request to the upstream only once.
+type HTTPResolver struct {
+	// The base URL of the upstream, e.g. `http://localhost:8080`.
+	// Resource paths are appended to it.
+	Upstream string `json:"upstream,omitempty"`
+
+	// How long to wait for the upstream to answer. Default: 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How often the remembered tokens are refreshed. Default: 10m.
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// The transport with which the upstream is asked, like for
+	// `reverse_proxy`. Only the `http` transport is supported, and
+	// requests go through it like those of `reverse_proxy`, so all of
+	// its options apply. Default: the `http` transport with its defaults.
+	TransportRaw json.RawMessage `json:"transport,omitempty" caddy:"namespace=http.reverse_proxy.transport inline_key=protocol"`
+
+	client *http.Client
+	store  *EtagStore
+}
+
+// CaddyModule returns the Caddy module information.
+func (HTTPResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.cachev2.resolvers.http",
+		New: func() caddy.Module { return new(HTTPResolver) },
+	}
+}
+
+// Provision sets up the HTTP resolver.
+func (hr *HTTPResolver) Provision(ctx caddy.Context) error {
+	if hr.Timeout == 0 {
+		hr.Timeout = caddy.Duration(10 * time.Second)
+	}
+
+	if hr.RefreshInterval == 0 {
+		hr.RefreshInterval = caddy.Duration(10 * time.Minute)
+	}
+
+	var mod any
+	var err error
+	if hr.TransportRaw != nil {
+		mod, err = ctx.LoadModule(hr, "TransportRaw")
+	} else {
+		mod, err = ctx.LoadModuleByID("http.reverse_proxy.transport.http", json.RawMessage("{}"))
+	}
+	if err != nil {
+		return fmt.Errorf("loading transport module: %v", err)
+	}
+	ht, ok := mod.(*reverseproxy.HTTPTransport)
+	if !ok {
+		return fmt.Errorf("transport module %T is not supported, only http is", mod)
+	}
+	transport := caddyTransport{ht}
+
+	hr.client = &http.Client{Transport: transport, Timeout: time.Duration(hr.Timeout)}
+	hr.store = NewEtagStore(EtagStoreOptions{Interval: time.Duration(hr.RefreshInterval), Transport: transport})
+	return nil
+}
+
+// Cleanup stops refreshing the remembered tokens.
+func (hr *HTTPResolver) Cleanup() error {
+	if hr.store != nil {
+		hr.store.Stop()
+	}
+	return nil
+}
+
+// Validate ensures hr has a valid configuration.
+func (hr *HTTPResolver) Validate() error {
+	if hr.Upstream == "" {
+		return fmt.Errorf("upstream is required")
+	}
+	if hr.Timeout < 0 || hr.RefreshInterval < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	return nil
+}
+
+// ResolveETag returns the validation token the upstream reports for
+// target, i.e. its Etag or else its Last-Modified date.
+func (hr *HTTPResolver) ResolveETag(r *http.Request, target string) (string, error) {
+	key := strings.TrimSuffix(hr.Upstream, "/") + target
+	if etag, ok := hr.store.Get(key); ok {
+		return etag, nil
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodHead, key, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream responded with status %d", resp.StatusCode)
+	}
+
+	hr.store.setFromHeader(key, resp.Header)
+	return headerToken(resp.Header), nil
+}
+
+// OpenResource fetches target from the upstream.
+func (hr *HTTPResolver) OpenResource(r *http.Request, target string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, strings.TrimSuffix(hr.Upstream, "/")+target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream responded with status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens. Syntax:
+//
+//	http <upstream> {
+//	    timeout          <duration>
+//	    refresh_interval <duration>
+//	    transport        http {
+//	        ...
+//	    }
+//	}
+func (hr *HTTPResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume module name
+	if !d.Args(&hr.Upstream) {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing timeout duration: %v", err)
+			}
+			hr.Timeout = caddy.Duration(dur)
+		case "refresh_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing refresh interval duration: %v", err)
+			}
+			hr.RefreshInterval = caddy.Duration(dur)
+		case "transport":
+			if hr.TransportRaw != nil {
+				return d.Err("transport already specified")
+			}
+			raw, err := unmarshalTransport(d)
+			if err != nil {
+				return err
+			}
+			hr.TransportRaw = raw
+		default:
+			return d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ ETagResolver          = (*FileResolver)(nil)
+	_ ResourceOpener        = (*FileResolver)(nil)
+	_ caddy.Provisioner     = (*FileResolver)(nil)
+	_ caddy.CleanerUpper    = (*FileResolver)(nil)
+	_ changeNotifier        = (*FileResolver)(nil)
+	_ caddyfile.Unmarshaler = (*FileResolver)(nil)
+
+	_ ETagResolver          = (*HTTPResolver)(nil)
+	_ ResourceOpener        = (*HTTPResolver)(nil)
+	_ caddy.Provisioner     = (*HTTPResolver)(nil)
+	_ caddy.Validator       = (*HTTPResolver)(nil)
+	_ caddy.CleanerUpper    = (*HTTPResolver)(nil)
+	_ caddyfile.Unmarshaler = (*HTTPResolver)(nil)
+)
@@ -0,0 +1,45 @@
+package fileserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestHTTPResolver(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"up"`)
+	}))
+	defer upstream.Close()
+
+	hr := new(HTTPResolver)
+	d := caddyfile.NewTestDispenser(`http ` + upstream.URL + ` {
+		refresh_interval 1h
+	}`)
+	if err := hr.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := hr.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer hr.Cleanup()
+
+	// without a transport, that of reverse_proxy is used with its defaults
+	if _, ok := hr.client.Transport.(caddyTransport); !ok {
+		t.Errorf("expected the http transport, got %T", hr.client.Transport)
+	}
+	if hr.store.opts.Interval != time.Hour {
+		t.Errorf("expected the configured refresh interval, got %v", hr.store.opts.Interval)
+	}
+	etag, err := hr.ResolveETag(httptest.NewRequest(http.MethodGet, "/", nil), "/a.css")
+	if err != nil || etag != `"up"` {
+		t.Errorf("expected the upstream's token, got %q: %v", etag, err)
+	}
+}
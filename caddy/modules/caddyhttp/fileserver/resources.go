@@ -0,0 +1,249 @@
+package fileserver
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// resourceAttrs lists, per element, the attributes that hold the URL
+// of a sub-resource which browsers fetch when rendering the element.
+// Links are handled separately because it depends on their relation.
+var resourceAttrs = map[atom.Atom][]string{
+	atom.Img:    {"src"},
+	atom.Script: {"src"},
+	atom.Source: {"src"},
+	atom.Video:  {"src", "poster"},
+	atom.Audio:  {"src"},
+	atom.Track:  {"src"},
+	atom.Input:  {"src"},
+	atom.Embed:  {"src"},
+	atom.Object: {"data"},
+	atom.Iframe: {"src"},
+	atom.Body:   {"background"},
+	atom.Table:  {"background"},
+	atom.Td:     {"background"},
+	atom.Th:     {"background"},
+}
+
+// srcsetAttrs lists, per element, the attributes that hold a list
+// of image candidates in the srcset syntax.
+var srcsetAttrs = map[atom.Atom]string{
+	atom.Img:    "srcset",
+	atom.Source: "srcset",
+	atom.Link:   "imagesrcset",
+}
+
+// fetchedLinkRels are the link relations for which browsers fetch
+// the linked resource while loading the page.
+var fetchedLinkRels = []string{
+	"stylesheet",
+	"icon",
+	"apple-touch-icon",
+	"apple-touch-icon-precomposed",
+	"mask-icon",
+	"manifest",
+	"preload",
+	"modulepreload",
+	"prefetch",
+}
+
+// extractResourceURLs returns the URLs of all sub-resources referenced by
+// the document at root, in document order and without duplicates. URLs
+// are returned as written in the document, i.e. possibly relative.
+func extractResourceURLs(root *html.Node) []string {
+	var c resourceCollector
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			// the contents of templates are inert
+			if n.DataAtom == atom.Template {
+				return
+			}
+
+			if n.DataAtom == atom.Style {
+				for child := n.FirstChild; child != nil; child = child.NextSibling {
+					if child.Type == html.TextNode {
+						c.addStyleSheet(child.Data)
+					}
+				}
+			}
+			c.addElement(n.DataAtom, n.Attr)
+		}
+
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(root)
+
+	return c.urls
+}
+
+// resourceCollector collects the URLs of the sub-resources referenced by
+// a document, element by element, in document order and without
+// duplicates.
+type resourceCollector struct {
+	urls []string
+	seen map[string]struct{}
+}
+
+func (c *resourceCollector) add(u string) {
+	u = strings.TrimSpace(u)
+	if !isFetchableURL(u) {
+		return
+	}
+	if _, ok := c.seen[u]; ok {
+		return
+	}
+	if c.seen == nil {
+		c.seen = make(map[string]struct{})
+	}
+	c.seen[u] = struct{}{}
+	c.urls = append(c.urls, u)
+}
+
+// addElement adds the URLs referenced by the attributes attrs of an
+// element of type a.
+func (c *resourceCollector) addElement(a atom.Atom, attrs []html.Attribute) {
+	if a == atom.Link && linkFetchesResource(attrValue(attrs, "rel")) {
+		c.add(attrValue(attrs, "href"))
+	}
+	for _, key := range resourceAttrs[a] {
+		c.add(attrValue(attrs, key))
+	}
+	if key, ok := srcsetAttrs[a]; ok {
+		for _, u := range parseSrcset(attrValue(attrs, key)) {
+			c.add(u)
+		}
+	}
+	if style := attrValue(attrs, "style"); style != "" {
+		c.addStyleSheet(style)
+	}
+}
+
+// addStyleSheet adds the URLs referenced by the style sheet (or the
+// declarations of a style attribute) css.
+func (c *resourceCollector) addStyleSheet(css string) {
+	for _, u := range extractCSSURLs(css) {
+		c.add(u)
+	}
+}
+
+// attrValue returns the value of the attribute key in attrs,
+// or an empty string if there is no such attribute.
+func attrValue(attrs []html.Attribute, key string) string {
+	for _, attr := range attrs {
+		if attr.Namespace == "" && strings.EqualFold(attr.Key, key) {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// linkFetchesResource returns true if a link with the space-separated
+// relations rel makes the browser fetch the linked resource.
+func linkFetchesResource(rel string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		for _, fetched := range fetchedLinkRels {
+			if r == fetched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isFetchableURL returns true if u refers to a resource that is
+// fetched over the network, i.e. it is not empty, a fragment or
+// a URL with a scheme like data: whose content is inline.
+func isFetchableURL(u string) bool {
+	if u == "" || strings.HasPrefix(u, "#") {
+		return false
+	}
+	if i := strings.IndexByte(u, ':'); i > 0 {
+		switch strings.ToLower(u[:i]) {
+		case "data", "blob", "javascript", "about", "mailto", "tel":
+			return false
+		}
+	}
+	return true
+}
+
+// parseSrcset returns the URLs of the image candidates in a srcset
+// attribute, following the parsing rules of the HTML standard:
+// candidates are separated by commas, URLs may contain commas but
+// not trailing ones, and descriptors follow URLs after whitespace.
+func parseSrcset(srcset string) []string {
+	var urls []string
+	s := srcset
+	for {
+		s = strings.TrimLeft(s, " \t\n\r\f,")
+		if s == "" {
+			return urls
+		}
+
+		end := strings.IndexAny(s, " \t\n\r\f")
+		if end < 0 {
+			end = len(s)
+		}
+		u := s[:end]
+		s = s[end:]
+
+		if trimmed := strings.TrimRight(u, ","); trimmed != u {
+			// a URL that ends with commas has no descriptors
+			urls = append(urls, trimmed)
+			continue
+		}
+		urls = append(urls, u)
+
+		// skip the descriptors, which end at the first comma
+		// that is not inside parentheses
+		depth := 0
+		i := 0
+	descriptors:
+		for ; i < len(s); i++ {
+			switch s[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth > 0 {
+					depth--
+				}
+			case ',':
+				if depth == 0 {
+					break descriptors
+				}
+			}
+		}
+		s = s[i:]
+	}
+}
+
+var (
+	cssURLRegexp     = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s"']*))\s*\)`)
+	cssImportRegexp  = regexp.MustCompile(`(?i)@import\s+(?:"([^"]*)"|'([^']*)')`)
+	cssCommentRegexp = regexp.MustCompile(`/\*[\s\S]*?\*/`)
+)
+
+// extractCSSURLs returns the URLs referenced by the style sheet (or the
+// declarations of a style attribute) css, i.e. the targets of url()
+// functions and of @import rules.
+func extractCSSURLs(css string) []string {
+	css = cssCommentRegexp.ReplaceAllString(css, "")
+
+	var urls []string
+	for _, re := range []*regexp.Regexp{cssImportRegexp, cssURLRegexp} {
+		for _, m := range re.FindAllStringSubmatch(css, -1) {
+			for _, group := range m[1:] {
+				if group != "" {
+					urls = append(urls, group)
+					break
+				}
+			}
+		}
+	}
+	return urls
+}
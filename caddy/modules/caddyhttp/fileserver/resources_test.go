@@ -0,0 +1,99 @@
+package fileserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// resourcesTestDocument references all kinds of sub-resources, those in
+// resourcesTestURLs.
+const resourcesTestDocument = `<!DOCTYPE html>
+<html>
+<head>
+	<link rel="stylesheet" href="/css/site.css">
+	<link rel="canonical" href="/canonical">
+	<link rel="preload" as="image" href="/img/hero.jpg" imagesrcset="/img/hero-1x.jpg 1x, /img/hero-2x.jpg 2x">
+	<link rel="Shortcut Icon" href="/favicon.ico">
+	<script src="/js/app.js"></script>
+	<style>
+		/* url(/img/commented.png) */
+		@import "/css/print.css";
+		body { background: url('/img/bg.png') no-repeat; }
+		.logo { background-image: url(/img/logo.svg); }
+		.inline { background: url(data:image/png;base64,AAAA); }
+		.mask { mask: url(#clip); }
+	</style>
+</head>
+<body>
+	<img src="/img/a.png" srcset="/img/a-480.png 480w, /img/a-800.png 800w">
+	<picture>
+		<source srcset="/img/b.webp" type="image/webp">
+		<img src="/img/b.jpg">
+	</picture>
+	<video src="/media/clip.mp4" poster="/img/poster.jpg">
+		<source src="/media/clip.webm">
+		<track src="/media/subs.vtt">
+	</video>
+	<audio><source src="/media/sound.ogg"></audio>
+	<div style="background-image: url(&quot;/img/div.png&quot;)"></div>
+	<a href="/not-fetched.html">link</a>
+	<img src="/img/a.png">
+	<template><img src="/img/inert.png"></template>
+</body>
+</html>`
+
+var resourcesTestURLs = []string{
+	"/css/site.css",
+	"/img/hero.jpg",
+	"/img/hero-1x.jpg",
+	"/img/hero-2x.jpg",
+	"/favicon.ico",
+	"/js/app.js",
+	"/css/print.css",
+	"/img/bg.png",
+	"/img/logo.svg",
+	"/img/a.png",
+	"/img/a-480.png",
+	"/img/a-800.png",
+	"/img/b.webp",
+	"/img/b.jpg",
+	"/media/clip.mp4",
+	"/img/poster.jpg",
+	"/media/clip.webm",
+	"/media/subs.vtt",
+	"/media/sound.ogg",
+	"/img/div.png",
+}
+
+func TestExtractResourceURLs(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(resourcesTestDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := extractResourceURLs(root); !reflect.DeepEqual(actual, resourcesTestURLs) {
+		t.Errorf("expected:\n%q\ngot:\n%q", resourcesTestURLs, actual)
+	}
+}
+
+func TestParseSrcset(t *testing.T) {
+	for i, tc := range []struct {
+		input  string
+		expect []string
+	}{
+		{input: "", expect: nil},
+		{input: "a.png", expect: []string{"a.png"}},
+		{input: "a.png 1x, b.png 2x", expect: []string{"a.png", "b.png"}},
+		{input: "a.png, b.png", expect: []string{"a.png", "b.png"}},
+		{input: "a.png,b.png", expect: []string{"a.png,b.png"}},
+		{input: " a.png  480w ,\n b.png 800w ", expect: []string{"a.png", "b.png"}},
+		{input: "a,b.png 1x, c.png 2x", expect: []string{"a,b.png", "c.png"}},
+		{input: "a.png (foo, bar) 1x, b.png", expect: []string{"a.png", "b.png"}},
+	} {
+		if actual := parseSrcset(tc.input); !reflect.DeepEqual(actual, tc.expect) {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.expect, actual)
+		}
+	}
+}
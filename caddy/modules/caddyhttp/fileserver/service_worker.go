@@ -0,0 +1,46 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// serviceWorkerScript is the CacheV2 service worker. It is served
+// virtually, so it works no matter where the binary runs from and
+// does not need to be written into the site root.
+//
+//go:embed sw.js
+var serviceWorkerScript []byte
+
+// serviceWorkerEtag is the Etag of the embedded service worker.
+var serviceWorkerEtag = func() string {
+	sum := sha256.Sum256(serviceWorkerScript)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}()
+
+// serveServiceWorker writes the embedded service worker script.
+// Browsers check registered service workers for updates on their
+// own, so the script is revalidated on every use instead of being
+// cached; and since it may be served from any path, it is allowed
+// to control the whole origin.
+func serveServiceWorker(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/javascript; charset=utf-8")
+	hdr.Set("Service-Worker-Allowed", "/")
+	hdr.Set("Cache-Control", "no-cache")
+	hdr.Set("Etag", serviceWorkerEtag)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(serviceWorkerScript))
+	return nil
+}
@@ -24,13 +24,13 @@ import (
 	weakrand "math/rand"
 	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -86,6 +86,8 @@ func init() {
 // modified the last component of the path (the filename).
 //
 // This handler sets the Etag and Last-Modified headers for static files.
+// By default, the Etag is derived from the modification time and size
+// of the file; it can instead be a hash of its contents.
 // It does not perform MIME sniffing to determine Content-Type based on
 // contents, but does use the extension (if known); see the Go docs for
 // details: https://pkg.go.dev/mime#TypeByExtension
@@ -169,8 +171,17 @@ type FileServer struct {
 	// that both client and server support is used
 	PrecompressedOrder []string `json:"precompressed_order,omitempty"`
 	precompressors     map[string]encode.Precompressed
-	// The ETag store for caching ETags.
-	store *EtagStore
+
+	// Use Etags that are derived from the contents of files instead of
+	// their modification time and size. The validation tokens of the
+	// built-in CacheV2 support are computed the same way.
+	ContentEtag *ContentEtag `json:"content_etag,omitempty"`
+	digester    *contentDigester
+
+	// Settings of the built-in CacheV2 validation token scheme, which
+	// is enabled if they are given and not disabled.
+	CacheV2 *CacheV2Config `json:"cachev2,omitempty"`
+	cachev2 *cacheV2Engine
 
 	logger *zap.Logger
 }
@@ -185,7 +196,6 @@ func (FileServer) CaddyModule() caddy.ModuleInfo {
 
 // Provision sets up the static files responder.
 func (fsrv *FileServer) Provision(ctx caddy.Context) error {
-	fsrv.store = NewEtagStore()
 	fsrv.logger = ctx.Logger()
 
 	// establish which file system (possibly a virtual one) we'll be using
@@ -200,14 +210,23 @@ func (fsrv *FileServer) Provision(ctx caddy.Context) error {
 		fsrv.fileSystem = osFS{}
 	}
 
-	root := fsrv.Root
 	if fsrv.Root == "" {
 		fsrv.Root = "{http.vars.root}"
-		root = caddy.NewReplacer().ReplaceAll(fsrv.Root, ".")
 	}
-	err := loadCacheV2ServiceWorker(root)
-	if err != nil {
-		fsrv.logger.Error("failed to load service worker " + err.Error())
+	fsrv.digester = fsrv.ContentEtag.newDigester()
+	if fsrv.CacheV2 != nil && !fsrv.CacheV2.Disabled {
+		resolver := &FileResolver{Root: fsrv.Root, fileSystem: fsrv.fileSystem, digester: fsrv.digester, Watch: fsrv.CacheV2.Watch}
+		if resolver.Watch {
+			if _, ok := fsrv.fileSystem.(osFS); !ok {
+				return fmt.Errorf("cachev2: watching is only supported on the local disk file system")
+			}
+			resolver.watchers = newFileWatchers(fsrv.logger)
+		}
+		cachev2, err := provisionCacheV2Engine(ctx, *fsrv.CacheV2, resolver)
+		if err != nil {
+			return err
+		}
+		fsrv.cachev2 = cachev2
 	}
 
 	if fsrv.IndexNames == nil {
@@ -254,113 +273,37 @@ func (fsrv *FileServer) Provision(ctx caddy.Context) error {
 	return nil
 }
 
-func (fsrv *FileServer) proxyRequest(w http.ResponseWriter, r *http.Request) error {
-	targetURLStr := r.URL.Query().Get("url")
-	if targetURLStr == "" {
-		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing 'url' query parameter"))
-	}
-
-	// Basic URL validation
-	targetURL, err := url.Parse(targetURLStr)
-	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") {
-		fsrv.logger.Warn("Invalid proxy target URL", zap.String("url", targetURLStr), zap.Error(err))
-		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid 'url' query parameter: %w", err))
-	}
-
-	fsrv.logger.Debug("Proxying request for service worker", zap.String("target_url", targetURLStr))
-
-	// Create the request to the third-party server
-	proxyReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, targetURLStr, nil)
-	if err != nil {
-		fsrv.logger.Error("Failed to create proxy request", zap.String("target_url", targetURLStr), zap.Error(err))
-		// Return internal server error as this is a server-side issue
-		return caddyhttp.Error(http.StatusInternalServerError, err)
-	}
-
-	// Copy essential headers (consider adding more if needed, like Accept-Language)
-	if userAgent := r.UserAgent(); userAgent != "" {
-		proxyReq.Header.Set("User-Agent", userAgent)
-	}
-	if accept := r.Header.Get("Accept"); accept != "" {
-		proxyReq.Header.Set("Accept", accept)
-	}
-	// Avoid sending cookies or authorization from the original request to the third party
-	proxyReq.Header.Del("Cookie")
-	proxyReq.Header.Del("Authorization")
-
-	// Fallback: Always use default transport for proxy requests.
-	// Caddy-specific settings (timeouts, TLS) might not apply.
-	fsrv.logger.Warn("Creating new HTTP client with default transport for proxy request. Caddy-specific settings might not apply.")
-	client := &http.Client{Transport: http.DefaultTransport}
-
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		fsrv.logger.Error("Failed to fetch resource via proxy", zap.String("target_url", targetURLStr), zap.Error(err))
-		// Determine appropriate error code based on the error (e.g., context deadline exceeded -> 504)
-		// For simplicity, return 502 Bad Gateway for now
-		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("proxy request failed: %w", err))
+// Cleanup releases the CacheV2 token store and watchers of the file server.
+func (fsrv *FileServer) Cleanup() error {
+	if fsrv.cachev2 == nil {
+		return nil
 	}
-	defer resp.Body.Close()
-
-	fsrv.logger.Debug("Received response from proxy target",
-		zap.String("target_url", targetURLStr),
-		zap.Int("status_code", resp.StatusCode),
-		zap.String("content_type", resp.Header.Get("Content-Type")))
-
-	// Store the ETag using the *original* third-party URL as the key
-	etag := resp.Header.Get("ETag")
-	if etag != "" {
-		fsrv.store.Set(targetURLStr, etag)
+	if err := fsrv.cachev2.resolver.(*FileResolver).Cleanup(); err != nil {
+		return err
 	}
+	return fsrv.cachev2.cleanup()
+}
 
-	// Copy headers from the proxy response to our response writer.
-	// Filter hop-by-hop headers and potentially sensitive headers.
-	hdr := w.Header()
-	for k, vv := range resp.Header {
-		// Filter common hop-by-hop headers (might need a more extensive list)
-		if strings.EqualFold(k, "connection") || strings.EqualFold(k, "proxy-authenticate") ||
-			strings.EqualFold(k, "proxy-authorization") || strings.EqualFold(k, "transfer-encoding") ||
-			strings.EqualFold(k, "keep-alive") || strings.EqualFold(k, "trailer") || strings.EqualFold(k, "upgrade") {
-			continue
-		}
-		// Filter potentially sensitive headers or headers managed by Caddy
-		if strings.EqualFold(k, "set-cookie") || strings.EqualFold(k, "strict-transport-security") || strings.EqualFold(k, "server") {
-			continue
+// Validate ensures fsrv has a valid configuration.
+func (fsrv *FileServer) Validate() error {
+	if fsrv.ContentEtag != nil {
+		if err := fsrv.ContentEtag.validate(); err != nil {
+			return err
 		}
-
-		// Set the header (using Set instead of Add to avoid duplicates if key differs only by case)
-		// Important: Set overwrites, Add appends. Choose based on header semantics.
-		// For most headers, Set is appropriate. For things like Vary, Add might be needed.
-		hdr[http.CanonicalHeaderKey(k)] = vv // Use CanonicalHeaderKey for proper formatting
-	}
-	// Ensure Content-Type is set
-	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
-		hdr.Set("Content-Type", contentType)
 	}
-
-	// Write the status code from the proxy response
-	w.WriteHeader(resp.StatusCode)
-
-	// Copy the response body from the proxy response
-	copiedBytes, err := io.Copy(w, resp.Body)
-	if err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("error copying response body: %w", err))
+	if fsrv.CacheV2 != nil {
+		return fsrv.CacheV2.validate()
 	}
-
-	fsrv.logger.Info("Successfully proxied request",
-		zap.String("target_url", targetURLStr),
-		zap.Int("status_code", resp.StatusCode),
-		zap.Int64("bytes_copied", copiedBytes))
-
 	return nil
 }
 
 func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 
-	proxyPrefix := "/proxy-resource"
-	if strings.HasPrefix(r.URL.Path, proxyPrefix) {
-		return fsrv.proxyRequest(w, r)
+	if fsrv.cachev2 != nil {
+		if handled, err := fsrv.cachev2.serveOwnRoutes(w, r); handled {
+			return err
+		}
 	}
 
 	if runtime.GOOS == "windows" {
@@ -391,20 +334,13 @@ func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next c
 	// get information about the file
 	info, err := fs.Stat(fsrv.fileSystem, filename)
 	if err != nil {
-		if filename == getServiceWorkerFullPath(root) { // TODO: refactor
-			filename = getServiceWorkerRelativePath()
-			info, err = fs.Stat(fsrv.fileSystem, filename)
-		}
-		// if err persists, we'll handle it below
-		if err != nil {
-			err = fsrv.mapDirOpenError(err, filename)
-			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
-				return fsrv.notFound(w, r, next)
-			} else if errors.Is(err, fs.ErrPermission) {
-				return caddyhttp.Error(http.StatusForbidden, err)
-			}
-			return caddyhttp.Error(http.StatusInternalServerError, err)
+		err = fsrv.mapDirOpenError(err, filename)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			return fsrv.notFound(w, r, next)
+		} else if errors.Is(err, fs.ErrPermission) {
+			return caddyhttp.Error(http.StatusForbidden, err)
 		}
+		return caddyhttp.Error(http.StatusInternalServerError, err)
 	}
 
 	// if the request mapped to a directory, see if
@@ -497,8 +433,19 @@ func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next c
 	// etag is usually unset, but if the user knows what they're doing, let them override it
 	etag := w.Header().Get("Etag")
 
+	// CacheV2 rewrites HTML pages, so they are read from the file itself
+	// rather than from a precompressed sidecar, and compressed after
+	// rewriting; a cachev2 handler before the file server takes over
+	_, handled := r.Context().Value(rewriterCtxKey).(*cacheV2Engine)
+	cachev2 := fsrv.cachev2 != nil && !handled
+	rewriteHTML := cachev2 && strings.HasSuffix(info.Name(), ".html") && fsrv.cachev2.enabledFor(r)
+	var sidecarEncodings []string
+	if !rewriteHTML {
+		sidecarEncodings = encode.AcceptedEncodings(r, fsrv.PrecompressedOrder)
+	}
+
 	// check for precompressed files
-	for _, ae := range encode.AcceptedEncodings(r, fsrv.PrecompressedOrder) {
+	for _, ae := range sidecarEncodings {
 		precompress, ok := fsrv.precompressors[ae]
 		if !ok {
 			continue
@@ -527,8 +474,13 @@ func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next c
 		// don't assign info = compressedInfo because sidecars are kind
 		// of transparent; however we do need to set the Etag:
 		// https://caddy.community/t/gzipped-sidecar-file-wrong-same-etag/16793
-		if etag == "" {
-			etag = calculateEtag(compressedInfo)
+		// With CacheV2, manifests hold the token of the file itself, so the
+		// etag of the sidecar is derived from it like for rewritten pages,
+		// which the service worker recognizes
+		if etag == "" && (fsrv.cachev2 != nil || handled) {
+			etag = encodedEtag(fileEtag(fsrv.fileSystem, filename, info, fsrv.digester), ae)
+		} else if etag == "" {
+			etag = fileEtag(fsrv.fileSystem, compressedFilename, compressedInfo, fsrv.digester)
 		}
 
 		break
@@ -550,7 +502,7 @@ func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next c
 		defer file.Close()
 
 		if etag == "" {
-			etag = calculateEtag(info)
+			etag = fileEtag(fsrv.fileSystem, filename, info, fsrv.digester)
 		}
 	}
 
@@ -606,50 +558,91 @@ func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next c
 		}
 	}
 
-	// if we do have an override from the previous two parts, then
-	// we wrap the response writer to intercept the WriteHeader call
-	if statusCodeOverride > 0 {
-		w = statusOverrideResponseWriter{ResponseWriter: w, code: statusCodeOverride}
-	}
-
 	content := file.(io.ReadSeeker)
+	modTime := info.ModTime()
 
-	// read and modify html file before serving by http library
-	extensionEnabled := r.Header.Get("X-CacheV2-Extension-Enabled") == "true"
-	if strings.HasSuffix(info.Name(), ".html") && extensionEnabled {
-		b := new(bytes.Buffer)
-		_, err = b.ReadFrom(content)
-		if err == nil {
-			newContent, etags, err := getEtagJsonAndRegisterServiceWorker(
-				fsrv.fileSystem,
-				root+r.RequestURI,
-				b,
-			)
+	// read and modify html file before serving by http library; the
+	// rewritten page has its own etag, and no modification time since
+	// its manifest changes with other files
+	if cachev2 {
+		fsrv.cachev2.varyHTML(w.Header())
+	}
+	if rewriteHTML && statusCodeOverride == 0 {
+		fsrv.cachev2.sendEarlyHints(w, r)
+	}
+	if rewriteHTML && fsrv.cachev2.streams(info.Size()) {
+		if statusCodeOverride > 0 {
+			w = statusOverrideResponseWriter{ResponseWriter: w, code: statusCodeOverride}
+		}
+		if err := fsrv.cachev2.rewriteStream(w, r, etag, content); err != nil {
+			fsrv.logger.Warn("failed to stream html for cachev2", zap.Error(err))
+		}
+		return nil
+	}
+	if rewriteHTML {
+		newContent, newEtag, err := fsrv.cachev2.rewrite(w, r, etag, func() ([]byte, error) { return io.ReadAll(content) })
+		if err != nil {
+			// the original page is served instead, from its start
+			fsrv.logger.Warn("failed to rewrite html for cachev2", zap.String("filename", filename), zap.Error(err))
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				return caddyhttp.Error(http.StatusInternalServerError, err)
+			}
+		} else {
+			w.Header().Set("Etag", newEtag)
+			modTime = time.Time{}
+			newContent, err = fsrv.encodeRewritten(w, r, newContent)
 			if err != nil {
-				fsrv.logger.Warn("failed to inject last-modified attr.", zap.Error(err))
-			} else {
-				content = bytes.NewReader([]byte(newContent))
-
-				mergedEtags, err := fsrv.store.MergeJSON(etags)
-				if err != nil {
-					fsrv.logger.Warn("failed to merge etags", zap.Error(err))
-					w.Header().Set("X-Etag-Config", etags)
-				} else {
-					w.Header().Set("X-Etag-Config", string(mergedEtags))
-				}
+				return caddyhttp.Error(http.StatusInternalServerError, err)
 			}
+			content = bytes.NewReader(newContent)
 		}
 	}
 
+	// if we do have an override from the previous two parts, then
+	// we wrap the response writer to intercept the WriteHeader call
+	if statusCodeOverride > 0 {
+		w = statusOverrideResponseWriter{ResponseWriter: w, code: statusCodeOverride}
+	}
+
 	// let the standard library do what it does best; note, however,
 	// that errors generated by ServeContent are written immediately
 	// to the response, so we cannot handle them (but errors there
 	// are rare)
-	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+	http.ServeContent(w, r, info.Name(), modTime, content)
 
 	return nil
 }
 
+// encodeRewritten compresses the content of a page that CacheV2 rewrote
+// with the first encoding which the client accepts and one of the
+// precompressors can encode with, if any, and returns the result. Pages
+// are only compressed if precompressed files are enabled, since the
+// sidecars cannot be used for them; otherwise they are left to the
+// encode handler.
+func (fsrv *FileServer) encodeRewritten(w http.ResponseWriter, r *http.Request, content []byte) ([]byte, error) {
+	if len(fsrv.precompressors) == 0 {
+		return content, nil
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	for _, ae := range encode.AcceptedEncodings(r, fsrv.PrecompressedOrder) {
+		enc, ok := fsrv.precompressors[ae].(encode.Encoding)
+		if !ok {
+			continue
+		}
+		encoded, err := fsrv.cachev2.encodeContent(enc, content)
+		if err != nil {
+			return nil, err
+		}
+		w.Header().Set("Content-Encoding", ae)
+		w.Header().Del("Accept-Ranges")
+		if etag := w.Header().Get("Etag"); etag != "" {
+			w.Header().Set("Etag", encodedEtag(etag, ae))
+		}
+		return encoded, nil
+	}
+	return content, nil
+}
+
 // openFile opens the file at the given filename. If there was an error,
 // the response is configured to inform the client how to best handle it
 // and a well-described handler error is returned (do not wrap the
@@ -850,6 +843,8 @@ const (
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*FileServer)(nil)
+	_ caddy.Validator             = (*FileServer)(nil)
+	_ caddy.CleanerUpper          = (*FileServer)(nil)
 	_ caddyhttp.MiddlewareHandler = (*FileServer)(nil)
 
 	_ fs.StatFS     = (*osFS)(nil)
@@ -1,71 +1,709 @@
 package fileserver
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
+	weakrand "math/rand"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// EtagStoreOptions configures the size of an EtagStore and how it
+// refreshes its tokens. Zero values select the defaults.
+type EtagStoreOptions struct {
+	// How often the tokens are refreshed. Default: 10m.
+	Interval time.Duration
+
+	// The maximum number of tokens in the store. Beyond it, the
+	// least recently used tokens are evicted. Default: 10000.
+	MaxEntries int
+
+	// How long a token is kept after it was last set. Refreshes
+	// do not extend it, so tokens of resources which clients no
+	// longer ask for eventually expire. Default: 24h.
+	TTL time.Duration
+
+	// The maximum number of concurrent refresh requests. Default: 8.
+	Workers int
+
+	// The maximum number of concurrent refresh requests
+	// to the same host. Default: 2.
+	PerHost int
+
+	// The transport with which refresh requests are sent.
+	// Default: http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// The name of the store in metrics. Optional.
+	Name string
+}
+
+// EtagStore holds the validation tokens of cross-origin resources
+// by URL, and periodically revalidates them with their origins.
 type EtagStore struct {
-	store    map[string]string
-	interval time.Duration
-	rw       sync.RWMutex
+	opts    EtagStoreOptions
+	entries map[string]*list.Element
+	lru     *list.List // of *etagEntry, most recently used first
+	mu      sync.Mutex
+
+	// changes counts the modifications of the store,
+	// so that unchanged stores need not be saved
+	changes uint64
+
+	// the tokens that were deleted since the store was last saved,
+	// or all, so that merging does not bring them back
+	deleted    map[string]bool
+	deletedAll bool
+
+	// the listeners to changes of tokens, and the changes which are
+	// yet to be reported to them
+	listeners []*func(tokenEvent)
+	pending   []tokenEvent
+
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// requests a refresh before the next interval
+	trigger chan struct{}
+}
+
+// etagEntry is the token of a URL in an EtagStore.
+type etagEntry struct {
+	key     string
+	etag    string
+	expires time.Time
+
+	// the Last-Modified date of the resource, for conditional requests
+	lastModified string
+
+	// when the origin last confirmed the token; zero for
+	// tokens this instance did not learn from the origin
+	validated time.Time
+
+	// whether the origin rejected HEAD requests for the resource
+	headRejected bool
+
+	// the number of consecutive failed refreshes
+	failures int
+
+	// whether the origin answered the last refresh with 404 or 410; the
+	// token is not handed out until a refresh confirms it again, while
+	// it is after transient failures
+	stale bool
 }
 
-func NewEtagStore() *EtagStore {
+// usable returns true if the token of e may be handed out at now.
+func (e *etagEntry) usable(now time.Time) bool {
+	return !e.stale && !now.After(e.expires)
+}
+
+// storedToken is the serialized form of an etagEntry in snapshots.
+type storedToken struct {
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+// maxRefreshFailures is the number of consecutive failed refreshes
+// after which a token is removed from the store.
+const maxRefreshFailures = 3
+
+// headerToken returns the validation token in the response header hdr,
+// which is its Etag or, for origins which do not send one, its
+// Last-Modified date. It returns an empty string if there is neither.
+func headerToken(hdr http.Header) string {
+	if etag := hdr.Get("Etag"); etag != "" {
+		return etag
+	}
+	return hdr.Get("Last-Modified")
+}
+
+// NewEtagStore returns a new store which refreshes its tokens until
+// it is stopped.
+func NewEtagStore(opts EtagStoreOptions) *EtagStore {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Minute
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 10000
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 8
+	}
+	if opts.PerHost <= 0 {
+		opts.PerHost = 2
+	}
+
+	cacheV2Metrics.init.Do(initCacheV2Metrics)
+
 	s := &EtagStore{
-		store:    make(map[string]string),
-		interval: 10 * time.Minute,
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		client:  &http.Client{Transport: opts.Transport, Timeout: 10 * time.Second},
+		trigger: make(chan struct{}, 1),
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.wg.Add(1)
 	go s.sync()
 
 	return s
 }
 
-func (s *EtagStore) fetch(key string) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodHead, key, nil)
-	if err != nil {
+// Stop stops refreshing the tokens in the store and waits
+// for pending refreshes to finish.
+func (s *EtagStore) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// revalidate refreshes the token of key with a conditional HEAD request,
+// or a conditional GET of a single byte if the origin rejects HEAD.
+func (s *EtagStore) revalidate(key string) {
+	s.mu.Lock()
+	elem, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
 		return
 	}
-	resp, err := client.Do(req)
+	entry := *elem.Value.(*etagEntry)
+	s.mu.Unlock()
+
+	headRejected := entry.headRejected
+	method := http.MethodHead
+	if headRejected {
+		method = http.MethodGet
+	}
+	resp, err := s.conditionalRequest(method, &entry)
+	if err == nil && method == http.MethodHead &&
+		(resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		headRejected = true
+		resp, err = s.conditionalRequest(http.MethodGet, &entry)
+	}
 	if err != nil {
+		// requests canceled because the store stopped did not fail
+		if s.ctx.Err() == nil {
+			cacheV2Metrics.refreshes.WithLabelValues(s.opts.Name, "error").Inc()
+			s.refreshFailed(key, false)
+		}
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK && resp.Header.Get("Etag") != "" {
-		s.rw.Lock()
-		defer s.rw.Unlock()
-		s.store[key] = resp.Header.Get("Etag")
+	resp.Body.Close()
+	cacheV2Metrics.refreshes.WithLabelValues(s.opts.Name, strconv.Itoa(resp.StatusCode)).Inc()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		s.refreshed(key, entry.etag, entry.lastModified, headRejected)
+	case http.StatusOK, http.StatusPartialContent:
+		if token := headerToken(resp.Header); token != "" {
+			s.refreshed(key, token, resp.Header.Get("Last-Modified"), headRejected)
+		} else {
+			s.refreshFailed(key, false)
+		}
+	case http.StatusNotFound, http.StatusGone:
+		s.refreshFailed(key, true)
+	default:
+		// including server errors, which may be transient
+		s.refreshFailed(key, false)
+	}
+}
+
+// conditionalRequest requests the resource of entry with method, asking
+// the origin to answer with 304 Not Modified if its token still matches.
+// GET requests ask for the first byte only.
+func (s *EtagStore) conditionalRequest(method string, entry *etagEntry) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(s.ctx, method, entry.key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(entry.etag, `"`) || strings.HasPrefix(entry.etag, `W/"`) {
+		req.Header.Set("If-None-Match", entry.etag)
 	}
+	if entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	return s.client.Do(req)
 }
 
+// sync refreshes the tokens every interval, varied by a random jitter
+// so that the instances of a cluster do not refresh in lockstep.
 func (s *EtagStore) sync() {
-	ticker := time.NewTicker(s.interval)
-	defer ticker.Stop()
-	for range ticker.C {
-		s.rw.RLock()
-		for key := range s.store {
-			go s.fetch(key)
+	defer s.wg.Done()
+	timer := time.NewTimer(jitter(s.opts.Interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-s.ctx.Done():
+			return
+		}
+		s.refresh()
+		timer.Reset(jitter(s.opts.Interval))
+	}
+}
+
+// refreshSoon makes the store refresh its tokens as soon as the current
+// refresh, if any, is done. Requests made meanwhile are coalesced into
+// a single refresh.
+func (s *EtagStore) refreshSoon() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// refresh revalidates the tokens of all unexpired entries with a bounded
+// number of workers, and no more concurrent requests per host than
+// allowed. The keys of a host with as many requests in flight as allowed
+// wait in its queue while those of other hosts are dispatched, so that a
+// slow host does not hold up the others. It returns when all fetches are
+// done or the store is stopped.
+func (s *EtagStore) refresh() {
+	work := make(chan string)
+	done := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < s.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				s.revalidate(key)
+				select {
+				case done <- keyHost(key):
+				case <-s.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	queues := s.refreshQueues()
+	inFlight := make(map[string]int)
+	var running, next int
+dispatch:
+	for len(queues) > 0 || running > 0 {
+		// offer the next key of the first host in turn which may take
+		// another request, if any, to an idle worker
+		var send chan string
+		var key string
+		var q int
+		for i := range queues {
+			q = (next + i) % len(queues)
+			if inFlight[queues[q].host] < s.opts.PerHost {
+				send, key = work, queues[q].keys[0]
+				break
+			}
+		}
+		select {
+		case send <- key:
+			inFlight[queues[q].host]++
+			running++
+			next = q + 1
+			if queues[q].keys = queues[q].keys[1:]; len(queues[q].keys) == 0 {
+				queues = append(queues[:q], queues[q+1:]...)
+				next = q
+			}
+		case host := <-done:
+			inFlight[host]--
+			running--
+		case <-s.ctx.Done():
+			break dispatch
 		}
-		s.rw.RUnlock()
 	}
+	close(work)
+	wg.Wait()
+}
+
+// hostQueue holds the keys of a host which are still to be refreshed.
+type hostQueue struct {
+	host string
+	keys []string
+}
+
+// refreshQueues removes the expired entries and returns the keys of the
+// others, including stale ones which may recover, queued by host.
+func (s *EtagStore) refreshQueues() []hostQueue {
+	defer s.notify()
+	s.mu.Lock()
+	s.removeExpired(time.Now())
+	byHost := make(map[string][]string)
+	for key := range s.entries {
+		host := keyHost(key)
+		byHost[host] = append(byHost[host], key)
+	}
+	s.mu.Unlock()
+
+	queues := make([]hostQueue, 0, len(byHost))
+	for host, keys := range byHost {
+		queues = append(queues, hostQueue{host: host, keys: keys})
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].host < queues[j].host })
+	return queues
+}
+
+// keyHost returns the host of the URL key, or an empty
+// string if it is not a valid URL.
+func keyHost(key string) string {
+	u, err := url.Parse(key)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// jitter returns d varied randomly by up to 10% in either direction.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 5)
+	if spread <= 0 {
+		return d
+	}
+	//nolint:gosec
+	return d - d/10 + time.Duration(weakrand.Int63n(spread))
 }
 
+// Set sets the token of key, marks it as most recently
+// used and renews its expiry.
 func (s *EtagStore) Set(key string, etag string) {
+	s.set(key, etag, "", time.Time{}, sourceAPI)
+}
+
+// setFromHeader sets the token of key to the one in the
+// response header hdr, if there is one.
+func (s *EtagStore) setFromHeader(key string, hdr http.Header) {
+	s.set(key, headerToken(hdr), hdr.Get("Last-Modified"), time.Now(), sourceOrigin)
+}
+
+// set sets the token of key like Set, and reports changes as coming
+// from source.
+func (s *EtagStore) set(key, etag, lastModified string, validated time.Time, source string) {
 	if etag == "" {
 		return
 	}
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.store[key] = etag
+	defer s.notify()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(s.opts.TTL)
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*etagEntry)
+		if entry.etag != etag {
+			cacheV2Metrics.tokenChanges.WithLabelValues(s.opts.Name, source).Inc()
+			s.record(tokenEvent{name: eventTokenChanged, url: key, oldEtag: entry.etag, etag: etag, source: source})
+		}
+		if entry.etag != etag || entry.stale {
+			entry.etag = etag
+			entry.stale = false
+			entry.validated = time.Time{}
+			s.changes++
+		}
+		entry.failures = 0
+		if !validated.IsZero() {
+			entry.validated = validated
+		}
+		entry.lastModified = lastModified
+		entry.expires = expires
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&etagEntry{
+		key:          key,
+		etag:         etag,
+		lastModified: lastModified,
+		expires:      expires,
+		validated:    validated,
+	})
+	s.changes++
+	s.record(tokenEvent{name: eventTokenAdded, url: key, etag: etag, source: source})
+	for s.lru.Len() > s.opts.MaxEntries {
+		s.remove(s.lru.Back(), "evicted")
+	}
+}
+
+// refreshed updates the validators of key after a successful refresh,
+// if it is still in the store. Unlike Set, it does not count as a use.
+func (s *EtagStore) refreshed(key, etag, lastModified string, headRejected bool) {
+	defer s.notify()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*etagEntry)
+	if entry.etag != etag {
+		cacheV2Metrics.tokenChanges.WithLabelValues(s.opts.Name, sourceRefresh).Inc()
+		s.record(tokenEvent{name: eventTokenChanged, url: key, oldEtag: entry.etag, etag: etag, source: sourceRefresh})
+	}
+	if entry.etag != etag || entry.stale {
+		entry.etag = etag
+		entry.stale = false
+		s.changes++
+	}
+	entry.failures = 0
+	entry.lastModified = lastModified
+	entry.headRejected = headRejected
+	entry.validated = time.Now()
+}
+
+// refreshFailed counts a failed refresh of the token of key, and removes
+// it after repeated failures. If gone, the origin no longer has the
+// resource and the token is stale until a refresh confirms it again;
+// otherwise the failure may be transient and the token stays usable.
+func (s *EtagStore) refreshFailed(key string, gone bool) {
+	defer s.notify()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*etagEntry)
+	entry.failures++
+	if entry.failures >= maxRefreshFailures {
+		s.remove(elem, "failed")
+		return
+	}
+	if gone && !entry.stale {
+		entry.stale = true
+		s.changes++
+	}
+}
+
+// Get returns the token of key, if it is in the store and not expired.
+func (s *EtagStore) Get(key string) (string, bool) {
+	defer s.notify()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*etagEntry)
+	if time.Now().After(entry.expires) {
+		s.remove(elem, "expired")
+		return "", false
+	}
+	if entry.stale {
+		return "", false
+	}
+	s.lru.MoveToFront(elem)
+	return entry.etag, true
+}
+
+// has returns true if the store has a token for key, even an
+// expired or stale one. Unlike Get, it does not count as a use.
+func (s *EtagStore) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.entries[key]
+	return ok
+}
+
+// validation returns the usable token of key and when the origin last
+// confirmed it, which is zero if this instance did not learn it from
+// the origin. Unlike Get, it does not count as a use.
+func (s *EtagStore) validation(key string) (etag string, validated time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	entry := elem.Value.(*etagEntry)
+	if !entry.usable(time.Now()) {
+		return "", time.Time{}, false
+	}
+	return entry.etag, entry.validated, true
+}
+
+// Len returns the number of tokens in the store.
+func (s *EtagStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// remove removes the entry elem for the given reason. The caller must
+// hold the lock.
+func (s *EtagStore) remove(elem *list.Element, reason string) {
+	entry := elem.Value.(*etagEntry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.key)
+	s.changes++
+	s.record(tokenEvent{name: eventTokenRemoved, url: entry.key, etag: entry.etag, reason: reason})
+}
+
+// removeExpired removes the entries which expired before now.
+// The caller must hold the lock.
+func (s *EtagStore) removeExpired(now time.Time) {
+	for elem := s.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if now.After(elem.Value.(*etagEntry).expires) {
+			s.remove(elem, "expired")
+		}
+		elem = next
+	}
+}
+
+// tokens returns the unexpired tokens by key.
+func (s *EtagStore) tokens() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	m := make(map[string]string, len(s.entries))
+	for key, elem := range s.entries {
+		if entry := elem.Value.(*etagEntry); entry.usable(now) {
+			m[key] = entry.etag
+		}
+	}
+	return m
+}
+
+// tokenStatus describes the token of a URL in an EtagStore.
+type tokenStatus struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Expires      time.Time `json:"expires"`
+
+	// when the origin last confirmed the token, if it did
+	Validated *time.Time `json:"validated,omitempty"`
+
+	// the number of consecutive failed refreshes
+	Failures int `json:"failures,omitempty"`
+
+	// `validated` if the origin confirmed the token, `unvalidated` if
+	// it was set by a page or another instance, `stale` if the origin
+	// answered the last refresh with 404 or 410, or `expired`
+	Status string `json:"status"`
+}
+
+func (e *etagEntry) status(now time.Time) tokenStatus {
+	ts := tokenStatus{
+		URL:          e.key,
+		ETag:         e.etag,
+		LastModified: e.lastModified,
+		Expires:      e.expires,
+		Failures:     e.failures,
+	}
+	if !e.validated.IsZero() {
+		validated := e.validated
+		ts.Validated = &validated
+	}
+	switch {
+	case now.After(e.expires):
+		ts.Status = "expired"
+	case e.stale:
+		ts.Status = "stale"
+	case ts.Validated != nil:
+		ts.Status = "validated"
+	default:
+		ts.Status = "unvalidated"
+	}
+	return ts
+}
+
+// statuses returns the status of all tokens in the store, by URL.
+// Unlike Get, it does not count as a use.
+func (s *EtagStore) statuses() []tokenStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	statuses := make([]tokenStatus, 0, len(s.entries))
+	for _, elem := range s.entries {
+		statuses = append(statuses, elem.Value.(*etagEntry).status(now))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].URL < statuses[j].URL })
+	return statuses
+}
+
+// status returns the status of the token of key, if it is in the store.
+// Unlike Get, it does not count as a use.
+func (s *EtagStore) status(key string) (tokenStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return tokenStatus{}, false
+	}
+	return elem.Value.(*etagEntry).status(time.Now()), true
+}
+
+// Delete removes the token of key from the store. It returns
+// false if there was none.
+func (s *EtagStore) Delete(key string) bool {
+	defer s.notify()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	s.remove(elem, "deleted")
+	if s.deleted == nil {
+		s.deleted = make(map[string]bool)
+	}
+	s.deleted[key] = true
+	return true
+}
+
+// Clear removes all tokens from the store.
+func (s *EtagStore) Clear() {
+	defer s.notify()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*etagEntry)
+		s.record(tokenEvent{name: eventTokenRemoved, url: entry.key, etag: entry.etag, reason: "deleted"})
+	}
+	s.entries = make(map[string]*list.Element)
+	s.lru.Init()
+	s.changes++
+	s.deleted = nil
+	s.deletedAll = true
+}
+
+// changeCount returns the number of changes of the store so far.
+func (s *EtagStore) changeCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changes
+}
+
+// forgetDeleted forgets the deleted tokens once a snapshot which reflects
+// the given number of changes was saved, unless the store changed since.
+func (s *EtagStore) forgetDeleted(changes uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changes == changes {
+		s.deleted = nil
+		s.deletedAll = false
+	}
 }
 
 func (s *EtagStore) MarshalJSON() ([]byte, error) {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	return json.Marshal(s.store)
+	return json.Marshal(s.tokens())
 }
 
 func (s *EtagStore) UnmarshalJSON(data []byte) error {
@@ -73,22 +711,48 @@ func (s *EtagStore) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &store); err != nil {
 		return err
 	}
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.store = store
+	s.mu.Lock()
+	s.entries = make(map[string]*list.Element)
+	s.lru.Init()
+	s.changes++
+	s.mu.Unlock()
+	for k, v := range store {
+		s.Set(k, v)
+	}
 	return nil
 }
 
-func (s *EtagStore) MergeJSON(o string) ([]byte, error) {
-	var other map[string]string
-
-	if err := json.Unmarshal([]byte(o), &other); err != nil {
-		return nil, err
+// merge adds the unexpired tokens in other for URLs the store does not
+// know yet, as long as there is room for them. Tokens in the store are
+// kept, as they are at least as recent, and deleted tokens are not
+// added again.
+func (s *EtagStore) merge(other map[string]storedToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, v := range other {
+		if s.lru.Len() >= s.opts.MaxEntries {
+			return
+		}
+		if _, ok := s.entries[k]; ok || v.ETag == "" || now.After(v.Expires) || s.deletedAll || s.deleted[k] {
+			continue
+		}
+		// merged tokens have not been used here yet
+		s.entries[k] = s.lru.PushBack(&etagEntry{key: k, etag: v.ETag, lastModified: v.LastModified, expires: v.Expires})
 	}
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	for k, v := range s.store {
-		other[k] = v
+}
+
+// snapshot returns a copy of the unexpired entries in the store and the
+// number of changes it reflects.
+func (s *EtagStore) snapshot() (map[string]storedToken, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	m := make(map[string]storedToken, len(s.entries))
+	for key, elem := range s.entries {
+		if entry := elem.Value.(*etagEntry); entry.usable(now) {
+			m[key] = storedToken{ETag: entry.etag, LastModified: entry.lastModified, Expires: entry.expires}
+		}
 	}
-	return json.Marshal(other)
+	return m, s.changes
 }
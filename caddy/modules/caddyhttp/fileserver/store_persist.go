@@ -0,0 +1,188 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// etagStores holds the stores of cross-origin validation tokens by name,
+// so that handlers with the same store name share one store, and the
+// tokens it learned survive config reloads.
+var etagStores = caddy.NewUsagePool()
+
+// persistedEtagStore is an EtagStore which is loaded from a storage
+// when it is created, and periodically merged with and saved to it.
+// Instances of a cluster that use the same storage thereby converge
+// on the same tokens, and restarts do not lose them.
+type persistedEtagStore struct {
+	*EtagStore
+	storage certmagic.Storage
+	key     string
+	logger  *zap.Logger
+
+	saved uint64 // the number of changes of the last save
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// loadEtagStore returns the store of tokens named in cfg, creating it and
+// loading its last snapshot from storage if no handler uses it yet. A new
+// store refreshes its tokens with transport. The store must be released
+// with etagStores.Delete(cfg.StoreName) when it is no longer needed.
+func loadEtagStore(storage certmagic.Storage, cfg CacheV2Config, transport http.RoundTripper, logger *zap.Logger) (*EtagStore, error) {
+	val, loaded, err := etagStores.LoadOrNew(cfg.StoreName, func() (caddy.Destructor, error) {
+		opts := cfg.storeOptions()
+		opts.Transport = transport
+		s := &persistedEtagStore{
+			EtagStore: NewEtagStore(opts),
+			storage:   storage,
+			key:       etagStoreKey(cfg.StoreName),
+			logger:    logger,
+			stop:      make(chan struct{}),
+			done:      make(chan struct{}),
+		}
+		if cfg.DisablePersistence {
+			s.storage = nil
+			close(s.done)
+			return s, nil
+		}
+
+		if err := s.load(); err != nil {
+			// the tokens will be learned again, so this is not fatal
+			logger.Error("loading cachev2 token snapshot",
+				zap.String("key", s.key),
+				zap.Error(err))
+		}
+		go s.snapshots(time.Duration(cfg.SnapshotInterval))
+		return s, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if loaded {
+		logger.Debug("using existing cachev2 token store", zap.String("store", cfg.StoreName))
+	}
+	return val.(*persistedEtagStore).EtagStore, nil
+}
+
+// etagStoreKey returns the storage key of the snapshot of the named store.
+func etagStoreKey(name string) string {
+	return path.Join("cachev2", certmagic.StorageKeys.Safe(name), "etags.json")
+}
+
+// load fills the store with the tokens in its snapshot.
+func (s *persistedEtagStore) load() error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	if err := s.pull(ctx); err != nil {
+		return err
+	}
+	_, s.saved = s.snapshot()
+	return nil
+}
+
+// pull merges the store with its snapshot, if there is one.
+func (s *persistedEtagStore) pull(ctx context.Context) error {
+	data, err := s.storage.Load(ctx, s.key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var tokens map[string]storedToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	s.merge(tokens)
+	return nil
+}
+
+// save merges the store with its snapshot, which other instances may
+// have updated, and writes the result back if the store has changed
+// since it was saved last. The snapshot is only locked in that case,
+// so that idle stores do not lock the storage every interval.
+func (s *persistedEtagStore) save() error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	if s.changeCount() == s.saved {
+		return s.pull(ctx)
+	}
+
+	if err := s.storage.Lock(ctx, s.key); err != nil {
+		return fmt.Errorf("locking snapshot: %v", err)
+	}
+	defer func() {
+		if err := s.storage.Unlock(context.Background(), s.key); err != nil {
+			s.logger.Error("unlocking cachev2 token snapshot", zap.String("key", s.key), zap.Error(err))
+		}
+	}()
+
+	if err := s.pull(ctx); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+			return err
+		}
+		s.logger.Warn("overwriting invalid cachev2 token snapshot", zap.String("key", s.key), zap.Error(err))
+	}
+
+	tokens, changes := s.snapshot()
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.Store(ctx, s.key, data); err != nil {
+		return err
+	}
+	s.saved = changes
+	s.forgetDeleted(changes)
+	return nil
+}
+
+// snapshots saves the store every interval until it is destructed.
+func (s *persistedEtagStore) snapshots(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				s.logger.Error("saving cachev2 token snapshot", zap.String("key", s.key), zap.Error(err))
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Destruct stops the store and saves its final snapshot.
+func (s *persistedEtagStore) Destruct() error {
+	s.EtagStore.Stop()
+	close(s.stop)
+	<-s.done
+	if s.storage == nil {
+		return nil
+	}
+	return s.save()
+}
+
+// snapshotTimeout bounds the time a snapshot may take to load or save.
+const snapshotTimeout = 30 * time.Second
+
+// Interface guards
+var _ caddy.Destructor = (*persistedEtagStore)(nil)
@@ -0,0 +1,124 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestPersistedEtagStore(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	cfg := CacheV2Config{StoreName: "persist-test"}
+	cfg.provision()
+
+	first, err := loadEtagStore(storage, cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Set("https://cdn.example.com/a.js", `"a"`)
+
+	// a second handler with the same name shares the store
+	second, err := loadEtagStore(storage, cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Fatal("expected handlers with the same store name to share the store")
+	}
+
+	// another instance of the cluster adds a token to the snapshot
+	peer := map[string]storedToken{
+		"https://cdn.example.com/b.css":   {ETag: `"b"`, Expires: time.Now().Add(time.Hour)},
+		"https://cdn.example.com/old.css": {ETag: `"old"`, Expires: time.Now().Add(-time.Hour)},
+	}
+	data, err := json.Marshal(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(context.Background(), etagStoreKey(cfg.StoreName), data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store is saved when the last handler releases it
+	for i := 0; i < 2; i++ {
+		if _, err := etagStores.Delete(cfg.StoreName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted, err := loadEtagStore(storage, cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer etagStores.Delete(cfg.StoreName)
+	if restarted == first {
+		t.Fatal("expected a new store after the last handler released it")
+	}
+	for key, expect := range map[string]string{
+		"https://cdn.example.com/a.js":  `"a"`,
+		"https://cdn.example.com/b.css": `"b"`,
+	} {
+		if etag, _ := restarted.Get(key); etag != expect {
+			t.Errorf("expected %s to be loaded with %s, got %q", key, expect, etag)
+		}
+	}
+	if _, ok := restarted.Get("https://cdn.example.com/old.css"); ok {
+		t.Error("expected expired token not to be loaded")
+	}
+}
+
+// lockCountingStorage counts the locks taken on a storage.
+type lockCountingStorage struct {
+	certmagic.Storage
+	locks int
+}
+
+func (s *lockCountingStorage) Lock(ctx context.Context, name string) error {
+	s.locks++
+	return s.Storage.Lock(ctx, name)
+}
+
+func TestPersistedEtagStoreSavesChanges(t *testing.T) {
+	storage := &lockCountingStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	s := &persistedEtagStore{
+		EtagStore: NewEtagStore(EtagStoreOptions{}),
+		storage:   storage,
+		key:       etagStoreKey("save-test"),
+		logger:    zap.NewNop(),
+	}
+	defer s.Stop()
+
+	// unchanged stores only pick up the snapshot
+	data, err := json.Marshal(map[string]storedToken{
+		"https://cdn.example.com/b.css": {ETag: `"b"`, Expires: time.Now().Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(context.Background(), s.key, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	if storage.locks != 0 {
+		t.Errorf("expected no lock for an unchanged store, got %d", storage.locks)
+	}
+	if etag, _ := s.Get("https://cdn.example.com/b.css"); etag != `"b"` {
+		t.Errorf("expected the token of the snapshot, got %q", etag)
+	}
+
+	s.Set("https://cdn.example.com/a.js", `"a"`)
+	for i := 0; i < 2; i++ {
+		if err := s.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if storage.locks != 1 {
+		t.Errorf("expected one lock for one change, got %d", storage.locks)
+	}
+}
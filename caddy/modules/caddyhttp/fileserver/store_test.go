@@ -0,0 +1,276 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEtagStoreEviction(t *testing.T) {
+	s := NewEtagStore(EtagStoreOptions{Interval: time.Hour, MaxEntries: 2, TTL: 50 * time.Millisecond})
+	defer s.Stop()
+
+	s.Set("https://a.example/1", `"1"`)
+	s.Set("https://a.example/2", `"2"`)
+	s.Get("https://a.example/1") // makes 2 the least recently used
+	s.Set("https://a.example/3", `"3"`)
+
+	if _, ok := s.Get("https://a.example/2"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	for _, key := range []string{"https://a.example/1", "https://a.example/3"} {
+		if _, ok := s.Get(key); !ok {
+			t.Errorf("expected %s to be kept", key)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := s.Get("https://a.example/1"); ok {
+		t.Error("expected entry to expire after its TTL")
+	}
+	if tokens := s.tokens(); len(tokens) != 0 {
+		t.Errorf("expected no unexpired tokens, got %v", tokens)
+	}
+}
+
+func TestEtagStoreRefresh(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		requests.Add(1)
+		w.Header().Set("Etag", `"new"`)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	s := NewEtagStore(EtagStoreOptions{Interval: time.Hour, Workers: 4, PerHost: 2})
+	for i := 0; i < 10; i++ {
+		s.Set(fmt.Sprintf("%s/%d", srv.URL, i), `"old"`)
+	}
+	s.refresh()
+	s.Stop()
+
+	if n := requests.Load(); n != 10 {
+		t.Errorf("expected 10 refresh requests, got %d", n)
+	}
+	if maxInFlight > 2 {
+		t.Errorf("expected at most 2 concurrent requests to the host, got %d", maxInFlight)
+	}
+	if etag, _ := s.Get(srv.URL + "/0"); etag != `"new"` {
+		t.Errorf("expected refreshed token, got %s", etag)
+	}
+
+	// a stopped store does not refresh anymore
+	s.refresh()
+	if n := requests.Load(); n != 10 {
+		t.Errorf("expected no requests after stop, got %d", n-10)
+	}
+}
+
+func TestEtagStoreRefreshSlowHost(t *testing.T) {
+	var once sync.Once
+	release := make(chan struct{})
+	unblock := func() { once.Do(func() { close(release) }) }
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Etag", `"new"`)
+	}))
+	defer slow.Close()
+	defer unblock()
+
+	var fastRequests atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the slow host answers once the other host got all requests
+		if fastRequests.Add(1) == 5 {
+			unblock()
+		}
+		w.Header().Set("Etag", `"new"`)
+	}))
+	defer fast.Close()
+
+	s := NewEtagStore(EtagStoreOptions{Interval: time.Hour, Workers: 2, PerHost: 1})
+	defer s.Stop()
+	for i := 0; i < 5; i++ {
+		s.Set(fmt.Sprintf("%s/%d", slow.URL, i), `"old"`)
+		s.Set(fmt.Sprintf("%s/%d", fast.URL, i), `"old"`)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.refresh()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		unblock()
+		<-finished
+		t.Fatal("expected the requests to a host not to wait for those to a slow one")
+	}
+	if n := fastRequests.Load(); n != 5 {
+		t.Errorf("expected 5 refresh requests to the fast host, got %d", n)
+	}
+	if etag, _ := s.Get(slow.URL + "/4"); etag != `"new"` {
+		t.Errorf("expected the tokens of the slow host to be refreshed too, got %s", etag)
+	}
+}
+
+func TestEtagStoreRevalidate(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var mu sync.Mutex
+	conditional := make(map[string]bool)
+	var flaky atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conditional[r.URL.Path] = r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/etag":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Etag", `"v1"`)
+		case "/changed":
+			w.Header().Set("Etag", `"v2"`)
+		case "/last-modified":
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Last-Modified", lastModified)
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("expected ranged GET, got Range %q", r.Header.Get("Range"))
+			}
+			w.Header().Set("Etag", `"g1"`)
+			w.WriteHeader(http.StatusPartialContent)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/flaky":
+			if flaky.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNotModified)
+		case "/down":
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewEtagStore(EtagStoreOptions{Interval: time.Hour})
+	defer s.Stop()
+	s.Set(srv.URL+"/etag", `"v1"`)
+	s.Set(srv.URL+"/changed", `"v1"`)
+	s.setFromHeader(srv.URL+"/last-modified", http.Header{"Last-Modified": {lastModified}})
+	s.Set(srv.URL+"/no-head", `"g0"`)
+	s.Set(srv.URL+"/gone", `"x"`)
+	s.Set(srv.URL+"/flaky", `"f"`)
+	s.Set(srv.URL+"/down", `"d"`)
+
+	s.refresh()
+
+	for path, expect := range map[string]string{
+		"/etag":          `"v1"`,
+		"/changed":       `"v2"`,
+		"/last-modified": lastModified,
+		"/no-head":       `"g1"`,
+	} {
+		if etag, _ := s.Get(srv.URL + path); etag != expect {
+			t.Errorf("expected token %s for %s, got %q", expect, path, etag)
+		}
+		if path != "/no-head" && !conditional[path] {
+			t.Errorf("expected conditional refresh request for %s", path)
+		}
+	}
+
+	// gone resources are not handed out anymore, and
+	// removed after repeated failures
+	if _, ok := s.Get(srv.URL + "/gone"); ok {
+		t.Error("expected token of gone resource to be stale")
+	}
+	if _, ok := s.tokens()[srv.URL+"/gone"]; ok {
+		t.Error("expected stale token not to be in the manifest")
+	}
+
+	// transient failures leave the token usable
+	for _, path := range []string{"/flaky", "/down"} {
+		if _, ok := s.Get(srv.URL + path); !ok {
+			t.Errorf("expected token of %s to stay usable after a transient failure", path)
+		}
+		if status, _ := s.status(srv.URL + path); status.Failures != 1 || status.Status == "stale" {
+			t.Errorf("expected one failure counted for %s, got %+v", path, status)
+		}
+	}
+
+	for i := 1; i < maxRefreshFailures; i++ {
+		s.refresh()
+	}
+	if status, _ := s.status(srv.URL + "/flaky"); status.Failures != 0 {
+		t.Errorf("expected a successful refresh to reset the failures, got %d", status.Failures)
+	}
+	if n := s.Len(); n != 5 {
+		t.Errorf("expected gone and unavailable resources to be removed, got %d entries", n)
+	}
+}
+
+func TestEtagStoreEvents(t *testing.T) {
+	s := NewEtagStore(EtagStoreOptions{Interval: time.Hour, MaxEntries: 2})
+	defer s.Stop()
+
+	var first, second []tokenEvent
+	s.subscribe(func(ev tokenEvent) { first = append(first, ev) })
+	unsubscribe := s.subscribe(func(ev tokenEvent) { second = append(second, ev) })
+
+	s.Set("https://a.example/1", `"1"`)
+	s.setFromHeader("https://a.example/1", http.Header{"Etag": []string{`"2"`}})
+	s.refreshed("https://a.example/1", `"3"`, "", false)
+	s.Set("https://a.example/2", `"1"`)
+	s.Set("https://a.example/3", `"1"`)
+	s.Delete("https://a.example/2")
+
+	expect := []tokenEvent{
+		{name: eventTokenAdded, url: "https://a.example/1", etag: `"1"`, source: sourceAPI},
+		{name: eventTokenChanged, url: "https://a.example/1", oldEtag: `"1"`, etag: `"2"`, source: sourceOrigin},
+		{name: eventTokenChanged, url: "https://a.example/1", oldEtag: `"2"`, etag: `"3"`, source: sourceRefresh},
+		{name: eventTokenAdded, url: "https://a.example/2", etag: `"1"`, source: sourceAPI},
+		{name: eventTokenAdded, url: "https://a.example/3", etag: `"1"`, source: sourceAPI},
+		{name: eventTokenRemoved, url: "https://a.example/1", etag: `"3"`, reason: "evicted"},
+		{name: eventTokenRemoved, url: "https://a.example/2", etag: `"1"`, reason: "deleted"},
+	}
+	if fmt.Sprint(second) != fmt.Sprint(expect) {
+		t.Errorf("expected events\n%v\ngot\n%v", expect, second)
+	}
+	if len(first) != 0 {
+		t.Errorf("expected only the last listener to be notified, got %v", first)
+	}
+
+	// the other listener takes over
+	unsubscribe()
+	s.Clear()
+	if len(first) != 1 || first[0].name != eventTokenRemoved || first[0].url != "https://a.example/3" {
+		t.Errorf("expected the cleared token to be reported, got %v", first)
+	}
+}
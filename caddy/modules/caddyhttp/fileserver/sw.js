@@ -1,3 +1,90 @@
+// Settings passed by the server in the registration URL, e.g.
+// /sw.js?header=X-Etag-Config&proxy=/proxy-resource
+// proxyPrefix is null when the server's proxy endpoint is disabled.
+const swParams = new URL(self.location).searchParams;
+const manifestHeader = swParams.get("header") || "X-Etag-Config";
+const proxyPrefix = swParams.get("proxy");
+
+// Compressed variants of a file are served with the etag of the file plus
+// the content coding, e.g. "abc-gzip" for "abc", while manifests hold the
+// token of the file itself.
+const codingSuffix = /-(gzip|br|zstd)"$/;
+const sameToken = (etag, token) =>
+  etag != null && etag.replace(codingSuffix, '"') == token.replace(codingSuffix, '"');
+
+// A manifest holds the tokens of a page's sub-resources as JSON grouped
+// by URL prefix, e.g. {"/css/": {"site.css": "\"abc\""}}, where prefixes
+// starting with "/" are paths of this origin. The server sends it in the
+// manifest header of the page, or the page hands it to the worker in a
+// message. It may instead be "gz:" followed by the gzipped JSON in base64,
+// or "ref:" followed by the URL of the manifest.
+async function decodeManifest(value) {
+  let json;
+  if (value.startsWith("ref:")) {
+    const res = await fetch(new URL(value.slice(4), self.location.origin));
+    json = await res.text();
+  } else if (value.startsWith("gz:")) {
+    const bytes = Uint8Array.from(atob(value.slice(3)), (c) => c.charCodeAt(0));
+    const stream = new Blob([bytes]).stream().pipeThrough(new DecompressionStream("gzip"));
+    json = await new Response(stream).text();
+  } else {
+    json = value;
+  }
+
+  const etags = {};
+  for (const [prefix, group] of Object.entries(JSON.parse(json))) {
+    if (typeof group === "string") {
+      etags[prefix] = group; // flat manifest keyed by absolute URL
+      continue;
+    }
+    const base = prefix.startsWith("/") ? self.location.origin + prefix : prefix;
+    for (const [name, token] of Object.entries(group)) {
+      etags[base + name] = token;
+    }
+  }
+  return etags;
+}
+
+// The tokens of all manifests received are kept in IndexedDB, so that
+// they survive when the browser stops the worker.
+const etagsDB = new Promise((resolve, reject) => {
+  const req = indexedDB.open("cachev2", 1);
+  req.onupgradeneeded = () => req.result.createObjectStore("manifest");
+  req.onsuccess = () => resolve(req.result);
+  req.onerror = () => reject(req.error);
+});
+
+const inEtagsDB = (mode, op) => etagsDB.then((db) => new Promise((resolve, reject) => {
+  const req = op(db.transaction("manifest", mode).objectStore("manifest"));
+  req.onsuccess = () => resolve(req.result);
+  req.onerror = () => reject(req.error);
+}));
+
+const etagsLoaded = inEtagsDB("readonly", (store) => store.get("etags"))
+  .then((etags) => {
+    self.etags = Object.assign(etags || {}, self.etags);
+  })
+  .catch((error) => console.error("[Manifest] Cannot load stored tokens:", error));
+
+// updateEtags adds the tokens of the manifest value to the known ones.
+async function updateEtags(value) {
+  const etags = await decodeManifest(value);
+  await etagsLoaded;
+  self.etags = Object.assign(self.etags || {}, etags);
+  await inEtagsDB("readwrite", (store) => store.put(self.etags, "etags"));
+}
+
+// Pages hand their inline or referenced manifest to the worker, which
+// may not have seen their response, e.g. on the first visit.
+self.addEventListener("message", (evt) => {
+  const manifest = evt.data?.cachev2Manifest;
+  if (typeof manifest === "string") {
+    evt.waitUntil(updateEtags(manifest).catch((error) => {
+      console.error("[Manifest] Invalid manifest from page:", error);
+    }));
+  }
+});
+
 self.addEventListener("install", (evt) => {
     console.log("Service worker installed");
     // Force the waiting service worker to become the active service worker.
@@ -51,13 +138,15 @@ self.addEventListener("install", (evt) => {
     const resFromCache = await caches.match(req);
   
     if (resFromCache) {
-      const etag = resFromCache.headers.get("Etag");
+      await etagsLoaded;
+      // origins without etags are validated by their Last-Modified date
+      const etag = resFromCache.headers.get("Etag") || resFromCache.headers.get("Last-Modified");
       // Use request URL directly as key (assuming referrer isn't part of uniqueness)
       const key = req.url;
       const cachedEtag = self.etags?.[key];
   
       if (cachedEtag) {
-        if (etag == cachedEtag) {
+        if (sameToken(etag, cachedEtag)) {
           return resFromCache;
         } else {
           // ETag mismatch, force network reload (potentially via proxy)
@@ -77,11 +166,11 @@ self.addEventListener("install", (evt) => {
     const requestUrl = req.url;
     const pageOrigin = self.location.origin; // Get current service worker origin
   
-    // Check if it's a cross-origin request
-    if (!isSameOrigin(requestUrl, pageOrigin)) {
+    // Check if it's a cross-origin request that should go through the proxy
+    if (proxyPrefix && !isSameOrigin(requestUrl, pageOrigin)) {
     //   console.log(`[Network] Cross-origin request detected for: ${requestUrl}`);
       // Construct the proxy URL pointing to your Caddy server
-      const proxyUrl = `${pageOrigin}/proxy-resource?url=${encodeURIComponent(requestUrl)}`;
+      const proxyUrl = `${pageOrigin}${proxyPrefix}?url=${encodeURIComponent(requestUrl)}`;
     //   console.log(`[Network] Rewriting to proxy: ${proxyUrl}`);
       // Create a new request object targeting the proxy
       fetchRequest = new Request(proxyUrl, {
@@ -97,15 +186,25 @@ self.addEventListener("install", (evt) => {
   
     // Next try to get the resource from the network (either directly or via proxy)
     try {
-      const resFromNetwork = await fetch(fetchRequest, options); // Use fetchRequest here
+      let resFromNetwork = await fetch(fetchRequest, options); // Use fetchRequest here
+
+      // The proxy refuses resources that it may not fetch, e.g. ones
+      // the site's pages did not reference; load those directly.
+      if (fetchRequest !== req && resFromNetwork.status === 403) {
+        resFromNetwork = await fetch(req, options);
+      }
   
       // Check for special header from Caddy indicating it's the initial HTML load
       // This header might now come from the proxy response if the HTML itself was proxied,
       // or directly if it was a same-origin request.
-      const etagsJson = resFromNetwork.headers.get("X-Etag-Config");
+      const etagsJson = resFromNetwork.headers.get(manifestHeader);
       if (etagsJson != null) {
-        // console.log(`[Network] Found X-Etag-Config for ${req.url}. Parsing and updating self.etags.`);
-        self.etags = JSON.parse(etagsJson);
+        // console.log(`[Network] Found ${manifestHeader} for ${req.url}. Parsing and updating self.etags.`);
+        try {
+          await updateEtags(etagsJson);
+        } catch (error) {
+          console.error(`[Network] Invalid ${manifestHeader} for ${req.url}:`, error);
+        }
         // Don't cache the initial HTML load response itself typically
         // return resFromNetwork;
       }
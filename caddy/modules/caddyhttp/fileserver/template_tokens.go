@@ -0,0 +1,136 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+)
+
+// templateTokens provides the validation tokens of a page to the
+// functions of the templates handler, which collect the manifest of the
+// page as the template is executed, instead of it being extracted from
+// the rendered page.
+type templateTokens struct {
+	engine *cacheV2Engine
+	w      http.ResponseWriter
+	r      *http.Request
+
+	tokens     map[string]string
+	registered bool
+}
+
+// Interface guard
+var _ templates.ValidationTokens = (*templateTokens)(nil)
+
+// Etag implements templates.ValidationTokens.
+func (t *templateTokens) Etag(ref string) (string, error) {
+	_, token, err := t.token(ref)
+	if err != nil {
+		return "", err
+	}
+	return queryToken(token), nil
+}
+
+// URL implements templates.ValidationTokens. The token is added to the
+// query as v, and the versioned URL gets the token of the resource in
+// the manifest, since the file server serves it with the same etag.
+func (t *templateTokens) URL(ref string) (string, error) {
+	u, token, err := t.token(ref)
+	if err != nil || token == "" {
+		return ref, err
+	}
+	versioned, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	v := queryToken(token)
+	if versioned.RawQuery != "" {
+		versioned.RawQuery += "&"
+	}
+	versioned.RawQuery += "v=" + v
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += "v=" + v
+	u.Fragment = ""
+	t.tokens[u.String()] = token
+	return versioned.String(), nil
+}
+
+// queryToken returns the etag token without quotes, escaped for URLs.
+func queryToken(token string) string {
+	return url.QueryEscape(strings.Trim(strings.TrimPrefix(token, "W/"), `"`))
+}
+
+// token looks up the token of the resource at ref, which is relative
+// to the page, and returns it with the absolute URL of the resource.
+func (t *templateTokens) token(ref string) (*url.URL, string, error) {
+	u, err := resolveURL(documentURL(t.r), ref)
+	if err != nil {
+		return nil, "", err
+	}
+	t.lookup([]string{ref})
+	return u, t.tokens[u.String()], nil
+}
+
+// Manifest implements templates.ValidationTokens.
+func (t *templateTokens) Manifest(refs ...string) (string, error) {
+	if !t.engine.enabledFor(t.r) {
+		return "", nil
+	}
+	t.lookup(refs)
+	data, err := encodeManifest(t.tokens, documentURL(t.r))
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	json.HTMLEscape(buf, data)
+	return buf.String(), nil
+}
+
+// Register implements templates.ValidationTokens. The manifest is
+// delivered as configured, so the response must not have been written.
+func (t *templateTokens) Register() (string, error) {
+	if !t.engine.enabledFor(t.r) || t.registered {
+		return "", nil
+	}
+	t.lookup(nil)
+	data, _, header, err := t.engine.prepareManifest(t.tokens, documentURL(t.r))
+	if err != nil {
+		return "", err
+	}
+	nodes, err := t.engine.registrationNodes(data, header)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	for _, node := range nodes {
+		if err := html.Render(buf, node); err != nil {
+			return "", err
+		}
+	}
+	t.engine.deliverManifest(t.w, header)
+	t.registered = true
+	return buf.String(), nil
+}
+
+// lookup adds the tokens of the resources at refs, and of those they
+// reference up to the crawl depth, to the manifest of the page.
+func (t *templateTokens) lookup(refs []string) {
+	if t.tokens == nil {
+		t.tokens = make(map[string]string)
+	}
+	if len(refs) == 0 {
+		return
+	}
+	_, tokens := t.engine.crawler.crawl(t.r, documentURL(t.r), refs)
+	for key, token := range tokens {
+		t.tokens[key] = token
+	}
+}
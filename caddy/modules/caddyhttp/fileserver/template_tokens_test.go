@@ -0,0 +1,102 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+)
+
+func TestCacheV2TemplateFunctions(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{"site.css": "body{}", "app.js": "run()"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine, err := newCacheV2Engine(CacheV2Config{}, &FileResolver{Root: root, fileSystem: osFS{}}, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &CacheV2{engine: engine}
+	tpl := new(templates.Templates)
+	if err := tpl.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(root, "site.css"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cssEtag := fileEtag(osFS{}, filepath.Join(root, "site.css"), info, nil)
+
+	serve := func(page, contentType string, enabled bool) *http.Response {
+		t.Helper()
+		origin := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", contentType)
+			_, err := w.Write([]byte(page))
+			return err
+		})
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return tpl.ServeHTTP(w, r, origin)
+		})
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/page.html", nil)
+		if enabled {
+			req.Header.Set("X-CacheV2-Extension-Enabled", "true")
+		}
+		rr := httptest.NewRecorder()
+		if err := c.ServeHTTP(rr, withTestReplacer(req), next); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Result()
+	}
+
+	// pages which register themselves are not rewritten, and get the
+	// manifest of the resources they looked up
+	page := `<html><head><link rel="stylesheet" href="{{cachev2URL "site.css"}}"></head><body>{{cachev2Register}}</body></html>`
+	resp := serve(page, "text/html", true)
+	body := readBody(t, resp)
+	version := strings.Trim(cssEtag, `"`)
+	if !strings.Contains(body, `href="site.css?v=`+version+`"`) {
+		t.Errorf("expected the versioned URL of the style sheet in the page, got %s", body)
+	}
+	if n := strings.Count(body, "serviceWorker.register"); n != 1 {
+		t.Errorf("expected the page to be registered once, got %d times: %s", n, body)
+	}
+	if !strings.HasSuffix(body, "</script></body></html>") {
+		t.Errorf("expected the registration at the end of the body, got %s", body)
+	}
+	var manifest map[string]map[string]string
+	if err := json.Unmarshal([]byte(resp.Header.Get("X-Etag-Config")), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest["/"]["site.css?v="+version] != cssEtag {
+		t.Errorf("expected the versioned URL of the style sheet in the manifest, got %v", manifest)
+	}
+
+	// the manifest includes the resources given to it
+	resp = serve(`{{etag "/site.css"}} {{cachev2Manifest "/app.js" "/missing.js"}}`, "text/plain", true)
+	body = readBody(t, resp)
+	_, data, _ := strings.Cut(body, " ")
+	manifest = nil
+	if err := json.Unmarshal([]byte(data), &manifest); err != nil {
+		t.Fatalf("expected a manifest, got %s: %v", body, err)
+	}
+	if len(manifest["/"]) != 2 || manifest["/"]["app.js"] == "" {
+		t.Errorf("expected the style sheet and the script in the manifest, got %v", manifest)
+	}
+
+	// clients which did not opt in only get tokens
+	resp = serve(`{{etag "/site.css"}}|{{cachev2Manifest}}|{{cachev2Register}}`, "text/html", false)
+	if body := readBody(t, resp); body != version+"||" {
+		t.Errorf("expected only the token, got %s", body)
+	}
+}
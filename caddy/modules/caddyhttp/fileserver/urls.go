@@ -0,0 +1,136 @@
+package fileserver
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// documentURL returns the absolute URL of the document requested by r as
+// the browser sees it, i.e. before any internal rewrites were applied.
+func documentURL(r *http.Request) *url.URL {
+	req := r
+	if origReq, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		req = &origReq
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return normalizeURL(&url.URL{
+		Scheme:   scheme,
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	})
+}
+
+// documentBaseURL returns the URL against which the references in the
+// document at root are resolved: the href of its first <base> element
+// that has one, resolved against docURL, or docURL itself.
+func documentBaseURL(root *html.Node, docURL *url.URL) *url.URL {
+	var base *url.URL
+	var find func(n *html.Node) bool
+	find = func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Base {
+			for _, attr := range n.Attr {
+				if attr.Namespace == "" && attr.Key == "href" {
+					if u, err := resolveURL(docURL, attr.Val); err == nil {
+						base = u
+					}
+					return true
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if find(c) {
+				return true
+			}
+		}
+		return false
+	}
+	find(root)
+
+	if base == nil {
+		return docURL
+	}
+	return base
+}
+
+// urlWhitespaceRemover removes the characters that browsers
+// strip from anywhere in a URL before parsing it.
+var urlWhitespaceRemover = strings.NewReplacer("\t", "", "\n", "", "\r", "")
+
+// resolveURL resolves ref against base like browsers do according to the
+// WHATWG URL standard: leading and trailing C0 controls and spaces as well
+// as tabs and newlines are ignored, backslashes in the path of http(s)
+// URLs are treated as slashes, and the fragment is dropped. The result
+// is normalized, so that it serializes the same as in browsers.
+func resolveURL(base *url.URL, ref string) (*url.URL, error) {
+	ref = strings.TrimFunc(ref, func(r rune) bool { return r <= ' ' })
+	ref = urlWhitespaceRemover.Replace(ref)
+
+	if end := strings.IndexAny(ref, "?#"); end != 0 {
+		if end < 0 {
+			end = len(ref)
+		}
+		if isSpecialScheme(base.Scheme) || isSpecialScheme(refScheme(ref[:end])) {
+			ref = strings.ReplaceAll(ref[:end], `\`, "/") + ref[end:]
+		}
+	}
+
+	u, err := base.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	return normalizeURL(u), nil
+}
+
+// refScheme returns the lowercased scheme of the URL reference
+// ref, or an empty string if it has none.
+func refScheme(ref string) string {
+	i := strings.IndexByte(ref, ':')
+	if i <= 0 || strings.ContainsAny(ref[:i], "/?#") {
+		return ""
+	}
+	return strings.ToLower(ref[:i])
+}
+
+// isSpecialScheme returns true for the schemes of URLs that
+// CacheV2 deals with and that browsers parse specially.
+func isSpecialScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// normalizeURL lowercases the scheme and host of u, removes the
+// default port and gives it a path of "/" if it has none.
+func normalizeURL(u *url.URL) *url.URL {
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if host, port, err := net.SplitHostPort(u.Host); err == nil &&
+		(u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443") {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u.Host = host
+	}
+	if u.Path == "" && u.Host != "" {
+		u.Path = "/"
+	}
+	return u
+}
+
+// sameOrigin returns true if a and b, which must be normalized,
+// have the same scheme, host and port.
+func sameOrigin(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host
+}
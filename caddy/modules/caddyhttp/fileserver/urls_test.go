@@ -0,0 +1,130 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/net/html"
+)
+
+func TestResolveURL(t *testing.T) {
+	base, err := url.Parse("https://example.com/blog/post/index.html?page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		ref    string
+		expect string
+	}{
+		{ref: "style.css", expect: "https://example.com/blog/post/style.css"},
+		{ref: "./img/a.png?v=3", expect: "https://example.com/blog/post/img/a.png?v=3"},
+		{ref: "../../app.js#main", expect: "https://example.com/app.js"},
+		{ref: "../../../../app.js", expect: "https://example.com/app.js"},
+		{ref: "/css/site.css", expect: "https://example.com/css/site.css"},
+		{ref: "?v=2", expect: "https://example.com/blog/post/index.html?v=2"},
+		{ref: "//cdn.example.net/lib.js", expect: "https://cdn.example.net/lib.js"},
+		{ref: "HTTPS://Example.COM:443/a.png", expect: "https://example.com/a.png"},
+		{ref: "http://example.com:80", expect: "http://example.com/"},
+		{ref: "https://example.com:8443/a.png", expect: "https://example.com:8443/a.png"},
+		{ref: "  \t/a\nb.png ", expect: "https://example.com/ab.png"},
+		{ref: `\img\a.png`, expect: "https://example.com/img/a.png"},
+		{ref: `/search?q=a\b`, expect: `https://example.com/search?q=a\b`},
+		{ref: "/a%20b.png", expect: "https://example.com/a%20b.png"},
+	} {
+		actual, err := resolveURL(base, tc.ref)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error resolving %q: %v", i, tc.ref, err)
+			continue
+		}
+		if actual.String() != tc.expect {
+			t.Errorf("Test %d: expected %q to resolve to %s, got %s", i, tc.ref, tc.expect, actual)
+		}
+	}
+}
+
+func TestDocumentURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://Example.com:443/blog/index.html?a=1", nil)
+	if actual := documentURL(req).String(); actual != "https://example.com/blog/index.html?a=1" {
+		t.Errorf("expected TLS request URL, got %s", actual)
+	}
+
+	// the original request is what the browser sees
+	req = httptest.NewRequest(http.MethodGet, "http://example.com:8080/blog/", nil)
+	rewritten := req.Clone(context.WithValue(req.Context(), caddyhttp.OriginalRequestCtxKey, *req))
+	rewritten.URL.Path = "/blog/index.html"
+	rewritten.TLS = &tls.ConnectionState{}
+	if actual := documentURL(rewritten).String(); actual != "http://example.com:8080/blog/" {
+		t.Errorf("expected original request URL, got %s", actual)
+	}
+}
+
+func TestDocumentBaseURL(t *testing.T) {
+	docURL, err := url.Parse("http://example.com/blog/post.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		doc    string
+		expect string
+	}{
+		{
+			doc:    `<html><head><title>x</title></head></html>`,
+			expect: "http://example.com/blog/post.html",
+		},
+		{
+			doc:    `<html><head><base href="/static/"></head></html>`,
+			expect: "http://example.com/static/",
+		},
+		{
+			doc:    `<html><head><base target="_blank"><base href="assets/"><base href="/ignored/"></head></html>`,
+			expect: "http://example.com/blog/assets/",
+		},
+		{
+			doc:    `<html><head><base href="https://cdn.example.net/v1/"></head></html>`,
+			expect: "https://cdn.example.net/v1/",
+		},
+	} {
+		root, err := html.Parse(strings.NewReader(tc.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := documentBaseURL(root, docURL).String(); actual != tc.expect {
+			t.Errorf("Test %d: expected base %s, got %s", i, tc.expect, actual)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	origin, err := url.Parse("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		ref    string
+		expect bool
+	}{
+		{ref: "/a.css", expect: true},
+		{ref: "http://EXAMPLE.com:80/a.css", expect: true},
+		{ref: "https://example.com/a.css", expect: false},
+		{ref: "http://example.com:8080/a.css", expect: false},
+		{ref: "//localhost/a.css", expect: false},
+		{ref: "http://example.com.evil.net/a.css", expect: false},
+	} {
+		u, err := resolveURL(origin, tc.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := sameOrigin(u, origin); actual != tc.expect {
+			t.Errorf("Test %d: expected sameOrigin(%s)=%t, got %t", i, u, tc.expect, actual)
+		}
+	}
+}
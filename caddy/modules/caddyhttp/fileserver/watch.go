@@ -0,0 +1,282 @@
+package fileserver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// changeNotifier is implemented by resolvers which notice when resources
+// change, so that CacheV2 can drop what it derived from them.
+type changeNotifier interface {
+	// onChange registers fn to be called with the request path of every
+	// resource that changed, or with an empty path if any may have, and
+	// a function which returns the current token of a resource by its
+	// request path, or "" if it does not exist.
+	onChange(fn func(target string, etag func(target string) string))
+}
+
+// maxWatchedRoots is the maximum number of root directories a file
+// resolver watches; files below others are looked up on disk.
+const maxWatchedRoots = 16
+
+// maxIndexedFiles is the maximum number of files whose etags a file
+// index holds.
+const maxIndexedFiles = 1 << 17
+
+// fileWatchers holds the indexes of the root directories which a file
+// resolver watches. Since the root may contain placeholders, the
+// directories are watched once files below them are resolved.
+type fileWatchers struct {
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	indexes   map[string]*fileIndex // by root; nil if watching failed
+	listeners []func(root, filename string)
+	closed    bool
+}
+
+func newFileWatchers(logger *zap.Logger) *fileWatchers {
+	return &fileWatchers{
+		logger:  logger,
+		indexes: make(map[string]*fileIndex),
+	}
+}
+
+// index returns the index of the files below root, or nil if root is
+// not watched.
+func (fw *fileWatchers) index(root string) *fileIndex {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if idx, ok := fw.indexes[root]; ok || fw.closed {
+		return idx
+	}
+	if len(fw.indexes) >= maxWatchedRoots {
+		return nil
+	}
+	idx, err := newFileIndex(root, fw.changed, fw.logger)
+	if err != nil {
+		fw.logger.Warn("cannot watch root directory; resolving tokens from disk",
+			zap.String("root", root),
+			zap.Error(err))
+	}
+	fw.indexes[root] = idx
+	return idx
+}
+
+// subscribe registers fn to be called with the root and the name of
+// every file that changed below it, or an empty name if any may have.
+func (fw *fileWatchers) subscribe(fn func(root, filename string)) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.listeners = append(fw.listeners, fn)
+}
+
+func (fw *fileWatchers) changed(root, filename string) {
+	fw.mu.Lock()
+	listeners := fw.listeners
+	fw.mu.Unlock()
+	for _, fn := range listeners {
+		fn(root, filename)
+	}
+}
+
+// close stops watching all root directories.
+func (fw *fileWatchers) close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	var errs []error
+	for root, idx := range fw.indexes {
+		if idx != nil {
+			errs = append(errs, idx.watcher.Close())
+		}
+		delete(fw.indexes, root)
+	}
+	fw.closed = true
+	return errors.Join(errs...)
+}
+
+// fileIndex holds the etags of the files below a root directory, which
+// is watched for changes, so that the etags of files which did not
+// change are known without looking at the files. Entries are removed
+// when their files change and added again when they are resolved next.
+type fileIndex struct {
+	root    string
+	watcher *fsnotify.Watcher
+	changed func(root, filename string)
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	ready  bool              // once all directories below root are watched
+	failed bool              // if a directory could not be watched
+	gen    uint64            // incremented with every change
+	etags  map[string]string // by file name; empty for files that do not exist
+}
+
+// newFileIndex starts watching the directories below root in the
+// background; until they are all watched, the index holds nothing.
+// Changes are reported to changed.
+func newFileIndex(root string, changed func(root, filename string), logger *zap.Logger) (*fileIndex, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	idx := &fileIndex{
+		root:    filepath.Clean(root),
+		watcher: watcher,
+		changed: changed,
+		logger:  logger,
+		etags:   make(map[string]string),
+	}
+	go idx.watch()
+	go func() {
+		if err := idx.addTree(idx.root, make(map[string]bool)); err != nil {
+			idx.disable(err)
+			return
+		}
+		idx.mu.Lock()
+		idx.ready = !idx.failed
+		idx.mu.Unlock()
+	}()
+	return idx, nil
+}
+
+// addTree watches dir and the directories below it, including those
+// that symbolic links point to. seen holds the directories that are
+// watched already, by real path, so that links cannot form cycles.
+func (idx *fileIndex) addTree(dir string, seen map[string]bool) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				// walked from the trailing separator, the link is
+				// followed instead of being reported as is
+				return idx.addTree(path+string(filepath.Separator), seen)
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return nil
+		}
+		if seen[real] {
+			return filepath.SkipDir
+		}
+		seen[real] = true
+		return idx.watcher.Add(path)
+	})
+}
+
+// watch handles the events of the watcher until it is closed.
+func (idx *fileIndex) watch() {
+	for {
+		select {
+		case event, ok := <-idx.watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Clean(event.Name)
+			// new directories are watched too; files may have been
+			// created in them before, which went unnoticed
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(name); err == nil && info.IsDir() {
+					if err := idx.addTree(name, make(map[string]bool)); err != nil {
+						idx.disable(err)
+					}
+				}
+			}
+			idx.invalidate(name, !event.Has(fsnotify.Write) && !event.Has(fsnotify.Chmod))
+		case err, ok := <-idx.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events were lost, e.g. because the queue overflowed
+			idx.logger.Warn("watching root directory",
+				zap.String("root", idx.root),
+				zap.Error(err))
+			idx.invalidate("", true)
+		}
+	}
+}
+
+// invalidate removes the entry of the file name from the index, and
+// the entries below it if it may be a directory. An empty name removes
+// all entries.
+func (idx *fileIndex) invalidate(name string, tree bool) {
+	idx.mu.Lock()
+	idx.gen++
+	if name == "" {
+		idx.etags = make(map[string]string)
+	} else {
+		delete(idx.etags, name)
+		if tree {
+			prefix := name + string(filepath.Separator)
+			for filename := range idx.etags {
+				if strings.HasPrefix(filename, prefix) {
+					delete(idx.etags, filename)
+				}
+			}
+		}
+	}
+	idx.mu.Unlock()
+	idx.changed(idx.root, name)
+}
+
+// disable empties the index for good after changes could no longer be
+// watched, so that all files are looked up on disk again.
+func (idx *fileIndex) disable(err error) {
+	if errors.Is(err, fsnotify.ErrClosed) {
+		return
+	}
+	idx.logger.Warn("cannot watch root directory; resolving tokens from disk",
+		zap.String("root", idx.root),
+		zap.Error(err))
+	idx.mu.Lock()
+	idx.ready = false
+	idx.failed = true
+	idx.gen++
+	idx.etags = make(map[string]string)
+	idx.mu.Unlock()
+	idx.changed(idx.root, "")
+}
+
+// etag returns the etag of the file filename from the index, or else
+// from resolve, whose result is added to the index unless the file
+// changed meanwhile.
+func (idx *fileIndex) etag(filename string, resolve func() (string, error)) (string, error) {
+	idx.mu.Lock()
+	ready, gen := idx.ready, idx.gen
+	etag, ok := idx.etags[filename]
+	idx.mu.Unlock()
+	if ok {
+		if etag == "" {
+			return "", fs.ErrNotExist
+		}
+		return etag, nil
+	}
+
+	etag, err := resolve()
+	if !ready || (err != nil && !errors.Is(err, fs.ErrNotExist)) {
+		return etag, err
+	}
+	idx.mu.Lock()
+	if idx.ready && idx.gen == gen && len(idx.etags) < maxIndexedFiles {
+		idx.etags[filename] = etag
+	}
+	idx.mu.Unlock()
+	return etag, err
+}
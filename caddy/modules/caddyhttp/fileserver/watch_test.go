@@ -0,0 +1,142 @@
+package fileserver
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// eventually fails the test if check does not return true within a few
+// seconds, since the watcher reports changes asynchronously.
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileResolverWatch(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string, mtime time.Time) {
+		filename := filepath.Join(root, name)
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("site.css", "body{}", now)
+
+	fr := &FileResolver{Root: root, fileSystem: osFS{}, watchers: newFileWatchers(zap.NewNop())}
+	defer fr.Cleanup()
+	var mu sync.Mutex
+	var changed, tokens []string
+	fr.onChange(func(target string, etag func(string) string) {
+		mu.Lock()
+		defer mu.Unlock()
+		changed = append(changed, target)
+		tokens = append(tokens, etag(target))
+	})
+
+	req := withTestReplacer(httptest.NewRequest(http.MethodGet, "/", nil))
+	resolve := func(target string) (string, error) {
+		return fr.ResolveETag(req, target)
+	}
+	idx := fr.watchers.index(root)
+	eventually(t, "the root is watched", func() bool {
+		idx.mu.Lock()
+		defer idx.mu.Unlock()
+		return idx.ready
+	})
+
+	etag, err := resolve("/site.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.mu.Lock()
+	indexed := idx.etags[filepath.Join(root, "site.css")]
+	idx.mu.Unlock()
+	if indexed != etag {
+		t.Errorf("expected the token %s to be indexed, got %q", etag, indexed)
+	}
+
+	// changed files are resolved again
+	write("site.css", "body{color:red}", now.Add(time.Hour))
+	eventually(t, "the changed token is resolved", func() bool {
+		newEtag, err := resolve("/site.css")
+		return err == nil && newEtag != etag
+	})
+	newEtag, _ := resolve("/site.css")
+	mu.Lock()
+	if len(changed) == 0 || changed[0] != "/site.css" {
+		t.Errorf("expected the change of /site.css to be reported, got %v", changed)
+	} else if tokens[len(tokens)-1] != newEtag {
+		t.Errorf("expected the change to be reported with the new token %s, got %v", newEtag, tokens)
+	}
+	mu.Unlock()
+
+	// files in new directories are noticed, even if they were missing
+	if _, err := resolve("/img/logo.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected missing file, got %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "img"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write("img/logo.png", "png", now)
+	eventually(t, "the new file is resolved", func() bool {
+		_, err := resolve("/img/logo.png")
+		return err == nil
+	})
+}
+
+func TestWatchRemovesDependentPages(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "logo.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fr := &FileResolver{Root: root, fileSystem: osFS{}, watchers: newFileWatchers(zap.NewNop())}
+	defer fr.Cleanup()
+	e, err := newCacheV2Engine(CacheV2Config{}, fr, nil, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := withTestReplacer(httptest.NewRequest(http.MethodGet, "/", nil))
+	page := []byte(`<html><head></head><body><img src="/logo.png"></body></html>`)
+	_, _, err = e.rewrite(httptest.NewRecorder(), req, `"a"`, func() ([]byte, error) { return page, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := documentURL(req).String()
+	if _, ok := e.pages.get(key); !ok {
+		t.Fatal("expected the page to be memoized")
+	}
+	idx := fr.watchers.index(root)
+	eventually(t, "the root is watched", func() bool {
+		idx.mu.Lock()
+		defer idx.mu.Unlock()
+		return idx.ready
+	})
+
+	if err := os.Remove(filepath.Join(root, "logo.png")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the page is dropped", func() bool {
+		_, ok := e.pages.get(key)
+		return !ok
+	})
+}
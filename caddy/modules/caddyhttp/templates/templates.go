@@ -304,6 +304,50 @@ func init() {
 // {{humanize "time" "Fri, 05 May 2022 15:04:05 +0200"}}
 // {{humanize "time:2006-Jan-02" "2022-May-05"}}
 // ```
+//
+// ##### `etag`
+//
+// Returns the CacheV2 validation token of a resource, whose URL is
+// relative to the page, and adds it to the page's manifest. The token
+// is returned without quotes and escaped for URLs, and it is empty if
+// it is not known. Requires the `cachev2` handler to come before
+// `templates`.
+//
+// ```
+// <link rel="stylesheet" href="/css/site.css" data-version="{{etag "/css/site.css"}}">
+// ```
+//
+// ##### `cachev2URL`
+//
+// Returns the URL of a resource with its CacheV2 validation token in the
+// query, as `v`, and adds that URL to the page's manifest, so that the
+// service worker knows the token of the URL the page actually uses.
+//
+// ```
+// <link rel="stylesheet" href="{{cachev2URL "/css/site.css"}}">
+// ```
+//
+// ##### `cachev2Manifest`
+//
+// Returns the CacheV2 manifest of the page as JSON, with the tokens of
+// the resources passed to `etag` and `cachev2URL` so far and of those
+// given as arguments.
+// It is empty unless the client opted in to CacheV2.
+//
+// ```
+// <script type="application/json">{{cachev2Manifest "/js/app.js"}}</script>
+// ```
+//
+// ##### `cachev2Register`
+//
+// Returns the scripts which register the CacheV2 service worker and hand
+// it the page's manifest, which should be complete by then, so it is best
+// placed at the end of the page. The `cachev2` handler does not rewrite
+// pages which use it. It is empty unless the client opted in to CacheV2.
+//
+// ```
+// {{cachev2Register}}
+// ```
 type Templates struct {
 	// The root path from which to load files. Required if template functions
 	// accessing the file system are used (such as include). Default is
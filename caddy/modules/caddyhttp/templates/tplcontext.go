@@ -88,6 +88,10 @@ func (c *TemplateContext) NewTemplate(tplName string) *template.Template {
 		"fileExists":       c.funcFileExists,
 		"httpError":        c.funcHTTPError,
 		"humanize":         c.funcHumanize,
+		"etag":             c.funcEtag,
+		"cachev2URL":       c.funcCacheV2URL,
+		"cachev2Manifest":  c.funcCacheV2Manifest,
+		"cachev2Register":  c.funcCacheV2Register,
 	})
 	return c.tpl
 }
@@ -492,6 +496,83 @@ func (c TemplateContext) funcHumanize(formatType, data string) (string, error) {
 	return "", fmt.Errorf("no know function was given")
 }
 
+// funcEtag returns the CacheV2 validation token of the resource at the
+// URL ref, which is relative to the page, without quotes and escaped
+// for URLs, and adds it to the manifest of the page. It is empty if the
+// resource has no known token.
+func (c TemplateContext) funcEtag(ref string) (string, error) {
+	tokens, err := c.validationTokens()
+	if err != nil {
+		return "", err
+	}
+	return tokens.Etag(ref)
+}
+
+// funcCacheV2URL returns ref with the CacheV2 validation token of the
+// resource in its query, and adds that URL to the manifest of the page.
+func (c TemplateContext) funcCacheV2URL(ref string) (string, error) {
+	tokens, err := c.validationTokens()
+	if err != nil {
+		return "", err
+	}
+	return tokens.URL(ref)
+}
+
+// funcCacheV2Manifest returns the CacheV2 manifest of the page as JSON,
+// with the tokens of the resources looked up so far and those of refs.
+func (c TemplateContext) funcCacheV2Manifest(refs ...string) (string, error) {
+	tokens, err := c.validationTokens()
+	if err != nil {
+		return "", err
+	}
+	return tokens.Manifest(refs...)
+}
+
+// funcCacheV2Register returns the HTML which registers the CacheV2
+// service worker and hands it the manifest of the page.
+func (c TemplateContext) funcCacheV2Register() (string, error) {
+	tokens, err := c.validationTokens()
+	if err != nil {
+		return "", err
+	}
+	return tokens.Register()
+}
+
+func (c TemplateContext) validationTokens() (ValidationTokens, error) {
+	tokens, ok := c.Req.Context().Value(ValidationTokensCtxKey).(ValidationTokens)
+	if !ok {
+		return nil, fmt.Errorf("cachev2 validation tokens not available; the cachev2 handler must come before templates")
+	}
+	return tokens, nil
+}
+
+// ValidationTokens gives templates the CacheV2 validation tokens of the
+// resources of the page they render. The cachev2 handler stores one in
+// the request context under ValidationTokensCtxKey.
+type ValidationTokens interface {
+	// Etag returns the token of the resource at the URL ref, which is
+	// relative to the page, and adds it to the manifest of the page.
+	// The token is returned without quotes and escaped for URLs.
+	Etag(ref string) (string, error)
+
+	// URL returns ref with the token of the resource in its query, and
+	// adds that URL to the manifest of the page.
+	URL(ref string) (string, error)
+
+	// Manifest returns the manifest of the page as JSON, escaped for
+	// HTML, with the tokens of the resources looked up so far and
+	// those of refs.
+	Manifest(refs ...string) (string, error)
+
+	// Register returns the HTML which registers the service worker and
+	// hands it the manifest of the page. The page is then not rewritten.
+	Register() (string, error)
+}
+
+// ValidationTokensCtxKey is the key of the ValidationTokens in the
+// context of requests.
+const ValidationTokensCtxKey caddy.CtxKey = "cachev2_validation_tokens"
+
 // WrappedHeader wraps niladic functions so that they
 // can be used in templates. (Template functions must
 // return a value.)
@@ -654,6 +654,35 @@ func TestHumanize(t *testing.T) {
 	}
 }
 
+type fakeTokens map[string]string
+
+func (f fakeTokens) Etag(ref string) (string, error) { return f[ref], nil }
+
+func (f fakeTokens) URL(ref string) (string, error) { return ref + "?v=" + f[ref], nil }
+
+func (f fakeTokens) Manifest(refs ...string) (string, error) {
+	return fmt.Sprintf("%d+%d", len(f), len(refs)), nil
+}
+
+func (f fakeTokens) Register() (string, error) { return "<script></script>", nil }
+
+func TestValidationTokens(t *testing.T) {
+	tplContext := getContextOrFail(t)
+	if _, err := tplContext.funcEtag("/a.css"); err == nil {
+		t.Error("expected an error without validation tokens")
+	}
+
+	tokens := fakeTokens{"/a.css": "a"}
+	tplContext.Req = tplContext.Req.WithContext(context.WithValue(tplContext.Req.Context(), ValidationTokensCtxKey, tokens))
+	buf := bytes.NewBufferString(`{{etag "/a.css"}} {{cachev2URL "/a.css"}} {{cachev2Manifest "/b.js"}} {{cachev2Register}}`)
+	if err := tplContext.executeTemplateInBuffer("test", buf); err != nil {
+		t.Fatal(err)
+	}
+	if expect := `a /a.css?v=a 1+1 <script></script>`; buf.String() != expect {
+		t.Errorf("expected %s, got %s", expect, buf.String())
+	}
+}
+
 func getContextOrFail(t *testing.T) TemplateContext {
 	tplContext, err := initTestContext()
 	t.Cleanup(func() {